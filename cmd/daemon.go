@@ -0,0 +1,99 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/daemon"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ux"
+	"github.com/spf13/cobra"
+)
+
+// daemonCmd runs atund: the process that owns all tunnels of the machine. `atun up` starts it when needed.
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the atun daemon owning all tunnels of this machine",
+	Long: `Runs the atun daemon in the foreground. The daemon owns the tunnels of all environments and profiles
+and serves a versioned JSON API on a Unix socket in the app directory (~/.atun/atund.sock).
+
+atun up starts the daemon in the background when it isn't running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		socketPath := daemon.GetSocketPath(config.App.Config.AppDir)
+
+		l, err := daemon.Listen(socketPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.Remove(socketPath)
+		}()
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		logger.Info("Daemon is listening", "socket", socketPath, "api", daemon.APIVersion, "pid", os.Getpid())
+
+		return daemon.NewServer().Serve(ctx, l)
+	},
+}
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the daemon and the tunnels it owns",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := daemon.Connect(cmd.Context(), config.App.Config.AppDir)
+		if err != nil {
+			ux.Println("Daemon is not running")
+			return nil
+		}
+
+		v, err := client.Version(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		tunnels, err := client.List(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		ux.Println(fmt.Sprintf("Daemon is running with pid %d (version %s, API %s)", v.PID, v.Version, v.APIVersion))
+		ux.RenderDaemonTunnelsTable(tunnels)
+
+		return nil
+	},
+}
+
+var daemonStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Bring all tunnels down and stop the daemon",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := daemon.Connect(cmd.Context(), config.App.Config.AppDir)
+		if err != nil {
+			ux.Println("Daemon is not running")
+			return nil
+		}
+
+		if err := client.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("can't stop the daemon: %w", err)
+		}
+
+		ux.Println("Daemon is stopping")
+		return nil
+	},
+}
+
+func init() {
+	daemonCmd.AddCommand(daemonStatusCmd)
+	daemonCmd.AddCommand(daemonStopCmd)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
 	"github.com/automationd/atun/internal/constraints"
+	"github.com/automationd/atun/internal/hostsfile"
 	"github.com/automationd/atun/internal/logger"
 	"github.com/automationd/atun/internal/ssh"
 	"github.com/automationd/atun/internal/tunnel"
@@ -26,51 +27,121 @@ var downCmd = &cobra.Command{
 	Long:  `Bring the existing tunnel down.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		logger.Debug("Down command called")
-		var (
-			err          error
-			routerHostID string
-		)
-
-		// Check Constraints
-		//if err := constraints.CheckConstraints(
-		//	constraints.WithRouterHostID(),
-		//); err != nil {
-		//	return err
-		//}
 
-		if err := constraints.CheckConstraints(
-			constraints.WithAWSProfile(),
-			//constraints.WithAWSRegion(), // Can be derived on the session level
-			constraints.WithENV(),
-		); err != nil {
-			return err
-		}
+		all, _ := cmd.Flags().GetBool("all")
+		targets := getTargets()
 
-		ux.Println("Deactivating Tunnel")
+		if !all && len(targets) == 1 {
+			return downTunnel(cmd, args, cmd.Flag("router").Value.String())
+		}
 
-		routerHostID = cmd.Flag("router").Value.String()
+		if cmd.Flag("router").Value.String() != "" {
+			return fmt.Errorf("--router can't be used with --all or several environments or profiles")
+		}
 
-		// If router ID is not provided via a flag
-		if routerHostID == "" {
+		base := config.App
 
-			spinnerGetRouterHostFromExistingSession := ux.NewProgressSpinner("Checking existing / previous sessions")
-			routerHostID, err = ssh.GetRouterHostIDFromExistingSession(config.App.Config.TunnelDir)
+		// Every running tunnel is found by its journal, along with its env, profile and router
+		if all {
+			journals, err := ssh.FindAllJournals(base.Config.AppDir)
 			if err != nil {
-				spinnerGetRouterHostFromExistingSession.UpdateText("Couldn't get router host ID locally. Trying with AWS", "error", err)
+				return err
+			}
+			if len(journals) == 0 {
+				ux.Println("No tunnels are running")
+				return nil
+			}
+
+			for _, j := range journals {
+				t := config.Target{Env: j.Env, AWSProfile: j.AWSProfile}
+				if err := useTarget(base, t); err != nil {
+					return err
+				}
+
+				ux.Println(fmt.Sprintf("Bringing down tunnel for %s", t))
+				if err := downTunnel(cmd, args, j.RouterHostID); err != nil {
+					return fmt.Errorf("%s: %w", t, err)
+				}
 			}
-			spinnerGetRouterHostFromExistingSession.Success("Tunnel config doesn't exist locally")
 
-			mfaInputRequired := aws.MFAInputRequired(config.App)
+			return nil
+		}
+
+		for _, t := range targets {
+			if err := useTarget(base, t); err != nil {
+				return err
+			}
 
-			if mfaInputRequired {
-				pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
-				aws.InitAWSClients(config.App)
-			} else {
-				spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
-				aws.InitAWSClients(config.App)
-				spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+			ux.Println(fmt.Sprintf("Bringing down tunnel for %s", t))
+			if err := downTunnel(cmd, args, ""); err != nil {
+				return fmt.Errorf("%s: %w", t, err)
 			}
+		}
+
+		return nil
+	},
+}
+
+// downTunnel brings down the tunnel of the current env and profile. The router is looked up if routerHostID is empty.
+func downTunnel(cmd *cobra.Command, args []string, routerHostID string) error {
+	logger.Debug("Down command called")
+	var err error
+
+	// Check Constraints
+	//if err := constraints.CheckConstraints(
+	//	constraints.WithRouterHostID(),
+	//); err != nil {
+	//	return err
+	//}
+
+	if err := constraints.CheckConstraints(
+		//constraints.WithAWSRegion(), // Can be derived on the session level
+		constraints.WithENV(),
+	); err != nil {
+		return err
+	}
+
+	ux.Println("Deactivating Tunnel")
+
+	// If router ID is not provided via a flag
+	if routerHostID == "" {
+		spinnerGetRouterHostFromExistingSession := ux.NewProgressSpinner("Checking existing / previous sessions")
+		routerHostID, err = ssh.GetRouterHostIDFromExistingSession(config.App.Config.TunnelDir)
+		if err != nil {
+			logger.Debug("Couldn't get router host ID locally", "error", err)
+			spinnerGetRouterHostFromExistingSession.Success("No running tunnel found locally. Trying with AWS")
+		} else {
+			spinnerGetRouterHostFromExistingSession.Success(fmt.Sprintf("Running tunnel found with router %s", routerHostID))
+		}
+	}
+
+	// Environments with an SSH router in atun.toml don't use AWS: the router and its endpoints are configured locally
+	sshRouter, err := tunnel.LoadSSHRouter(config.App)
+	if err != nil {
+		return err
+	}
+
+	if !sshRouter {
+		if err := constraints.CheckConstraints(
+			constraints.WithAWSProfile(),
+		); err != nil {
+			return err
+		}
+
+		// The router endpoints config is read from AWS even if the router is known
+		mfaInputRequired := aws.MFAInputRequired(config.App)
+
+		if mfaInputRequired {
+			pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
+			aws.InitAWSClients(config.App)
+		} else {
+			spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
+			aws.InitAWSClients(config.App)
+			spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+		}
 
+		// The router of the running tunnel wins over the one tagged in AWS (it may have been replaced since)
+		if routerHostID == "" {
 			spinnerRouterDetection := ux.NewProgressSpinner("Detecting Atun routers in AWS")
 
 			config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
@@ -103,62 +174,75 @@ var downCmd = &cobra.Command{
 
 		config.App.Version = routerHostConfig.Version
 		config.App.Config.Hosts = routerHostConfig.Config.Hosts
+		config.App.Config.Reverse = config.MergeReverse(routerHostConfig.Config.Reverse, config.App.Config.Reverse)
 		config.App.Config.RouterHostUser = routerHostConfig.Config.RouterHostUser
-
-		spinnerGetSSHTunnelStatus := ux.NewProgressSpinner("Getting SSH tunnel status")
-		tunnelActive, endpoints, err := ssh.GetSSHTunnelStatus(config.App)
+	}
+	tunnel.LoadHostsFile(config.App)
+
+	spinnerGetSSHTunnelStatus := ux.NewProgressSpinner("Getting SSH tunnel status")
+	tunnelActive, endpoints, err := ssh.GetSSHTunnelStatus(config.App)
+	if err != nil {
+		spinnerGetSSHTunnelStatus.Fail("Failed to get tunnel status", "error", err)
+	}
+	spinnerGetSSHTunnelStatus.Success(fmt.Sprintf("Tunnel status retrieved: %s", map[bool]string{true: "active", false: "inactive"}[tunnelActive]))
+
+	if tunnelActive {
+		spinnerDeactivateTunnel := ux.NewProgressSpinner("Deactivating tunnel")
+		spinnerDeactivateTunnel.UpdateText("Tunnel is active", "tunnelActive", tunnelActive, "routerHostID", config.App.Config.RouterHostID)
+
+		spinnerDeactivateTunnel.UpdateText("Deactivating tunnel")
+		tunnelActive, err = tunnel.DeactivateTunnel(config.App)
 		if err != nil {
-			spinnerGetSSHTunnelStatus.Fail("Failed to get tunnel status", "error", err)
-		}
-		spinnerGetSSHTunnelStatus.Success(fmt.Sprintf("Tunnel status retrieved: %s", map[bool]string{true: "active", false: "inactive"}[tunnelActive]))
-
-		if tunnelActive {
-			spinnerDeactivateTunnel := ux.NewProgressSpinner("Deactivating tunnel")
-			spinnerDeactivateTunnel.UpdateText("Tunnel is active", "tunnelActive", tunnelActive, "routerHostID", config.App.Config.RouterHostID)
-
-			spinnerDeactivateTunnel.UpdateText("Deactivating tunnel")
-			tunnelActive, err = tunnel.DeactivateTunnel(config.App)
-			if err != nil {
-				spinnerDeactivateTunnel.Fail("Failed to deactivate tunnel", "error", err)
-			}
-
+			spinnerDeactivateTunnel.Fail("Failed to deactivate tunnel", "error", err)
 		}
 
-		// Check tunnel for the second time
-		spinnerGetSSHTunnelStatusFinal := ux.NewProgressSpinner("Checking tunnel status")
-		tunnelActive, endpoints, err = ssh.GetSSHTunnelStatus(config.App)
-		if !tunnelActive {
-			spinnerGetSSHTunnelStatusFinal.Success("Tunnel inactive")
-		}
-
-		// Get delete flag
-		deleteRouter, _ := cmd.Flags().GetBool("delete")
-
-		if deleteRouter {
-			spinnerDeleteRouter := ux.NewProgressSpinner("Deleting router")
-			spinnerDeleteRouter.UpdateText("Delete flag is set. Deleting router host", "routerHostID", config.App.Config.RouterHostID)
-
-			// Run create command from here
-			err := routerDeleteCmd.RunE(routerDeleteCmd, args)
-			if err != nil {
-				spinnerDeleteRouter.Fail("Failed deleting the router", "err", err)
-			}
+	}
+
+	// The hosts file block is rolled back even if the tunnel is already gone
+	if rolledBack, err := tunnel.RemoveHostsFile(config.App); err != nil {
+		logger.Error("Failed to roll back hosts file", "error", err)
+	} else if rolledBack {
+		ux.NewProgressSpinner("Rolling back hosts file").Success(fmt.Sprintf("Hosts file entries removed from %s", hostsfile.Path()))
+	}
+
+	// Check tunnel for the second time
+	spinnerGetSSHTunnelStatusFinal := ux.NewProgressSpinner("Checking tunnel status")
+	tunnelActive, endpoints, err = ssh.GetSSHTunnelStatus(config.App)
+	if !tunnelActive {
+		spinnerGetSSHTunnelStatusFinal.Success("Tunnel inactive")
+	}
+
+	// Get delete flag
+	deleteRouter, _ := cmd.Flags().GetBool("delete")
+
+	// SSH routers aren't created by atun, so they aren't deleted either
+	if deleteRouter && sshRouter {
+		ux.NewProgressSpinner("Deleting router").Warning(fmt.Sprintf("SSH router %s of env %s is configured in atun.toml, it's not deleted", config.App.Config.RouterAddress, config.App.Config.Env))
+	} else if deleteRouter {
+		spinnerDeleteRouter := ux.NewProgressSpinner("Deleting router")
+		spinnerDeleteRouter.UpdateText("Delete flag is set. Deleting router host", "routerHostID", config.App.Config.RouterHostID)
+
+		// Run create command from here
+		err := routerDeleteCmd.RunE(routerDeleteCmd, args)
+		if err != nil {
+			spinnerDeleteRouter.Fail("Failed deleting the router", "err", err)
 		}
+	}
 
-		time.Sleep(1000 * time.Millisecond)
+	time.Sleep(1000 * time.Millisecond)
 
-		ux.ClearLines(7)
-		err = ux.RenderEndpointsTable(endpoints)
-		if err != nil {
-			logger.Error("Failed to render env table", "error", err)
-		}
+	ux.ClearLines(7)
+	err = ux.RenderEndpointsTable(endpoints)
+	if err != nil {
+		logger.Error("Failed to render env table", "error", err)
+	}
 
-		return nil
-	},
+	return nil
 }
 
 func init() {
 	logger.Debug("Initializing up command")
 	downCmd.PersistentFlags().StringP("router", "r", "", "Router instance id to use. If not specified the first running instance with the atun.io tags is used")
+	downCmd.PersistentFlags().BoolP("all", "a", false, "Bring down the tunnels of all environments and profiles")
 	downCmd.PersistentFlags().BoolP("delete", "x", false, "Delete ad-hoc router (if exists). Won't delete any resources non-managed by atun")
 }
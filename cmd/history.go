@@ -0,0 +1,74 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/automationd/atun/internal/audit"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/ux"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd shows the tunnel sessions recorded on this machine
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the history of tunnel sessions on this machine",
+	Long: `Show who opened which tunnel to which router and endpoints, when, and why it stopped.
+Sessions of all environments and profiles are recorded in the app directory (~/.atun/history.jsonl).
+
+Example:
+  atun history                               # Latest sessions of all environments
+  atun history --env prod --since 168h       # Sessions of prod in the last week
+  atun history --host db.internal --json     # Sessions with an endpoint to db.internal as JSON`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := audit.Filter{}
+
+		// --env and --aws-profile filter only when given, otherwise sessions of all environments are shown
+		if cmd.Flags().Changed("env") {
+			filter.Env = config.App.Config.Env
+		}
+		if cmd.Flags().Changed("aws-profile") {
+			filter.AWSProfile = config.App.Config.AWSProfile
+		}
+
+		filter.RouterHostID, _ = cmd.Flags().GetString("router")
+		filter.User, _ = cmd.Flags().GetString("user")
+		filter.Host, _ = cmd.Flags().GetString("host")
+		filter.Limit, _ = cmd.Flags().GetInt("limit")
+		if since, _ := cmd.Flags().GetDuration("since"); since > 0 {
+			filter.Since = time.Now().Add(-since)
+		}
+
+		records, err := audit.Read(audit.GetHistoryFilePath(config.App.Config.AppDir))
+		if err != nil {
+			return err
+		}
+
+		sessions := filter.Apply(audit.Sessions(records))
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			if sessions == nil {
+				sessions = []audit.Session{}
+			}
+			return ux.RenderJSON(sessions)
+		}
+
+		ux.RenderHistoryTable(sessions)
+
+		return nil
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringP("router", "r", "", "Only show sessions to this router")
+	historyCmd.Flags().String("user", "", "Only show sessions of this local user")
+	historyCmd.Flags().String("host", "", "Only show sessions with an endpoint to this host (substring match)")
+	historyCmd.Flags().Duration("since", 0, "Only show sessions started within this duration (e.g. 24h)")
+	historyCmd.Flags().Int("limit", 50, "Show at most this many sessions (0 for all)")
+	historyCmd.Flags().Bool("json", false, "Print the sessions as JSON")
+}
@@ -0,0 +1,128 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/constraints"
+	"github.com/automationd/atun/internal/ports"
+	"github.com/automationd/atun/internal/tunnel"
+	"github.com/automationd/atun/internal/ux"
+	"github.com/spf13/cobra"
+)
+
+// portsCmd manages the port registry: the local ports endpoints keep across `atun up` runs
+var portsCmd = &cobra.Command{
+	Use:   "ports",
+	Short: "Manage local ports assigned to endpoints",
+	Long: `Endpoints keep their local port across atun up runs. The assignments of all environments and profiles
+are stored in the app directory (~/.atun/ports.json), so two endpoints never get the same port.
+
+Pinned ports win over the local port configured on the router.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var portsListCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List local port assignments of all environments and profiles",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registry, err := ports.Load(ports.GetRegistryPath(config.App.Config.AppDir))
+		if err != nil {
+			return err
+		}
+
+		ux.RenderPortsTable(registry.Assignments)
+
+		return nil
+	},
+}
+
+var portsPinCmd = &cobra.Command{
+	Use:   "pin <host> <remote port> <local port>",
+	Short: "Pin the local port of an endpoint of the current environment",
+	Long: `Pins the local port of an endpoint of the current environment and profile.
+
+Example:
+  atun ports pin db.internal 5432 15432`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := constraints.CheckConstraints(
+			constraints.WithAWSProfile(),
+			constraints.WithENV(),
+		); err != nil {
+			return err
+		}
+
+		key, err := tunnel.PortKeyFromArgs(config.App, args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		local, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid local port %q", args[2])
+		}
+
+		if err := ports.Update(ports.GetRegistryPath(config.App.Config.AppDir), func(registry *ports.Registry) error {
+			return registry.Pin(key, local)
+		}); err != nil {
+			return err
+		}
+
+		ux.Println(fmt.Sprintf("Pinned %s to local port %d. Restart the tunnel to apply", key, local))
+
+		return nil
+	},
+}
+
+var portsReleaseCmd = &cobra.Command{
+	Use:   "release <host> <remote port>",
+	Short: "Release the local port of an endpoint of the current environment",
+	Long: `Forgets the local port of an endpoint of the current environment and profile.
+The endpoint gets a new port on the next atun up, unless one is configured on the router.
+
+Example:
+  atun ports release db.internal 5432`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := constraints.CheckConstraints(
+			constraints.WithAWSProfile(),
+			constraints.WithENV(),
+		); err != nil {
+			return err
+		}
+
+		key, err := tunnel.PortKeyFromArgs(config.App, args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := ports.Update(ports.GetRegistryPath(config.App.Config.AppDir), func(registry *ports.Registry) error {
+			if !registry.Release(key) {
+				return fmt.Errorf("no local port is assigned to %s", key)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		ux.Println(fmt.Sprintf("Released the local port of %s", key))
+
+		return nil
+	},
+}
+
+func init() {
+	portsCmd.AddCommand(portsListCmd)
+	portsCmd.AddCommand(portsPinCmd)
+	portsCmd.AddCommand(portsReleaseCmd)
+}
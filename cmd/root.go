@@ -7,7 +7,6 @@ package cmd
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/automationd/atun/internal/config"
 	"github.com/automationd/atun/internal/constraints"
@@ -48,20 +47,15 @@ func init() {
 		pterm.Info.Println("Not binding log-level flag (none provied)")
 	}
 
-	rootCmd.PersistentFlags().String("aws-profile", "", "Specify AWS profile (defined in ~/.aws/credentials)")
-	if err := viper.BindPFlag("AWS_PROFILE", rootCmd.PersistentFlags().Lookup("aws-profile")); err != nil {
-		pterm.Info.Println("Not binding aws-profile flag (none provied)")
-	}
+	// --aws-profile and --env can be repeated (`atun up`, `atun down`), so they're passed to viper in initializeAtun
+	rootCmd.PersistentFlags().StringSlice("aws-profile", nil, "Specify AWS profile (defined in ~/.aws/credentials). Repeat to run tunnels for several profiles")
 
 	rootCmd.PersistentFlags().String("aws-region", "", "Specify AWS region (e.g. us-east-1)")
 	if err := viper.BindPFlag("AWS_REGION", rootCmd.PersistentFlags().Lookup("aws-region")); err != nil {
 		pterm.Info.Println("Not binding binding aws-region flag (none provided)")
 	}
 
-	rootCmd.PersistentFlags().String("env", "", "Specify environment (dev/prod/...)")
-	if err := viper.BindPFlag("ENV", rootCmd.PersistentFlags().Lookup("env")); err != nil {
-		pterm.Info.Println("Not binding binding env flag (none provided)")
-	}
+	rootCmd.PersistentFlags().StringSlice("env", nil, "Specify environment (dev/prod/...). Repeat to run tunnels for several environments")
 
 	//if err := viper.BindPFlags(rootCmd.Flags()); err != nil {
 	//	pterm.Error.Println("Error while binding flags")
@@ -74,6 +68,10 @@ func init() {
 		statusCmd,
 		versionCmd,
 		routerCmd,
+		ssmProxyCmd,
+		daemonCmd,
+		portsCmd,
+		historyCmd,
 	)
 
 	//cobra.OnInitialize(config.LoadConfig)
@@ -90,6 +88,14 @@ func init() {
 
 }
 func initializeAtun() {
+	// The first of repeated --env and --aws-profile flags is the one of commands working with a single tunnel
+	if envs, _ := rootCmd.PersistentFlags().GetStringSlice("env"); len(envs) > 0 {
+		viper.Set("ENV", envs[0])
+	}
+	if profiles, _ := rootCmd.PersistentFlags().GetStringSlice("aws-profile"); len(profiles) > 0 {
+		viper.Set("AWS_PROFILE", profiles[0])
+	}
+
 	// Load config into a global struct
 	err := config.LoadConfig()
 	if err != nil {
@@ -119,7 +125,7 @@ func initializeAtun() {
 	//config.App.Session = sess
 
 	// Set directory for per-env-per-profile tunnel/cdk
-	config.App.Config.TunnelDir = filepath.Join(config.App.Config.AppDir, fmt.Sprintf("%s-%s", config.App.Config.Env, config.App.Config.AWSProfile))
+	config.App.Config.TunnelDir = config.GetTunnelDir(config.App.Config.AppDir, config.App.Config.Env, config.App.Config.AWSProfile)
 
 	if !constraints.SupportsANSIEscapeCodes() || constraints.IsCI() {
 		logger.Debug("Terminal doesn't support ANSI escape codes", "supportsANSI", constraints.SupportsANSIEscapeCodes())
@@ -145,3 +151,30 @@ func initializeAtun() {
 	//}
 
 }
+
+// getTargets returns the environments and profiles of repeated --env and --aws-profile flags.
+// Without the flags it's the env and profile of the config.
+func getTargets() []config.Target {
+	envs, _ := rootCmd.PersistentFlags().GetStringSlice("env")
+	if len(envs) == 0 {
+		envs = []string{config.App.Config.Env}
+	}
+
+	profiles, _ := rootCmd.PersistentFlags().GetStringSlice("aws-profile")
+	if len(profiles) == 0 {
+		profiles = []string{config.App.Config.AWSProfile}
+	}
+
+	return config.GetTargets(envs, profiles)
+}
+
+// useTarget makes the app config the one of the target, with its own tunnel directory
+func useTarget(base *config.Atun, t config.Target) error {
+	config.App = base.WithTarget(t)
+
+	if err := os.MkdirAll(config.App.Config.TunnelDir, 0755); err != nil {
+		return fmt.Errorf("error creating tunnel directory %s: %w", config.App.Config.TunnelDir, err)
+	}
+
+	return nil
+}
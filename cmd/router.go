@@ -28,5 +28,6 @@ func init() {
 	routerCmd.AddCommand(routerDeleteCmd)
 	routerCmd.AddCommand(routerInstallCmd)
 	routerCmd.AddCommand(routerUninstallCmd)
+	routerCmd.AddCommand(routerGCCmd)
 
 }
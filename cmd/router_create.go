@@ -12,6 +12,7 @@ import (
 	"github.com/automationd/atun/internal/config"
 	"github.com/automationd/atun/internal/constraints"
 	"github.com/automationd/atun/internal/infra"
+	"github.com/automationd/atun/internal/k8s"
 	"github.com/automationd/atun/internal/logger"
 	"github.com/automationd/atun/internal/tunnel"
 	"github.com/automationd/atun/internal/ux"
@@ -59,7 +60,8 @@ var routerCreateCmd = &cobra.Command{
 
 				err = buildHostConfig(config.App)
 				if err != nil {
-					logger.Error("Error creating endpoints config: %v", err)
+					logger.Error("Error creating endpoints config", "error", err)
+					return err
 				}
 
 				// Use Survey to ask if the user wants to save the configuration
@@ -93,7 +95,6 @@ var routerCreateCmd = &cobra.Command{
 
 		// Verify all constraints are met
 		if err := constraints.CheckConstraints(
-			constraints.WithSSMPlugin(),
 			constraints.WithAWSProfile(),
 			constraints.WithAWSRegion(),
 			constraints.WithENV(),
@@ -148,6 +149,10 @@ var routerCreateCmd = &cobra.Command{
 
 		}
 
+		if cmd.Flags().Changed("ttl") {
+			config.App.Config.RouterTTL, _ = cmd.Flags().GetDuration("ttl")
+		}
+
 		// Create and start a fork of the default spinner.
 		createRouterInstanceSpinner := ux.NewProgressSpinner("Creating Ad-Hoc EC2 Router Instance...")
 
@@ -312,7 +317,7 @@ func buildHostConfig(app *config.Atun) error {
 		} else {
 			// No more elements in `app.Config.Hosts`, fall back to no defaults
 			defaultHost = ""
-			defaultProtocol = "ssm"
+			defaultProtocol = config.ProtoSSM
 			defaultRemotePort = ""
 			defaultLocalPort = "0"
 		}
@@ -337,28 +342,27 @@ func buildHostConfig(app *config.Atun) error {
 		//	},
 		//}, &host.Proto, survey.WithValidator(survey.Required))
 
-		host.Proto, err = ux.GetInteractiveSelection("Select Endpoint Protocol", []string{"ssm", "k8s", "ssh"}, defaultProtocol)
+		host.Proto, err = ux.GetInteractiveSelection("Select Endpoint Protocol", []string{config.ProtoSSM, config.ProtoSSMDirect, config.ProtoK8s, config.ProtoSSH}, defaultProtocol)
 		if err != nil {
 			logger.Fatal("Error getting Endpoint Protocol", err)
 
 			return err
 		}
-		if host.Proto == "ssh" || host.Proto == "k8s" {
-			logger.Fatal("Sorry, only SSM is supported for now, but it's on the roadmap. Back to the matrix 💊")
+		// An EC2 router is reached over SSM. ssh endpoints belong to an SSH router, which is only configured in atun.toml
+		if host.Proto == config.ProtoSSH {
+			return fmt.Errorf("ssh endpoints are forwarded by an SSH router, not an EC2 one. Add it to atun.toml as [ssh_routers.%s] with its [[ssh_routers.%s.hosts]] and run atun up", app.Config.Env, app.Config.Env)
 		}
 
-		rp, err := aws.InferPortByHost(host.Name)
-		if err != nil {
+		// k8s endpoints are named after the Service or Pod they forward to, their port can't be inferred from AWS
+		if host.Proto == config.ProtoK8s {
+			if _, err := k8s.ParseTarget(host.Name); err != nil {
+				return err
+			}
+		} else if rp, err := aws.InferPortByHost(host.Name); err != nil {
 			logger.Debug("Error inferring port from the host", "host", host, "error", err)
 		} else {
 			logger.Debug("Inferred remote port from the host", "host", host, "port", rp)
 			defaultRemotePort = strconv.Itoa(rp)
-
-			lp, err := tunnel.CalculateLocalPort(rp)
-			defaultLocalPort = strconv.Itoa(lp)
-			if err != nil {
-				logger.Fatal("Error calculating local port", "error", err)
-			}
 		}
 
 		// Survey produces a string, so we need to convert it to int later
@@ -377,6 +381,16 @@ func buildHostConfig(app *config.Atun) error {
 			return err
 		}
 
+		// The port registry suggests a local port no other endpoint uses, so hosts with the same remote port
+		// (e.g. two Postgres databases) don't collide
+		if defaultLocalPort == "0" {
+			if lp, err := tunnel.SuggestLocalPort(app, host); err != nil {
+				logger.Debug("Can't suggest a local port", "host", host.Name, "remote", host.Remote, "error", err)
+			} else {
+				defaultLocalPort = strconv.Itoa(lp)
+			}
+		}
+
 		// Survey produces a string, so we need to convert it to int later
 		var localPortSurveyAnswer string
 
@@ -419,4 +433,5 @@ func init() {
 	routerCreateCmd.PersistentFlags().String("router-vpc-id", "", "VPC ID of the router host to be created")
 	routerCreateCmd.PersistentFlags().String("router-subnet-id", "", "Subnet ID of the router host to be created")
 	routerCreateCmd.PersistentFlags().String("aws-key-pair", "", "AWS Key Pair Name to use for the router host")
+	routerCreateCmd.PersistentFlags().Duration("ttl", 0, "Time-to-live of the router (e.g. 24h). Expired routers are removed by atun router gc. Overrides router_ttl of atun.toml")
 }
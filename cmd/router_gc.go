@@ -0,0 +1,139 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/automationd/atun/internal/aws"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/constraints"
+	"github.com/automationd/atun/internal/infra"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/tunnel"
+	"github.com/automationd/atun/internal/ux"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// routerGCCmd represents the router gc command
+var routerGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove ad-hoc routers whose time-to-live has passed",
+	Long: `Find routers of all environments whose atun.io/expires-at tag (set by atun router create --ttl) has passed
+and remove them. Routers created from this machine are destroyed with their CDKTF stack, the others are stopped.
+
+Example:
+  atun router gc --dry-run    # List expired routers without touching them
+  atun router gc              # Destroy or stop expired routers
+  atun router gc --stop       # Only stop them, so they can be started again`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := constraints.CheckConstraints(
+			constraints.WithAWSProfile(),
+		); err != nil {
+			return err
+		}
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		stop, _ := cmd.Flags().GetBool("stop")
+		yes, _ := cmd.Flags().GetBool("yes")
+
+		ux.Println("Looking for expired routers")
+
+		mfaInputRequired := aws.MFAInputRequired(config.App)
+		if mfaInputRequired {
+			pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
+			aws.InitAWSClients(config.App)
+		} else {
+			spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
+			aws.InitAWSClients(config.App)
+			spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+		}
+
+		spinnerFind := ux.NewProgressSpinner("Detecting expired Atun routers in AWS")
+		routers, err := tunnel.FindExpiredRouters(time.Now())
+		if err != nil {
+			spinnerFind.Fail("Failed to list routers", "error", err)
+			return err
+		}
+		spinnerFind.Success(fmt.Sprintf("Found %d expired router(s) in %s region of AWS account %s", len(routers), config.App.Config.AWSRegion, aws.GetAccountId()))
+
+		ux.RenderExpiredRoutersTable(routers, stop)
+		if dryRun || len(routers) == 0 {
+			return nil
+		}
+
+		if !yes {
+			if !constraints.IsInteractiveTerminal() {
+				return fmt.Errorf("not removing %d expired router(s) in a non-interactive session. Use --yes", len(routers))
+			}
+
+			confirmed, err := ux.GetConfirmation(fmt.Sprintf("Remove %d expired router(s)?", len(routers)))
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				logger.Info("Expired routers are left as they are")
+				return nil
+			}
+		}
+
+		var failed int
+		for _, router := range routers {
+			if err := removeExpiredRouter(router, stop); err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("failed to remove %d of %d expired router(s)", failed, len(routers))
+		}
+
+		return nil
+	},
+}
+
+// removeExpiredRouter destroys the CDKTF stack of a router created from this machine, and stops any other router
+func removeExpiredRouter(router config.ExpiredRouter, stop bool) error {
+	if stop || !router.LocalState {
+		spinner := ux.NewProgressSpinner(fmt.Sprintf("Stopping router %s (%s)", router.ID, router.Env))
+		if err := aws.StopInstance(router.ID); err != nil {
+			spinner.Fail(fmt.Sprintf("Failed to stop router %s", router.ID), "error", err)
+			return err
+		}
+		spinner.Success(fmt.Sprintf("Router %s (%s) stopped", router.ID, router.Env))
+		return nil
+	}
+
+	// The stack lives in the tunnel directory of the router's env
+	base := config.App
+	defer func() {
+		config.App = base
+	}()
+
+	if err := useTarget(base, config.Target{Env: router.Env, AWSProfile: base.Config.AWSProfile}); err != nil {
+		return err
+	}
+	config.App.Session = base.Session
+	config.App.Config.RouterSubnetID = router.SubnetID
+	config.App.Config.RouterVPCID = router.VPCID
+
+	spinner := ux.NewProgressSpinner(fmt.Sprintf("Destroying router %s (%s)", router.ID, router.Env))
+	if err := infra.DestroyCDKTF(config.App.Config); err != nil {
+		spinner.Fail(fmt.Sprintf("Failed to destroy router %s", router.ID), "error", err)
+		return err
+	}
+	spinner.Success(fmt.Sprintf("Router %s (%s) destroyed", router.ID, router.Env))
+
+	return nil
+}
+
+func init() {
+	routerGCCmd.Flags().Bool("dry-run", false, "List expired routers without removing them")
+	routerGCCmd.Flags().Bool("stop", false, "Stop expired routers instead of destroying them")
+	routerGCCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+}
@@ -6,7 +6,6 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -113,25 +112,26 @@ Example:
 			Value: aws.String(config.App.Config.Env),
 		})
 
-		// Process each host and add it to the tags
-		for _, host := range config.App.Config.Hosts {
-			key := fmt.Sprintf("atun.io/host/%s", host.Name)
-			hostConfig := map[string]interface{}{
-				"proto":  host.Proto,
-				"local":  host.Local,
-				"remote": host.Remote,
-			}
+		// Process each host and add it to the tags (one tag per host with all its port mappings)
+		hostTags, err := config.HostTags(config.App.Config.Hosts)
+		if err != nil {
+			installSpinner.Fail(fmt.Sprintf("Failed to marshal endpoints config: %v", err))
+			return fmt.Errorf("failed to marshal endpoints config: %w", err)
+		}
 
-			configJSON, err := json.Marshal(hostConfig)
-			if err != nil {
-				installSpinner.Fail(fmt.Sprintf("Failed to marshal endpoints config: %v", err))
-				return fmt.Errorf("failed to marshal endpoints config: %w", err)
-			}
+		reverseTags, err := config.ReverseTags(config.App.Config.Reverse)
+		if err != nil {
+			installSpinner.Fail(fmt.Sprintf("Failed to marshal reverse endpoints config: %v", err))
+			return fmt.Errorf("failed to marshal reverse endpoints config: %w", err)
+		}
 
-			tags = append(tags, &ec2.Tag{
-				Key:   aws.String(key),
-				Value: aws.String(string(configJSON)),
-			})
+		for _, t := range []map[string]string{hostTags, reverseTags} {
+			for key, value := range t {
+				tags = append(tags, &ec2.Tag{
+					Key:   aws.String(key),
+					Value: aws.String(value),
+				})
+			}
 		}
 
 		// Apply tags to the instance
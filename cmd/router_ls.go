@@ -32,7 +32,6 @@ Example:
 func listRouters(cmd *cobra.Command, args []string) error {
 	var err error
 	if err = constraints.CheckConstraints(
-		constraints.WithSSMPlugin(),
 		constraints.WithAWSProfile(),
 		constraints.WithENV(),
 	); err != nil {
@@ -9,6 +9,7 @@ import (
 
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/k8s"
 	"github.com/automationd/atun/internal/tunnel"
 	"github.com/automationd/atun/internal/ux"
 )
@@ -22,7 +23,8 @@ This allows you to perform troubleshooting or run commands directly on the route
 
 Example usage:
   atun router shell              # Connect to the most recently created router
-  atun router shell --target i-1234abcd  # Connect to a specific router by ID`,
+  atun router shell --target i-1234abcd  # Connect to a specific router by ID
+  atun router shell --type k8s --target db/pod/postgres-0  # Open a shell in a pod with the kubeconfig context of the env`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var targetID string
 
@@ -40,10 +42,6 @@ Example usage:
 		// 	routerID = selectedRouterID
 		// }
 
-		// Initialize AWS clients
-		sshSpinner.UpdateText("Authenticating with AWS...")
-		aws.InitAWSClients(config.App)
-
 		// Get the connection type and target ID
 		routerType, _ := cmd.Flags().GetString("type")
 		targetID = cmd.Flag("target").Value.String()
@@ -53,14 +51,19 @@ Example usage:
 			routerType = "ec2"
 		}
 
+		// Pods are reached with the kubeconfig, not AWS
+		if routerType != "k8s" {
+			sshSpinner.UpdateText("Authenticating with AWS...")
+			aws.InitAWSClients(config.App)
+		}
+
 		// Handle different connection types
 		switch routerType {
 		case "ec2":
 			return consoleToEC2Router(sshSpinner, targetID)
 		// Future connection types
 		case "k8s":
-			sshSpinner.Fail("Kubernetes connections not yet implemented")
-			return fmt.Errorf("kubernetes connections are planned for a future release")
+			return consoleToK8sPod(sshSpinner, targetID)
 		case "ecs":
 			sshSpinner.Fail("ECS connections not yet implemented")
 			return fmt.Errorf("ecs connections are planned for a future release")
@@ -106,10 +109,39 @@ func consoleToEC2Router(sshSpinner *ux.ProgressSpinner, targetID string) error {
 	return nil
 }
 
+// consoleToK8sPod opens a shell in a pod with the kubeconfig context of the environment
+func consoleToK8sPod(sshSpinner *ux.ProgressSpinner, targetID string) error {
+	if err := constraints.CheckConstraints(
+		constraints.WithKubectl(),
+	); err != nil {
+		sshSpinner.Fail("kubectl is required for shells in pods")
+		return err
+	}
+
+	if targetID == "" {
+		sshSpinner.Fail("No pod to connect to")
+		return fmt.Errorf("--target is required for k8s, e.g. --target db/pod/postgres-0")
+	}
+
+	target, err := k8s.ParseTarget(targetID)
+	if err != nil {
+		sshSpinner.Fail("Bad target", "target", targetID, "error", err)
+		return err
+	}
+
+	sshSpinner.Success(fmt.Sprintf("Connecting to %s", targetID))
+
+	if err := k8s.ConnectToShell(config.App.Config.Kubeconfig, config.App.Config.GetKubeContext(), target); err != nil {
+		return fmt.Errorf("failed to connect to pod: %w", err)
+	}
+
+	return nil
+}
+
 func init() {
 	// Ignore interrupt signals during shell session (Ctrl+C)
 	signal.Ignore(syscall.SIGINT)
 
-	routerShellCmd.Flags().String("target", "", "Target router identifier (instance ID for EC2)")
+	routerShellCmd.Flags().String("target", "", "Target router identifier (instance ID for EC2, [namespace/]pod/name for k8s)")
 	routerShellCmd.Flags().String("type", "", "Router type (ec2, k8s, ecs)")
 }
@@ -0,0 +1,65 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/automationd/atun/internal/aws"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ssm"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// ssmProxyCmd bridges stdin/stdout to an SSM session. It's used as ProxyCommand in the generated SSH config.
+var ssmProxyCmd = &cobra.Command{
+	Use:    "ssm-proxy <target> <port>",
+	Short:  "Proxy stdin/stdout to a port on the target via SSM (used as SSH ProxyCommand)",
+	Hidden: true,
+	Args:   cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// stdout belongs to the SSH client, so everything else goes to stderr
+		pterm.SetDefaultOutput(os.Stderr)
+		pterm.DefaultLogger.Writer = os.Stderr
+
+		target := args[0]
+		port, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid port %q: %w", args[1], err)
+		}
+
+		sess, err := aws.GetEnvSession(config.App)
+		if err != nil {
+			return err
+		}
+
+		conn, err := ssm.DialSSH(context.Background(), sess, target, port)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		logger.Debug("SSM proxy connected", "target", target, "port", port)
+
+		errCh := make(chan error, 2)
+		go func() {
+			_, err := io.Copy(conn, os.Stdin)
+			errCh <- err
+		}()
+		go func() {
+			_, err := io.Copy(os.Stdout, conn)
+			errCh <- err
+		}()
+
+		return <-errCh
+	},
+}
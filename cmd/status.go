@@ -6,6 +6,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
@@ -28,6 +29,15 @@ var statusCmd = &cobra.Command{
 		var routerHostID string
 		var err error
 
+		all, _ := cmd.Flags().GetBool("all")
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			return statusJSON(cmd, all)
+		}
+
+		if all {
+			return statusAll(cmd)
+		}
+
 		if err != nil {
 			return fmt.Errorf("can't load options for a command: %w", err)
 		}
@@ -39,53 +49,74 @@ var statusCmd = &cobra.Command{
 
 		ux.Println("Checking Tunnel Status")
 
-		// Get the router host ID from the command line
-		routerHostID = cmd.Flag("router").Value.String()
+		// Environments with an SSH router in atun.toml don't use AWS: the router and its endpoints are configured locally
+		sshRouter, err := tunnel.LoadSSHRouter(config.App)
+		if err != nil {
+			return err
+		}
 
-		// If router host is not provided, get the first running instance based on the discovery tag (atun.io/version)
-		if routerHostID == "" {
-			mfaInputRequired := aws.MFAInputRequired(config.App)
+		if !sshRouter {
+			// Get the router host ID from the command line
+			routerHostID = cmd.Flag("router").Value.String()
+
+			// If router host is not provided, get the first running instance based on the discovery tag (atun.io/version)
+			if routerHostID == "" {
+				mfaInputRequired := aws.MFAInputRequired(config.App)
+
+				if mfaInputRequired {
+					pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
+					aws.InitAWSClients(config.App)
+				} else {
+					spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
+					aws.InitAWSClients(config.App)
+					spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+				}
 
-			if mfaInputRequired {
-				pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
-				aws.InitAWSClients(config.App)
+				// The router of the running tunnel wins over the one tagged in AWS (it may have been replaced since)
+				if runningRouterHostID, err := ssh.GetRouterHostIDFromExistingSession(config.App.Config.TunnelDir); err == nil {
+					config.App.Config.RouterHostID = runningRouterHostID
+				} else {
+					spinnerRouterDetection := ux.NewProgressSpinner("Detecting Atun routers in AWS")
+					config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
+					if err != nil {
+						spinnerRouterDetection.Fail(fmt.Sprintf("No routers found. No --router flag has not been specified and no EC2 instances with atun.io tags found in %s region of AWS account %s.", config.App.Config.AWSRegion, aws.GetAccountId()))
+						if detailedStatus {
+							ux.RenderDetailedStatus()
+						}
+
+						return nil
+
+					}
+					spinnerRouterDetection.Success(fmt.Sprintf("Router found: %s", config.App.Config.RouterHostID))
+				}
 			} else {
-				spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
-				aws.InitAWSClients(config.App)
-				spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+				config.App.Config.RouterHostID = routerHostID
 			}
-			spinnerRouterDetection := ux.NewProgressSpinner("Detecting Atun routers in AWS")
-			config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
-			if err != nil {
-				spinnerRouterDetection.Fail(fmt.Sprintf("No routers found. No --router flag has not been specified and no EC2 instances with atun.io tags found in %s region of AWS account %s.", config.App.Config.AWSRegion, aws.GetAccountId()))
-				if detailedStatus {
-					ux.RenderDetailedStatus()
-				}
-
-				return nil
 
+			spinnerGetRouterHostConfig := ux.NewProgressSpinner("Getting router endpoints config")
+			routerHostConfig, err := tunnel.GetRouterHostConfig(config.App.Config.RouterHostID)
+			if err != nil {
+				spinnerGetRouterHostConfig.Fail("Error getting router endpoints config", "err", err)
 			}
-			spinnerRouterDetection.Success(fmt.Sprintf("Router found: %s", config.App.Config.RouterHostID))
-		} else {
-			config.App.Config.RouterHostID = routerHostID
-		}
+			spinnerGetRouterHostConfig.Success("Router endpoints config retrieved")
 
-		spinnerGetRouterHostConfig := ux.NewProgressSpinner("Getting router endpoints config")
-		routerHostConfig, err := tunnel.GetRouterHostConfig(config.App.Config.RouterHostID)
-		if err != nil {
-			spinnerGetRouterHostConfig.Fail("Error getting router endpoints config", "err", err)
+			config.App.Version = routerHostConfig.Version
+			config.App.Config.Hosts = routerHostConfig.Config.Hosts
+			config.App.Config.Reverse = config.MergeReverse(routerHostConfig.Config.Reverse, config.App.Config.Reverse)
+			config.App.Config.RouterHostUser = routerHostConfig.Config.RouterHostUser
 		}
-		spinnerGetRouterHostConfig.Success("Router endpoints config retrieved")
-
-		config.App.Version = routerHostConfig.Version
-		config.App.Config.Hosts = routerHostConfig.Config.Hosts
-		config.App.Config.RouterHostUser = routerHostConfig.Config.RouterHostUser
+		tunnel.LoadHostsFile(config.App)
 
 		spinnerGetSSHTunnelStatus := ux.NewProgressSpinner("Getting SSH tunnel status")
 		tunnelActive, endpoints, err := ssh.GetSSHTunnelStatus(config.App)
 		if err != nil {
 			spinnerGetSSHTunnelStatus.Fail("Failed to get tunnel status", "error", err)
 		}
+		// Listening ports don't mean the remote services answer, probe them through the tunnel
+		if tunnelActive {
+			spinnerGetSSHTunnelStatus.UpdateText("Checking endpoints health")
+			endpoints = ssh.CheckEndpoints(cmd.Context(), endpoints)
+		}
 		spinnerGetSSHTunnelStatus.Success("Tunnel status retrieved", "tunnelActive", tunnelActive)
 
 		ux.ClearLines(5)
@@ -99,9 +130,11 @@ var statusCmd = &cobra.Command{
 			logger.Error("Failed to render env table", "error", err)
 		}
 
-		config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
-		if err != nil {
-			logger.Error("Router not found. You might want to create it.", "error", err)
+		if !sshRouter {
+			config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
+			if err != nil {
+				logger.Error("Router not found. You might want to create it.", "error", err)
+			}
 		}
 		if detailedStatus {
 			ux.RenderDetailedStatus()
@@ -111,6 +144,68 @@ var statusCmd = &cobra.Command{
 	},
 }
 
+// statusAll shows the tunnels of all environments and profiles of the machine. They're found by their journals and
+// asked for the state of their endpoints directly, so no AWS credentials are needed.
+func statusAll(cmd *cobra.Command) error {
+	ux.Println("Checking Tunnels on this machine")
+
+	spinner := ux.NewProgressSpinner("Looking for running tunnels")
+	journals, err := ssh.FindAllJournals(config.App.Config.AppDir)
+	if err != nil {
+		spinner.Fail("Failed to look for running tunnels", "error", err)
+		return err
+	}
+
+	spinner.UpdateText("Checking endpoints of running tunnels")
+	tunnels := tunnelOverviews(cmd.Context(), journals)
+	spinner.Success(fmt.Sprintf("%d tunnel(s) running", len(tunnels)))
+
+	ux.RenderTunnelsOverview(tunnels)
+
+	return nil
+}
+
+// statusJSON prints the tunnels of the current environment and profile (or of the whole machine) with the health
+// and traffic of their endpoints as JSON. Like --all it only talks to the tunnels, so it works without AWS credentials.
+func statusJSON(cmd *cobra.Command, all bool) error {
+	var journals []ssh.Journal
+	var err error
+	if all {
+		journals, err = ssh.FindAllJournals(config.App.Config.AppDir)
+	} else {
+		journals, err = ssh.FindJournals(config.App.Config.TunnelDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ux.RenderJSON(tunnelOverviews(cmd.Context(), journals))
+}
+
+// tunnelOverviews asks the tunnels of the journals for the state and traffic of their endpoints
+func tunnelOverviews(ctx context.Context, journals []ssh.Journal) []ux.TunnelOverview {
+	tunnels := make([]ux.TunnelOverview, 0, len(journals))
+	for _, j := range journals {
+		running, endpoints := j.Status()
+		// Listening ports don't mean the remote services answer, probe them through the tunnel
+		if running {
+			endpoints = ssh.CheckEndpoints(ctx, endpoints)
+		}
+
+		tunnels = append(tunnels, ux.TunnelOverview{
+			Env:          j.Env,
+			AWSProfile:   j.AWSProfile,
+			AWSRegion:    j.AWSRegion,
+			RouterHostID: j.RouterHostID,
+			Running:      running,
+			StartedAt:    j.StartedAt,
+			Endpoints:    endpoints,
+		})
+	}
+
+	return tunnels
+}
+
 func init() {
 	// Show detailed status if log level is debug or info, otherwise hide
 	defaultDetailedStatus := false
@@ -120,6 +215,8 @@ func init() {
 
 	statusCmd.PersistentFlags().StringP("router", "r", "", "Router instance id to use. If not specified the first running instance with the atun.io tags is used")
 	statusCmd.Flags().BoolP("detailed", "d", defaultDetailedStatus, "Show detailed status")
+	statusCmd.Flags().Bool("json", false, "Print the tunnels with the health and traffic of their endpoints as JSON")
+	statusCmd.Flags().BoolP("all", "a", false, "Show the tunnels of all environments and profiles of this machine (doesn't need AWS credentials)")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
@@ -6,10 +6,15 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/automationd/atun/internal/audit"
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
 	"github.com/automationd/atun/internal/constraints"
+	"github.com/automationd/atun/internal/daemon"
+	"github.com/automationd/atun/internal/hostsfile"
 	"github.com/automationd/atun/internal/logger"
 	"github.com/automationd/atun/internal/ssh"
 	"github.com/automationd/atun/internal/tunnel"
@@ -17,6 +22,10 @@ import (
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // upCmd represents the up command
@@ -27,177 +36,657 @@ var upCmd = &cobra.Command{
 
 	If the router host is not provided, the first running instance with the atun.io/version tag is used.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// TODO: Use GO Method received on `atun`
+		if targets := getTargets(); len(targets) > 1 {
+			return upTargets(cmd, args, targets)
+		}
 
-		var err error
-		var routerHost string
+		requiresSSH, err := prepareTunnel(cmd, args)
+		if err != nil {
+			return err
+		}
 
-		if err := constraints.CheckConstraints(
-			constraints.WithSSMPlugin(),
-			constraints.WithAWSProfile(),
-			constraints.WithENV(),
-		); err != nil {
+		hostsEntries, err := planHostsFile(cmd, nil)
+		if err != nil {
 			return err
 		}
 
-		logger.Debug("All constraints satisfied")
-		//multiPrinter := pterm.DefaultMultiPrinter
-		//multiPrinter.Start()
+		// Supervise the tunnel in this process instead of detaching a background forwarder
+		if foreground, _ := cmd.Flags().GetBool("foreground"); foreground {
+			return runForeground(cmd, requiresSSH, hostsEntries)
+		}
 
-		ux.Println("Activating SSM Tunnel")
+		if err := checkLocalPorts(); err != nil {
+			return err
+		}
 
-		mfaInputRequired := aws.MFAInputRequired(config.App)
-		if mfaInputRequired {
-			pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
-			aws.InitAWSClients(config.App)
-		} else {
-			spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
-			aws.InitAWSClients(config.App)
-			spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+		return startTunnel(cmd, requiresSSH, hostsEntries)
+	},
+}
+
+// upTargets brings up independent tunnels for several environments and profiles. All of them are prepared and checked
+// first, so port conflicts between them are found before any tunnel starts or the hosts file is changed.
+func upTargets(cmd *cobra.Command, args []string, targets []config.Target) error {
+	if foreground, _ := cmd.Flags().GetBool("foreground"); foreground {
+		return fmt.Errorf("--foreground runs a single tunnel. Run atun up --foreground for each environment")
+	}
+	if cmd.Flag("router").Value.String() != "" {
+		return fmt.Errorf("--router can't be used with several environments or profiles")
+	}
+
+	base := config.App
+	apps := make([]*config.Atun, 0, len(targets))
+	requiresSSH := make([]bool, 0, len(targets))
+	hostsEntries := make([][]hostsfile.Entry, 0, len(targets))
+	// Loopback aliases planned for the tunnels before, they're only written to the hosts file when the tunnels start
+	aliases := map[string]bool{}
+
+	for _, t := range targets {
+		if err := useTarget(base, t); err != nil {
+			return err
 		}
 
-		// Get the router host ID from the command line
-		routerHost = cmd.Flag("router").Value.String()
+		ux.Println(fmt.Sprintf("Preparing tunnel for %s", t))
+		r, err := prepareTunnel(cmd, args)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
 
-		// If router host is not provided, get the first running instance based on the discovery tag (atun.io/version)
-		if routerHost == "" {
-			spinnerRouterDetection := ux.NewProgressSpinner("Detecting Atun routers in AWS")
+		entries, err := planHostsFile(cmd, aliases)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		for _, e := range entries {
+			aliases[e.Address] = true
+		}
 
-			config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
+		apps = append(apps, config.App)
+		requiresSSH = append(requiresSSH, r)
+		hostsEntries = append(hostsEntries, entries)
+	}
+
+	if err := tunnel.CheckPortConflicts(apps); err != nil {
+		return err
+	}
+
+	for _, app := range apps {
+		config.App = app
+		if err := checkLocalPorts(); err != nil {
+			return fmt.Errorf("%s/%s: %w", app.Config.AWSProfile, app.Config.Env, err)
+		}
+	}
+
+	for i, app := range apps {
+		config.App = app
+
+		ux.Println(fmt.Sprintf("Starting tunnel for %s/%s", app.Config.AWSProfile, app.Config.Env))
+		if err := startTunnel(cmd, requiresSSH[i], hostsEntries[i]); err != nil {
+			return fmt.Errorf("%s/%s: %w", app.Config.AWSProfile, app.Config.Env, err)
+		}
+	}
+
+	return nil
+}
+
+// prepareTunnel finds the router of the current env and profile and reads its endpoints into the app config.
+// Returns whether the tunnel needs SSH to the router.
+func prepareTunnel(cmd *cobra.Command, args []string) (bool, error) {
+	// TODO: Use GO Method received on `atun`
+
+	if err := constraints.CheckConstraints(
+		constraints.WithENV(),
+	); err != nil {
+		return false, err
+	}
+
+	// Environments with an SSH router in atun.toml don't use AWS: the router and its endpoints are configured locally
+	sshRouter, err := tunnel.LoadSSHRouter(config.App)
+	if err != nil {
+		return false, err
+	}
+
+	if sshRouter {
+		if cmd.Flag("router").Value.String() != "" {
+			return false, fmt.Errorf("--router can't be used for env %s, its SSH router is configured in atun.toml", config.App.Config.Env)
+		}
+
+		ux.Println("Activating SSH Tunnel")
+		ux.NewProgressSpinner("Reading SSH router").Success(fmt.Sprintf("SSH router: %s@%s", config.App.Config.RouterHostUser, config.App.Config.RouterAddress))
+	} else if err := prepareEC2Router(cmd, args); err != nil {
+		return false, err
+	}
+
+	// Other commands only look the ports up, they're recorded in the port registry when the tunnel comes up
+	if err := tunnel.AssignLocalPorts(config.App, config.App.Config.Hosts); err != nil {
+		return false, err
+	}
+
+	for _, host := range config.App.Config.Hosts {
+		// Review the hosts
+		logger.Debug("Endpoint", "name", host.Name, "proto", host.Proto, "remote", host.Remote, "local", host.GetLocalAddress())
+	}
+
+	// The flag wins over the idle timeouts of all environments in atun.toml
+	if cmd.Flags().Changed("idle-timeout") {
+		config.App.Config.IdleTimeout, _ = cmd.Flags().GetDuration("idle-timeout")
+		config.App.Config.IdleTimeouts = nil
+	}
+
+	if cmd.Flags().Changed("max-session") {
+		config.App.Config.MaxSession, _ = cmd.Flags().GetDuration("max-session")
+	}
+
+	// Lazy tunnels bind the local ports now and connect to the router for the first client
+	if cmd.Flags().Changed("lazy") {
+		config.App.Config.Lazy, _ = cmd.Flags().GetBool("lazy")
+	}
+	if cmd.Flags().Changed("lazy-grace") {
+		config.App.Config.LazyGrace, _ = cmd.Flags().GetDuration("lazy-grace")
+	}
+	if config.App.Config.Lazy && len(config.App.Config.Reverse) > 0 {
+		return false, fmt.Errorf("reverse endpoints can't be forwarded by a lazy tunnel, the router has to listen for them")
+	}
+
+	// Dynamic SOCKS5 proxy (like `ssh -D`) alongside the configured endpoints
+	if socksPort, _ := cmd.Flags().GetInt("socks"); socksPort > 0 {
+		config.App.Config.SocksPort = socksPort
+	}
+
+	// HTTP CONNECT proxy with a PAC file routing only the router's VPC through it
+	if httpProxyPort, _ := cmd.Flags().GetInt("http-proxy"); httpProxyPort > 0 {
+		config.App.Config.HTTPProxyPort = httpProxyPort
+
+		vpcSpinner := ux.NewProgressSpinner("Looking up router VPC networks for the PAC file")
+		vpcID, err := getRouterVPCID()
+		if err != nil {
+			vpcSpinner.Warning(fmt.Sprintf("Can't find router VPC. PAC file will send everything directly: %v", err))
+		} else {
+			network, err := aws.GetVPCNetwork(vpcID)
 			if err != nil {
-				spinnerRouterDetection.Warning("No EC2 router instances found with atun.io tags.")
-
-				// Get default from the flags
-				createHost, _ := cmd.Flags().GetBool("create")
-
-				// If the create flag is not set ask if the user wants to create a router host
-				if !createHost {
-					if !constraints.IsInteractiveTerminal() {
-						err = fmt.Errorf("no --router flag specified and no EC2 instances with atun.io tags found in %s region of AWS account %s", config.App.Config.AWSRegion, aws.GetAccountId())
-						spinnerRouterDetection.Fail("No routers found", "error", err)
-						return err
-					}
-
-					createHost, err = ux.GetConfirmation(fmt.Sprintf("%s %s", "Create a new router host?", pterm.NewStyle(pterm.Italic, pterm.Fuzzy).Sprintf("(It's easy to cleanly delete afterwards)")))
-					if err != nil {
-						logger.Fatal("Error getting confirmation:", err)
-						return err
-					}
-				}
+				vpcSpinner.Warning(fmt.Sprintf("Can't describe router VPC. PAC file will send everything directly: %v", err))
+			} else {
+				config.App.Config.ProxyCIDRs = network.CIDRs
+				config.App.Config.ProxyDomains = network.Domains
+				vpcSpinner.Success(fmt.Sprintf("VPC %s: %d CIDR blocks, %d domains", vpcID, len(network.CIDRs), len(network.Domains)))
+			}
+		}
+	}
+
+	// ssm-direct endpoints don't need SSH at all, so there's no SSH config or key to deal with
+	requiresSSH := config.App.Config.RequiresSSH()
+
+	// The forwarder runs in-process. The SSH config is only written for the user's own ssh (ssh -F)
+	if sshConfig, _ := cmd.Flags().GetBool("ssh-config"); sshConfig && requiresSSH {
+		sshConfigSpinner := ux.NewProgressSpinner("Generating SSH Config")
+
+		config.App.Config.SSHConfigFile, err = ssh.GenerateSSHConfigFile(config.App)
+		if err != nil {
+			sshConfigSpinner.Fail("Error generating SSH config file", "error", err)
+			return requiresSSH, err
+		}
+
+		sshConfigSpinner.Success("SSH Config generated", "path", config.App.Config.SSHConfigFile)
+	}
+
+	logger.Debug("Private key path", "path", config.App.Config.SSHKeyPath)
+
+	return requiresSSH, nil
+}
+
+// planHostsFile moves the endpoints to loopback aliases with their remote ports when the hosts file is used (opt-in).
+// The hosts file itself is only changed by writeHostsFile, once the tunnel passed its checks. taken holds aliases
+// planned for other tunnels of the same run.
+func planHostsFile(cmd *cobra.Command, taken map[string]bool) ([]hostsfile.Entry, error) {
+	if hostsFile, _ := cmd.Flags().GetBool("hosts-file"); hostsFile {
+		config.App.Config.HostsFile = true
+	}
+
+	if !config.App.Config.HostsFile {
+		// A tunnel brought up with --hosts-file keeps its aliases until `atun down`
+		tunnel.LoadHostsFile(config.App)
+		return nil, nil
+	}
+
+	entries, err := tunnel.PlanHostsFile(config.App, taken)
+	if err != nil {
+		return nil, fmt.Errorf("can't map remote hostnames to loopback aliases: %w", err)
+	}
+
+	return entries, nil
+}
+
+// writeHostsFile maps the remote hostnames to the loopback aliases planned by planHostsFile
+func writeHostsFile(entries []hostsfile.Entry) error {
+	if !config.App.Config.HostsFile {
+		return nil
+	}
+
+	hostsSpinner := ux.NewProgressSpinner("Mapping remote hostnames to loopback aliases")
+	if err := tunnel.WriteHostsFile(config.App, entries); err != nil {
+		hostsSpinner.Fail(fmt.Sprintf("Error updating hosts file: %s", err))
+		return err
+	}
+	hostsSpinner.Success(fmt.Sprintf("%d hostnames mapped in %s", len(entries), hostsfile.Path()))
+
+	return nil
+}
+
+// rollbackHostsFile removes the hosts file block written by writeHostsFile
+func rollbackHostsFile() {
+	if !config.App.Config.HostsFile {
+		return
+	}
+
+	if _, err := tunnel.RemoveHostsFile(config.App); err != nil {
+		logger.Error("Can't roll back hosts file", "error", err)
+	}
+}
+
+// checkLocalPorts makes sure the local ports of the tunnel are free before anything is started
+func checkLocalPorts() error {
+	// Two endpoints on the same local port would fail the tunnel later, with a less helpful error
+	if err := tunnel.CheckPortCollisions(config.App); err != nil {
+		return err
+	}
 
-				if !createHost {
-					spinnerRouterDetection.Fail("Router host creation cancelled but it's required. Exiting.")
+	// Ports taken by other processes would fail the tunnel later, with a less helpful error
+	return tunnel.CheckPorts(config.App)
+}
+
+// prepareEC2Router authenticates with AWS, finds the EC2 router of the current env and profile (creating one if asked)
+// and reads its endpoints from its tags into the app config
+func prepareEC2Router(cmd *cobra.Command, args []string) error {
+	var err error
+	var routerHost string
+
+	if err := constraints.CheckConstraints(
+		constraints.WithAWSProfile(),
+	); err != nil {
+		return err
+	}
+
+	logger.Debug("All constraints satisfied")
+	//multiPrinter := pterm.DefaultMultiPrinter
+	//multiPrinter.Start()
+
+	ux.Println("Activating SSM Tunnel")
+
+	mfaInputRequired := aws.MFAInputRequired(config.App)
+	if mfaInputRequired {
+		pterm.Printfln(" %s Authenticating with AWS", pterm.LightBlue("▶︎"))
+		aws.InitAWSClients(config.App)
+	} else {
+		spinnerAWSAuth := ux.NewProgressSpinner("Authenticating with AWS")
+		aws.InitAWSClients(config.App)
+		spinnerAWSAuth.Success(fmt.Sprintf("Authenticated with AWS account %s", aws.GetAccountId()))
+	}
+
+	// Get the router host ID from the command line
+	routerHost = cmd.Flag("router").Value.String()
+
+	// If router host is not provided, get the first running instance based on the discovery tag (atun.io/version)
+	if routerHost == "" {
+		spinnerRouterDetection := ux.NewProgressSpinner("Detecting Atun routers in AWS")
+
+		config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
+		if err != nil {
+			spinnerRouterDetection.Warning("No EC2 router instances found with atun.io tags.")
+
+			// Get default from the flags
+			createHost, _ := cmd.Flags().GetBool("create")
+
+			// If the create flag is not set ask if the user wants to create a router host
+			if !createHost {
+				if !constraints.IsInteractiveTerminal() {
+					err = fmt.Errorf("no --router flag specified and no EC2 instances with atun.io tags found in %s region of AWS account %s", config.App.Config.AWSRegion, aws.GetAccountId())
+					spinnerRouterDetection.Fail("No routers found", "error", err)
+					return err
 				}
 
-				// Run create command from here
-				err := routerCreateCmd.RunE(routerCreateCmd, args)
+				createHost, err = ux.GetConfirmation(fmt.Sprintf("%s %s", "Create a new router host?", pterm.NewStyle(pterm.Italic, pterm.Fuzzy).Sprintf("(It's easy to cleanly delete afterwards)")))
 				if err != nil {
+					logger.Fatal("Error getting confirmation:", err)
 					return err
 				}
-				spinnerRouterDetection.UpdateText("Discovering router host...")
+			}
 
-				config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
-				if err != nil {
-					logger.Debug("Error discovering router host", "error", err)
-					spinnerRouterDetection.Fail("Error discovering router host")
+			if !createHost {
+				spinnerRouterDetection.Fail("Router host creation cancelled but it's required. Exiting.")
+			}
 
-				}
+			// Run create command from here
+			err := routerCreateCmd.RunE(routerCreateCmd, args)
+			if err != nil {
+				return err
+			}
+			spinnerRouterDetection.UpdateText("Discovering router host...")
+
+			config.App.Config.RouterHostID, err = tunnel.GetRouterHostIDFromTags()
+			if err != nil {
+				logger.Debug("Error discovering router host", "error", err)
+				spinnerRouterDetection.Fail("Error discovering router host")
 
-				// TODO: suggest creating a router host.
-				// Use survey to ask if the user wants to create a router host
-				// If yes, run the create command
-				// If no, return
-				spinnerRouterDetection.Success("Routers found", "Discovered router host", config.App.Config.RouterHostID)
 			}
-			spinnerRouterDetection.Success(fmt.Sprintf("Router found: %s", config.App.Config.RouterHostID))
-		} else {
-			config.App.Config.RouterHostID = routerHost
+
+			// TODO: suggest creating a router host.
+			// Use survey to ask if the user wants to create a router host
+			// If yes, run the create command
+			// If no, return
+			spinnerRouterDetection.Success("Routers found", "Discovered router host", config.App.Config.RouterHostID)
+		}
+		spinnerRouterDetection.Success(fmt.Sprintf("Router found: %s", config.App.Config.RouterHostID))
+	} else {
+		config.App.Config.RouterHostID = routerHost
+	}
+
+	// TODO: refactor as a better functional
+	// Read atun:config from the instance as `config`
+	routerHostConfig, err := tunnel.GetRouterHostConfig(config.App.Config.RouterHostID)
+	if err != nil {
+		logger.Fatal("Error getting router endpoints config", "err", err)
+	}
+
+	config.App.Version = routerHostConfig.Version
+	config.App.Config.Hosts = routerHostConfig.Config.Hosts
+	config.App.Config.Reverse = config.MergeReverse(routerHostConfig.Config.Reverse, config.App.Config.Reverse)
+	config.App.Config.RouterHostUser = routerHostConfig.Config.RouterHostUser
+
+	return nil
+}
+
+// getRouterVPCID returns the VPC of the router for the PAC file of the HTTP proxy
+func getRouterVPCID() (string, error) {
+	if config.App.Config.IsSSHRouter() {
+		return "", fmt.Errorf("SSH router %s isn't in a VPC", config.App.Config.RouterAddress)
+	}
+	return aws.GetInstanceVPCID(config.App.Config.RouterHostID)
+}
+
+// startTunnel asks the daemon to bring up the tunnel prepared by prepareTunnel and checked by checkLocalPorts
+// and shows its endpoints
+func startTunnel(cmd *cobra.Command, requiresSSH bool, hostsEntries []hostsfile.Entry) error {
+	//err := o.checkOsVersion()
+	//if err != nil {
+	//	return err
+	//}
+
+	// The hosts file block of a running tunnel stays with it, even if this `atun up` fails
+	tunnelRunning, _, err := ssh.GetSSHTunnelStatus(config.App)
+	if err != nil {
+		logger.Debug("Can't check tunnel", "error", err)
+	}
+
+	if err := writeHostsFile(hostsEntries); err != nil {
+		return err
+	}
+
+	// A tunnel that doesn't come up leaves nothing behind
+	failActivation := func(err error) error {
+		if !tunnelRunning {
+			rollbackHostsFile()
 		}
+		return err
+	}
+
+	// Try to start a tunnel before writing the SSH key (to save on time spent on SSM)
+
+	activateTunnelSpinner := ux.NewProgressSpinner("Activating Tunnel")
+	tunnelActive, connections, err := tunnel.ActivateTunnel(config.App)
+	// The key can only be pushed to EC2 routers, SSH routers must already accept it. A tunnel running with another
+	// configuration isn't fixed by the key either.
+	if err != nil && (!requiresSSH || config.App.Config.IsSSHRouter() || errors.Is(err, daemon.ErrConflict)) {
+		activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+		return failActivation(err)
+	}
+	if err != nil {
+		activateTunnelSpinner.UpdateText("SSH key doesn't seem to be present on the router host")
+
+		// Read private key from HOME/id_rsa.pub
+		publicKey, err := ssh.GetPublicKey(config.App.Config.SSHKeyPath)
+		if err != nil {
+			logger.Error("Error getting public key", "error", err)
+		}
+		logger.Debug("Public key", "key", publicKey)
 
-		// TODO: refactor as a better functional
-		// Read atun:config from the instance as `config`
-		routerHostConfig, err := tunnel.GetRouterHostConfig(config.App.Config.RouterHostID)
+		activateTunnelSpinner.UpdateText("Ensuring local SSH key is authorized on router...", "SSHPublicKeyPath", config.App.Config.SSHKeyPath, "RouterHostID", config.App.Config.RouterHostID)
+
+		// Send the public key to the router instance
+		err = aws.EnsureSSHPublicKeyPresent(config.App.Config.RouterHostID, publicKey, config.App.Config.RouterHostUser)
 		if err != nil {
-			logger.Fatal("Error getting router endpoints config", "err", err)
+			activateTunnelSpinner.Fail("Failed to add local SSH Public key to the instance", "SSHPublicKey", publicKey, "RouterHostID", config.App.Config.RouterHostID, "error", err)
+			return failActivation(err)
 		}
 
-		config.App.Version = routerHostConfig.Version
-		config.App.Config.Hosts = routerHostConfig.Config.Hosts
-		config.App.Config.RouterHostUser = routerHostConfig.Config.RouterHostUser
+		activateTunnelSpinner.UpdateText(fmt.Sprintf("Public key added to router host ~/.ssh/authorized_keys on %s", config.App.Config.RouterHostID))
+		activateTunnelSpinner.UpdateText("SSH key authorized")
 
-		for _, host := range config.App.Config.Hosts {
-			// Review the hosts
-			logger.Debug("Endpoint", "name", host.Name, "proto", host.Proto, "remote", host.Remote, "local", host.Local)
+		// Retry starting the tunnel after the key is added
+		tunnelActive, connections, err = tunnel.ActivateTunnel(config.App)
+		if err != nil {
+			activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+			return failActivation(err)
 		}
+	}
 
-		sshConfigSpinner := ux.NewProgressSpinner("Generating SSH Config")
+	activateAttemptTunnelSpinner := ux.NewProgressSpinner("Activating Tunnel")
+	activateAttemptTunnelSpinner.Success("Tunnel is active")
 
-		// Generate SSH config file
-		config.App.Config.SSHConfigFile, err = ssh.GenerateSSHConfigFile(config.App)
+	connections, waitErr := checkEndpoints(cmd, connections, func() []ssh.Endpoint {
+		_, endpoints, err := ssh.GetSSHTunnelStatus(config.App)
 		if err != nil {
-			sshConfigSpinner.Fail("Error generating SSH config file", "SSHConfigFile", config.App.Config.SSHConfigFile, "error", err)
+			logger.Debug("Can't get tunnel status", "error", err)
 		}
+		return endpoints
+	})
 
-		sshConfigSpinner.Success("SSH Config generated", "path", config.App.Config.SSHConfigFile)
+	// Clear the screen
+	ux.ClearLines(5)
 
-		logger.Debug("Private key path", "path", config.App.Config.SSHKeyPath)
+	activateAttemptTunnelSpinner.Status("Tunnel", tunnelActive, connections)
+	if waitErr != nil {
+		return waitErr
+	}
 
-		//err := o.checkOsVersion()
-		//if err != nil {
-		//	return err
-		//}
+	if config.App.Config.HTTPProxyPort > 0 {
+		ux.Println(fmt.Sprintf("HTTP proxy PAC file: %s", ssh.GetPACURL(config.App.Config.HTTPProxyPort)))
+	}
+	// TODO: Check if Instance has forwarding working (check ipv4.forwarding sysctl)
+	//ux.Println("Tunnel is active")
 
-		// Try to start a tunnel before writing the SSH key (to save on time spent on SSM)
+	return nil
+}
+
+// runForeground runs the tunnel in the current process, reconnecting it when it drops, until Ctrl+C or `atun down`
+func runForeground(cobraCmd *cobra.Command, requiresSSH bool, hostsEntries []hostsfile.Entry) error {
+	// The key can only be pushed to EC2 routers, SSH routers must already accept it
+	if requiresSSH && !config.App.Config.IsSSHRouter() {
+		keySpinner := ux.NewProgressSpinner("Ensuring local SSH key is authorized on router...")
 
-		activateTunnelSpinner := ux.NewProgressSpinner("Activating Tunnel")
-		tunnelActive, connections, err := tunnel.ActivateTunnel(config.App)
+		publicKey, err := ssh.GetPublicKey(config.App.Config.SSHKeyPath)
 		if err != nil {
-			activateTunnelSpinner.UpdateText("SSH key doesn't seem to be present on the router host")
+			keySpinner.Fail("Error getting public key", "error", err)
+			return err
+		}
 
-			// Read private key from HOME/id_rsa.pub
-			publicKey, err := ssh.GetPublicKey(config.App.Config.SSHKeyPath)
-			if err != nil {
-				logger.Error("Error getting public key", "error", err)
-			}
-			logger.Debug("Public key", "key", publicKey)
+		if err := aws.EnsureSSHPublicKeyPresent(config.App.Config.RouterHostID, publicKey, config.App.Config.RouterHostUser); err != nil {
+			keySpinner.Fail("Failed to add local SSH Public key to the instance", "RouterHostID", config.App.Config.RouterHostID, "error", err)
+			return err
+		}
 
-			activateTunnelSpinner.UpdateText("Ensuring local SSH key is authorized on router...", "SSHPublicKeyPath", config.App.Config.SSHKeyPath, "RouterHostID", config.App.Config.RouterHostID)
+		keySpinner.Success("SSH key authorized")
+	}
 
-			// Send the public key to the router instance
-			err = aws.EnsureSSHPublicKeyPresent(config.App.Config.RouterHostID, publicKey, config.App.Config.RouterHostUser)
-			if err != nil {
-				activateTunnelSpinner.Fail("Failed to add local SSH Public key to the instance", "SSHPublicKey", publicKey, "RouterHostID", config.App.Config.RouterHostID, "error", err)
-				os.Exit(1)
-			}
+	if err := checkLocalPorts(); err != nil {
+		return err
+	}
 
-			activateTunnelSpinner.UpdateText(fmt.Sprintf("Public key added to router host ~/.ssh/authorized_keys on %s", config.App.Config.RouterHostID))
-			activateTunnelSpinner.UpdateText("SSH key authorized")
+	// The tunnel would only fail on its socket, after taking over the hosts file block of the running one
+	if running, _, err := ssh.GetSSHTunnelStatus(config.App); err == nil && running {
+		return fmt.Errorf("tunnel of env %s is already running, run `atun down` first", config.App.Config.Env)
+	}
 
-			// Retry starting the tunnel after the key is added
-			tunnelActive, connections, err = tunnel.ActivateTunnel(config.App)
-			if err != nil {
-				activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
-				os.Exit(1)
-			}
+	if err := writeHostsFile(hostsEntries); err != nil {
+		return err
+	}
+	// Nothing is left behind when the foreground tunnel stops or doesn't come up
+	defer rollbackHostsFile()
+
+	activateTunnelSpinner := ux.NewProgressSpinner("Activating Tunnel")
+
+	spec := ssh.NewTunnelSpec(config.App)
+
+	supervisor, err := daemon.NewSupervisor(config.App.Session, spec)
+	if err != nil {
+		activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(cobraCmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := supervisor.Start(ctx); err != nil {
+		activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+		return err
+	}
+
+	// The session is recorded in the history of `atun history`
+	startedAt := time.Now()
+	var callerARN, account string
+	if config.App.Session != nil {
+		if callerARN, account, err = aws.GetCallerIdentity(config.App.Session); err != nil {
+			logger.Debug("Can't get AWS caller identity for the session history", "error", err)
+		}
+	}
+	history := daemon.StartAudit(spec, startedAt, callerARN, account)
+
+	// `atun status` and `atun down` find the tunnel by its journal and talk to it over its socket
+	control, err := ssh.ServeControl(spec.SocketFile, supervisor, func() {
+		history.SetReason(audit.ReasonDown)
+		cancel()
+	})
+	if err != nil {
+		cancel()
+		_ = supervisor.Run(ctx)
+		history.Stop(err)
+		activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+		return err
+	}
+	defer func() {
+		_ = control.Close()
+		_ = os.Remove(spec.SocketFile)
+	}()
+
+	journal := ssh.NewJournal(spec, startedAt)
+	if config.App.Session != nil {
+		if expires, err := config.App.Session.Config.Credentials.ExpiresAt(); err == nil {
+			journal.CredentialsExpires = expires
 		}
+	}
+	if err := ssh.WriteJournal(journal); err != nil {
+		cancel()
+		_ = supervisor.Run(ctx)
+		history.Stop(err)
+		activateTunnelSpinner.Fail(fmt.Sprintf("Error activating tunnel: %s", err))
+		return err
+	}
+	defer func() {
+		_ = os.Remove(spec.JournalFile)
+	}()
+
+	activateTunnelSpinner.Success("Tunnel is active")
+
+	endpoints, err := checkEndpoints(cobraCmd, supervisor.Endpoints(), supervisor.Endpoints)
+	activateTunnelSpinner.Status("Tunnel", true, endpoints)
+	if err != nil {
+		cancel()
+		_ = supervisor.Run(ctx)
+		history.Stop(err)
+		return err
+	}
+
+	if config.App.Config.HTTPProxyPort > 0 {
+		ux.Println(fmt.Sprintf("HTTP proxy PAC file: %s", ssh.GetPACURL(config.App.Config.HTTPProxyPort)))
+	}
+	ux.Println("Supervising the tunnel in the foreground. Press Ctrl+C to stop")
+
+	// An idle tunnel exits the same way as on `atun down`
+	go supervisor.WatchIdle(ctx, spec.IdleTimeout, func(idle time.Duration) {
+		logger.Info("Tunnel has been idle. Bringing it down", "idle", idle.Round(time.Second), "idleTimeout", spec.IdleTimeout)
+		history.SetReason(audit.ReasonIdle)
+		cancel()
+	})
+
+	go ssh.WatchMaxSession(ctx, spec.MaxSession, func() {
+		logger.Info("Tunnel reached its maximum session duration. Bringing it down", "maxSession", spec.MaxSession)
+		history.SetReason(audit.ReasonMaxSession)
+		cancel()
+	})
+
+	err = supervisor.Run(ctx)
+	// Without another reason, the tunnel was stopped with Ctrl+C or a signal
+	if err == nil {
+		history.SetReason(audit.ReasonInterrupt)
+	}
+	history.Stop(err)
+
+	return err
+}
 
-		activateAttemptTunnelSpinner := ux.NewProgressSpinner("Activating Tunnel")
-		activateAttemptTunnelSpinner.Success("Tunnel is active")
+// checkEndpoints probes the endpoints through the tunnel. With --wait it polls them until all are healthy
+// and returns an error when --wait-timeout runs out, so that `atun up --wait` exits with a non-zero code.
+func checkEndpoints(cmd *cobra.Command, endpoints []ssh.Endpoint, refresh func() []ssh.Endpoint) ([]ssh.Endpoint, error) {
+	wait, _ := cmd.Flags().GetBool("wait")
+	if !wait {
+		return ssh.CheckEndpoints(cmd.Context(), endpoints), nil
+	}
 
-		// Clear the screen
-		ux.ClearLines(5)
+	waitTimeout, _ := cmd.Flags().GetDuration("wait-timeout")
 
-		activateAttemptTunnelSpinner.Status("Tunnel", tunnelActive, connections)
-		// TODO: Check if Instance has forwarding working (check ipv4.forwarding sysctl)
-		//ux.Println("Tunnel is active")
+	ctx, cancel := context.WithTimeout(cmd.Context(), waitTimeout)
+	defer cancel()
 
-		return nil
-	},
+	waitSpinner := ux.NewProgressSpinner("Waiting for endpoints to become healthy")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		endpoints = ssh.CheckEndpoints(ctx, endpoints)
+		if ssh.EndpointsHealthy(endpoints) {
+			waitSpinner.Success("All endpoints are healthy")
+			return endpoints, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			var failing []string
+			for _, e := range endpoints {
+				if !e.Healthy() {
+					failing = append(failing, fmt.Sprintf("%s:%d (%s %s)", e.RemoteHost, e.RemotePort, e.Health, e.HealthError))
+				}
+			}
+			err := fmt.Errorf("endpoints are not healthy after %s: %s", waitTimeout, strings.Join(failing, ", "))
+			waitSpinner.Fail(err.Error())
+			return endpoints, err
+		case <-ticker.C:
+			endpoints = refresh()
+		}
+	}
 }
 
 func init() {
 	logger.Debug("Initializing up command")
 	upCmd.PersistentFlags().StringP("router", "r", "", "Router instance id to use. If not specified the first running instance with the atun.io tags is used")
 	upCmd.PersistentFlags().BoolP("create", "c", false, "Create ad-hoc router (if it doesn't exist). Will be managed by built-in CDKTf")
+	upCmd.PersistentFlags().BoolP("foreground", "f", false, "Run the tunnel in the foreground and reconnect it automatically when it drops")
+	upCmd.PersistentFlags().Int("http-proxy", 0, "Start an HTTP CONNECT proxy on this local port. A PAC file for the router's VPC is served at /proxy.pac")
+	upCmd.PersistentFlags().Duration("idle-timeout", 0, "Bring the tunnel down after it has had no connections for this long (e.g. 2h). Overrides idle_timeout of atun.toml")
+	upCmd.PersistentFlags().Duration("max-session", 0, "Bring the tunnel down this long after it started (e.g. 8h), however busy it is. Overrides max_session of atun.toml")
+	upCmd.PersistentFlags().Bool("lazy", false, "Bind the local ports right away but connect to the router only when the first client connects. Overrides lazy of atun.toml")
+	upCmd.PersistentFlags().Duration("lazy-grace", time.Minute, "How long a lazy tunnel keeps the connection to the router without clients. Overrides lazy_grace of atun.toml")
+	upCmd.PersistentFlags().Bool("hosts-file", false, "Give each remote hostname its own loopback address (127.0.0.x) with the original remote ports and map it in the hosts file. Needs sudo. Rolled back by atun down")
+	upCmd.PersistentFlags().Bool("wait", false, "Wait until all endpoints pass their health checks through the tunnel. Exits with a non-zero code if they don't")
+	upCmd.PersistentFlags().Duration("wait-timeout", 2*time.Minute, "How long --wait waits for the endpoints to become healthy")
+	upCmd.PersistentFlags().Bool("ssh-config", false, "Also write an SSH config for the router to the tunnel directory, to use it with your own ssh (ssh -F)")
+	upCmd.PersistentFlags().Int("socks", 0, "Start a SOCKS5 proxy on this local port. Hostnames are resolved on the router (e.g. curl --socks5-hostname)")
 	logger.Debug("Up command initialized")
 }
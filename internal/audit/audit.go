@@ -0,0 +1,277 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package audit keeps the history of tunnel sessions on the machine: who opened which tunnel to which router
+// and endpoints, when, and why it stopped. Records are appended to a JSON lines file in the app directory.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+)
+
+// Events of a record
+const (
+	EventStart = "start"
+	EventStop  = "stop"
+)
+
+// Exit reasons of a session
+const (
+	ReasonDown       = "down"
+	ReasonIdle       = "idle-timeout"
+	ReasonMaxSession = "max-session"
+	ReasonShutdown   = "daemon-shutdown"
+	ReasonInterrupt  = "interrupted"
+	ReasonFailed     = "failed"
+)
+
+// Record is a line of the history file. A session has a start and (unless the process was killed) a stop record.
+type Record struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	SessionID    string    `json:"session_id"`
+	User         string    `json:"user"`
+	CallerARN    string    `json:"caller_arn,omitempty"`
+	Account      string    `json:"account,omitempty"`
+	Env          string    `json:"env"`
+	AWSProfile   string    `json:"aws_profile"`
+	AWSRegion    string    `json:"aws_region"`
+	RouterHostID string    `json:"router_host_id"`
+	Endpoints    []string  `json:"endpoints"`
+	ExitReason   string    `json:"exit_reason,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// GetHistoryFilePath returns the path of the history file in the app directory
+func GetHistoryFilePath(appDir string) string {
+	return filepath.Join(appDir, "history.jsonl")
+}
+
+// Append adds a record to the history file. Records are written with a single append, so the daemon and
+// foreground tunnels can share the file.
+func Append(path string, r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("can't open history: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Read returns the records of the history file. A missing file is an empty history, damaged lines are skipped.
+func Read(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// Session is a tunnel session built from its records. StoppedAt is zero while it's running,
+// or when the process running it was killed.
+type Session struct {
+	ID           string    `json:"id"`
+	User         string    `json:"user"`
+	CallerARN    string    `json:"caller_arn,omitempty"`
+	Account      string    `json:"account,omitempty"`
+	Env          string    `json:"env"`
+	AWSProfile   string    `json:"aws_profile"`
+	AWSRegion    string    `json:"aws_region"`
+	RouterHostID string    `json:"router_host_id"`
+	Endpoints    []string  `json:"endpoints"`
+	StartedAt    time.Time `json:"started_at"`
+	StoppedAt    time.Time `json:"stopped_at,omitempty"`
+	ExitReason   string    `json:"exit_reason,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Sessions joins the start and stop records into sessions, newest first
+func Sessions(records []Record) []Session {
+	var sessions []Session
+	index := map[string]int{}
+
+	for _, r := range records {
+		switch r.Event {
+		case EventStart:
+			index[r.SessionID] = len(sessions)
+			sessions = append(sessions, Session{
+				ID:           r.SessionID,
+				User:         r.User,
+				CallerARN:    r.CallerARN,
+				Account:      r.Account,
+				Env:          r.Env,
+				AWSProfile:   r.AWSProfile,
+				AWSRegion:    r.AWSRegion,
+				RouterHostID: r.RouterHostID,
+				Endpoints:    r.Endpoints,
+				StartedAt:    r.Time,
+			})
+		case EventStop:
+			if i, ok := index[r.SessionID]; ok {
+				sessions[i].StoppedAt = r.Time
+				sessions[i].ExitReason = r.ExitReason
+				sessions[i].Error = r.Error
+			}
+		}
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+
+	return sessions
+}
+
+// Filter selects sessions. Empty fields match everything.
+type Filter struct {
+	Env          string
+	AWSProfile   string
+	RouterHostID string
+	User         string
+	// Host matches sessions with an endpoint containing it (e.g. a database hostname)
+	Host  string
+	Since time.Time
+	Limit int
+}
+
+// Apply returns the sessions matching the filter, at most Limit of them
+func (f Filter) Apply(sessions []Session) []Session {
+	var matched []Session
+	for _, s := range sessions {
+		if f.Limit > 0 && len(matched) == f.Limit {
+			break
+		}
+		if f.match(s) {
+			matched = append(matched, s)
+		}
+	}
+	return matched
+}
+
+func (f Filter) match(s Session) bool {
+	switch {
+	case f.Env != "" && s.Env != f.Env,
+		f.AWSProfile != "" && s.AWSProfile != f.AWSProfile,
+		f.RouterHostID != "" && s.RouterHostID != f.RouterHostID,
+		f.User != "" && s.User != f.User,
+		!f.Since.IsZero() && s.StartedAt.Before(f.Since):
+		return false
+	}
+
+	if f.Host == "" {
+		return true
+	}
+	for _, e := range s.Endpoints {
+		if strings.Contains(e, f.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracker records a running session: its start right away, and its stop once, with the first reason given
+type Tracker struct {
+	path   string
+	record Record
+
+	mu     sync.Mutex
+	reason string
+	once   sync.Once
+}
+
+// Start records the start of a session described by r and returns its tracker. Nothing is recorded without a path.
+func Start(path string, r Record) *Tracker {
+	r.Event = EventStart
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	if r.SessionID == "" {
+		r.SessionID = fmt.Sprintf("%s-%d", r.RouterHostID, r.Time.UnixNano())
+	}
+
+	t := &Tracker{path: path, record: r}
+	if path == "" {
+		return t
+	}
+	if err := Append(path, r); err != nil {
+		logger.Error("Can't record tunnel session", "error", err)
+		t.path = ""
+	}
+
+	return t
+}
+
+// SetReason sets why the session is about to stop. The first reason wins (an idle timeout cancelling the tunnel
+// isn't recorded as an interrupt).
+func (t *Tracker) SetReason(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reason == "" {
+		t.reason = reason
+	}
+}
+
+// Stop records the end of the session. An error without a reason set is recorded as a failure.
+func (t *Tracker) Stop(err error) {
+	t.once.Do(func() {
+		if t.path == "" {
+			return
+		}
+
+		t.mu.Lock()
+		reason := t.reason
+		t.mu.Unlock()
+
+		r := t.record
+		r.Event = EventStop
+		r.Time = time.Now()
+		r.ExitReason = reason
+		if err != nil {
+			r.Error = err.Error()
+			if reason == "" {
+				r.ExitReason = ReasonFailed
+			}
+		}
+
+		if err := Append(t.path, r); err != nil {
+			logger.Error("Can't record tunnel session", "error", err)
+		}
+	})
+}
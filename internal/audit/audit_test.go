@@ -0,0 +1,74 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := GetHistoryFilePath(t.TempDir())
+	started := time.Now().Add(-time.Hour)
+
+	prod := Start(path, Record{Time: started, SessionID: "prod-1", User: "alice", Env: "prod", RouterHostID: "i-1", Endpoints: []string{"db.internal:5432 -> 127.0.0.1:15432"}})
+	dev := Start(path, Record{Time: started.Add(time.Minute), SessionID: "dev-1", User: "bob", Env: "dev", RouterHostID: "i-2"})
+	Start(path, Record{Time: started.Add(2 * time.Minute), SessionID: "dev-2", User: "bob", Env: "dev", RouterHostID: "i-2"})
+
+	// The first reason wins, a later one (e.g. the interrupt of the cancelled context) is ignored
+	prod.SetReason(ReasonIdle)
+	prod.SetReason(ReasonInterrupt)
+	prod.Stop(nil)
+	prod.Stop(nil)
+	dev.Stop(errors.New("giving up after 3 reconnect attempts"))
+
+	// A damaged line doesn't hide the rest of the history
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{broken\n")
+	_ = f.Close()
+
+	records, err := Read(path)
+	if err != nil || len(records) != 5 {
+		t.Fatalf("Read() = %d records, %v", len(records), err)
+	}
+
+	sessions := Sessions(records)
+	if len(sessions) != 3 || sessions[0].ID != "dev-2" || sessions[2].ID != "prod-1" {
+		t.Fatalf("Sessions() = %+v, want newest first", sessions)
+	}
+	if !sessions[0].StoppedAt.IsZero() {
+		t.Errorf("session without a stop record is stopped: %+v", sessions[0])
+	}
+	if sessions[1].ExitReason != ReasonFailed || sessions[1].Error == "" {
+		t.Errorf("failed session = %+v", sessions[1])
+	}
+	if sessions[2].ExitReason != ReasonIdle || sessions[2].StoppedAt.IsZero() {
+		t.Errorf("idle session = %+v", sessions[2])
+	}
+
+	if got := (Filter{Env: "dev"}).Apply(sessions); len(got) != 2 {
+		t.Errorf("env filter = %+v", got)
+	}
+	if got := (Filter{Host: "db.internal"}).Apply(sessions); len(got) != 1 || got[0].User != "alice" {
+		t.Errorf("host filter = %+v", got)
+	}
+	if got := (Filter{Since: started.Add(90 * time.Second)}).Apply(sessions); len(got) != 1 || got[0].ID != "dev-2" {
+		t.Errorf("since filter = %+v", got)
+	}
+	if got := (Filter{User: "bob", Limit: 1}).Apply(sessions); len(got) != 1 || got[0].ID != "dev-2" {
+		t.Errorf("limit = %+v", got)
+	}
+
+	if records, err := Read(filepath.Join(t.TempDir(), "missing.jsonl")); err != nil || records != nil {
+		t.Errorf("Read() of a missing file = %v, %v", records, err)
+	}
+}
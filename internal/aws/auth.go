@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/automationd/atun/internal/config"
 	"github.com/automationd/atun/internal/logger"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"os"
@@ -30,6 +31,68 @@ type SessionConfig struct {
 	MFASharedCredentialsPath string
 }
 
+// GetEnvSession creates a session for atun processes that can't prompt for MFA (`atun ssm-proxy` run by ssh).
+// Credentials exported in the environment are used as is. Otherwise it's the configured profile, with the MFA
+// credentials cached by `atun up` if there are any.
+func GetEnvSession(app *config.Atun) (*session.Session, error) {
+	opts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if app.Config.AWSRegion != "" {
+		opts.Config.Region = aws.String(app.Config.AWSRegion)
+	}
+	if app.Config.AWSEndpointUrl != "" {
+		opts.Config.Endpoint = aws.String(app.Config.AWSEndpointUrl)
+	}
+
+	// An explicit profile would win over the environment
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		opts.Profile = app.Config.AWSProfile
+
+		mfaPath := app.Config.AWSMFASharedCredentialsFile
+		if mfaPath != "" && opts.Profile != "" {
+			if updateRequired, _ := isMFAUpdateRequired(mfaPath, opts.Profile); !updateRequired {
+				logger.Debug("Using cached MFA credentials", "profile", opts.Profile, "path", mfaPath)
+				opts.Profile = fmt.Sprintf("%s-mfa", opts.Profile)
+				opts.SharedConfigFiles = []string{mfaPath}
+			}
+		}
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("can't create AWS session: %w", err)
+	}
+
+	return sess, nil
+}
+
+// GetDaemonSession creates a session for the long-running `atun daemon`, which serves tunnels of several profiles.
+// Credentials come from the provider (handed over by `atun up`). Without one the shared config of the profile is used.
+func GetDaemonSession(profile, region, endpointURL string, provider credentials.Provider) (*session.Session, error) {
+	opts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Profile:           profile,
+	}
+
+	if provider != nil {
+		opts.Config.Credentials = credentials.NewCredentials(provider)
+	}
+	if region != "" {
+		opts.Config.Region = aws.String(region)
+	}
+	if endpointURL != "" {
+		opts.Config.Endpoint = aws.String(endpointURL)
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("can't create AWS session: %w", err)
+	}
+
+	return sess, nil
+}
+
 func GetSession(sessionConfig *SessionConfig) (*session.Session, error) {
 	// Load base session using default AWS SDK logic (SSO compatible)
 	opts := session.Options{
@@ -187,6 +187,21 @@ func GetInstanceTags(instanceID string) (map[string]string, error) {
 	return tags, nil
 }
 
+// GetCallerIdentity returns the ARN and account of the identity the session is authenticated as
+func GetCallerIdentity(sess *session.Session) (string, string, error) {
+	stsClient, err := NewSTSClient(*sess.Config)
+	if err != nil {
+		return "", "", err
+	}
+
+	result, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", "", err
+	}
+
+	return aws.StringValue(result.Arn), aws.StringValue(result.Account), nil
+}
+
 func GetAccountId() string {
 	stsClient, err := NewSTSClient(*config.App.Session.Config)
 	if err != nil {
@@ -328,6 +343,19 @@ func EnsureSSHPublicKeyPresent(instanceID string, publicKey string, routerHostUs
 	return nil
 }
 
+// StopInstance stops the instance. It keeps its disk and can be started again.
+func StopInstance(instanceID string) error {
+	ec2Client, err := NewEC2Client(*config.App.Session.Config)
+	if err != nil {
+		return err
+	}
+
+	_, err = ec2Client.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	return err
+}
+
 // GetVPCIDFromSubnet returns the VPC ID for a given subnet ID
 func GetVPCIDFromSubnet(subnetID string) (string, error) {
 	ec2Client, err := NewEC2Client(*config.App.Session.Config)
@@ -0,0 +1,130 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// VPCNetwork describes what is reachable through a router in the VPC: address ranges and private DNS domains
+type VPCNetwork struct {
+	VPCID   string
+	CIDRs   []string
+	Domains []string
+}
+
+// GetInstanceVPCID returns the VPC ID of the instance
+func GetInstanceVPCID(instanceID string) (string, error) {
+	ec2Client, err := NewEC2Client(*config.App.Session.Config)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.VpcId != nil {
+				return *instance.VpcId, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no VPC found for instance %s", instanceID)
+}
+
+// GetVPCNetwork collects the CIDR blocks of the VPC, the domain names from its DHCP options
+// and the private Route 53 zones associated with it
+func GetVPCNetwork(vpcID string) (VPCNetwork, error) {
+	network := VPCNetwork{VPCID: vpcID}
+
+	ec2Client, err := NewEC2Client(*config.App.Session.Config)
+	if err != nil {
+		return network, err
+	}
+
+	vpcs, err := ec2Client.DescribeVpcs(&ec2.DescribeVpcsInput{
+		VpcIds: []*string{aws.String(vpcID)},
+	})
+	if err != nil {
+		return network, err
+	}
+	if len(vpcs.Vpcs) == 0 {
+		return network, fmt.Errorf("VPC %s not found", vpcID)
+	}
+
+	vpc := vpcs.Vpcs[0]
+	for _, association := range vpc.CidrBlockAssociationSet {
+		if association.CidrBlock != nil {
+			network.CIDRs = append(network.CIDRs, *association.CidrBlock)
+		}
+	}
+	if len(network.CIDRs) == 0 && vpc.CidrBlock != nil {
+		network.CIDRs = append(network.CIDRs, *vpc.CidrBlock)
+	}
+
+	domains := map[string]bool{}
+
+	// DHCP options carry the default internal domain (e.g. ec2.internal or us-west-2.compute.internal)
+	if vpc.DhcpOptionsId != nil && *vpc.DhcpOptionsId != "default" {
+		options, err := ec2Client.DescribeDhcpOptions(&ec2.DescribeDhcpOptionsInput{
+			DhcpOptionsIds: []*string{vpc.DhcpOptionsId},
+		})
+		if err != nil {
+			logger.Debug("Can't describe DHCP options", "vpc", vpcID, "error", err)
+		} else {
+			for _, o := range options.DhcpOptions {
+				for _, c := range o.DhcpConfigurations {
+					if aws.StringValue(c.Key) != "domain-name" {
+						continue
+					}
+					for _, v := range c.Values {
+						for _, domain := range strings.Fields(aws.StringValue(v.Value)) {
+							domains[strings.TrimSuffix(domain, ".")] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Private hosted zones are optional: the caller may not have Route 53 permissions
+	zones, err := route53.New(config.App.Session).ListHostedZonesByVPC(&route53.ListHostedZonesByVPCInput{
+		VPCId:     aws.String(vpcID),
+		VPCRegion: aws.String(config.App.Config.AWSRegion),
+	})
+	if err != nil {
+		logger.Debug("Can't list private hosted zones", "vpc", vpcID, "error", err)
+	} else {
+		for _, zone := range zones.HostedZoneSummaries {
+			domains[strings.TrimSuffix(aws.StringValue(zone.Name), ".")] = true
+		}
+	}
+
+	for domain := range domains {
+		if domain != "" {
+			network.Domains = append(network.Domains, domain)
+		}
+	}
+	sort.Strings(network.Domains)
+
+	logger.Debug("VPC network", "vpc", vpcID, "cidrs", network.CIDRs, "domains", network.Domains)
+
+	return network, nil
+}
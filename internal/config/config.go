@@ -7,9 +7,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +30,7 @@ type Atun struct {
 
 type Config struct {
 	Hosts                       []Endpoint
+	Reverse                     []ReverseEndpoint
 	SSHKeyPath                  string
 	SSHConfigFile               string
 	SSHStrictHostKeyChecking    bool
@@ -45,24 +49,275 @@ type Config struct {
 	RouterInstanceName          string
 	RouterHostAMI               string
 	RouterHostUser              string
+	RouterAddress               string
+	SSHRouters                  map[string]SSHRouter `mapstructure:"ssh_routers"`
 	AppDir                      string
 	TunnelDir                   string
 	LogLevel                    string
 	LogPlainText                bool
 	Env                         string
 	AutoAllocatePort            bool
+	SocksPort                   int
+	HTTPProxyPort               int
+	HostsFile                   bool
+	ProxyCIDRs                  []string
+	ProxyDomains                []string
+	KeepaliveInterval           time.Duration
+	KeepaliveCountMax           int
+	ReconnectMaxBackoff         time.Duration
+	ReconnectMaxAttempts        int
+	IdleTimeout                 time.Duration
+	IdleTimeouts                map[string]time.Duration `mapstructure:"idle_timeouts"`
+	MaxSession                  time.Duration
+	Kubeconfig                  string
+	KubeContext                 string
+	KubeContexts                map[string]string `mapstructure:"kube_contexts"`
+	Lazy                        bool
+	LazyGrace                   time.Duration
+	SSMDirectMaxSessions        int
+	RouterTTL                   time.Duration
 	TerraformVersion            string
 	DemoMode                    bool
 }
 
-// TODO: Add ability to add multiple ports for forwarding for one host
-//  (maybe <host>: [{"local":0, "remote":22, "proto": "ssm"}, {"local":0, "remote":443, "proto": "ssm"}])
-
+// Endpoint is a single port mapping of a host. A host with several ports is described by several endpoints with the same Name
+// (repeated [[hosts]] entries in atun.toml, or an array in the atun.io/host/<name> tag).
 type Endpoint struct {
-	Name   string `jsonschema:"-"`
-	Proto  string `json:"proto" jsonschema:"proto"`
-	Remote int    `json:"remote" jsonschema:"remote"`
-	Local  int    `json:"local" jsonschema:"local"`
+	Name      string `jsonschema:"-"`
+	Proto     string `json:"proto" jsonschema:"proto"`
+	Transport string `json:"transport,omitempty" jsonschema:"transport"`
+	Remote    int    `json:"remote" jsonschema:"remote"`
+	Local     int    `json:"local" jsonschema:"local"`
+	// Health overrides the health check picked by the remote port (tcp, tls, http, https, postgres, mysql, redis or none)
+	Health string `json:"health,omitempty" jsonschema:"health"`
+	// Bind is the local address the endpoint listens on: an interface address (0.0.0.0, ::1) or a Unix socket path
+	Bind string `json:"bind,omitempty" jsonschema:"bind"`
+}
+
+// ReverseEndpoint exposes a service running on the local machine on a port of the router (SSH remote forward),
+// so that workloads in the VPC can call it
+type ReverseEndpoint struct {
+	Name      string `jsonschema:"-"`
+	Bind      string `json:"bind,omitempty" jsonschema:"bind"`
+	Remote    int    `json:"remote" jsonschema:"remote"`
+	Local     int    `json:"local" jsonschema:"local"`
+	LocalHost string `json:"local_host,omitempty" mapstructure:"local_host" jsonschema:"local_host"`
+}
+
+// GetBind returns the router address the reverse endpoint listens on. Defaults to all interfaces.
+// Binding to anything but loopback requires `GatewayPorts clientspecified` in the router's sshd_config.
+func (r ReverseEndpoint) GetBind() string {
+	if r.Bind == "" {
+		return "0.0.0.0"
+	}
+	return r.Bind
+}
+
+// GetLocalHost returns the local address the reverse endpoint forwards to
+func (r ReverseEndpoint) GetLocalHost() string {
+	if r.LocalHost == "" {
+		return "127.0.0.1"
+	}
+	return r.LocalHost
+}
+
+// MergeReverse combines reverse endpoints from router tags with the ones from the local config.
+// Local entries win over router entries with the same name.
+func MergeReverse(router, local []ReverseEndpoint) []ReverseEndpoint {
+	var merged []ReverseEndpoint
+
+	overridden := make(map[string]bool, len(local))
+	for _, r := range local {
+		overridden[r.Name] = true
+	}
+
+	for _, r := range router {
+		if !overridden[r.Name] {
+			merged = append(merged, r)
+		}
+	}
+
+	return append(merged, local...)
+}
+
+const (
+	// ProtoSSM forwards the endpoint through an SSH connection to the router (tunneled over SSM)
+	ProtoSSM = "ssm"
+	// ProtoSSMDirect forwards the endpoint with SSM port-forwarding sessions (AWS-StartPortForwardingSessionToRemoteHost).
+	// It doesn't need an SSH daemon, an authorized key or a known user on the router.
+	ProtoSSMDirect = "ssm-direct"
+	// ProtoK8s forwards the endpoint to a Service or Pod of a Kubernetes cluster through its API server,
+	// with the kubeconfig context of the environment. It doesn't use the router.
+	ProtoK8s = "k8s"
+	// ProtoSSH forwards the endpoint through a plain SSH connection to an SSH router (a bastion defined in atun.toml)
+	ProtoSSH = "ssh"
+)
+
+const (
+	// TransportTCP is the default endpoint transport
+	TransportTCP = "tcp"
+	// TransportUDP forwards datagrams through a relay started on the router over SSH
+	TransportUDP = "udp"
+)
+
+// Protos lists the supported endpoint protocols
+var Protos = []string{ProtoSSM, ProtoSSMDirect, ProtoK8s, ProtoSSH}
+
+// Transports lists the supported endpoint transports
+var Transports = []string{TransportTCP, TransportUDP}
+
+// IsValidProto reports whether proto is a supported endpoint protocol
+func IsValidProto(proto string) bool {
+	for _, p := range Protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidTransport reports whether transport is a supported endpoint transport. Empty means TCP.
+func IsValidTransport(transport string) bool {
+	return transport == "" || transport == TransportTCP || transport == TransportUDP
+}
+
+// IsUDP reports whether the endpoint forwards UDP datagrams
+func (e Endpoint) IsUDP() bool {
+	return e.Transport == TransportUDP
+}
+
+// GetTransport returns the endpoint transport, defaulting to TCP
+func (e Endpoint) GetTransport() string {
+	if e.Transport == "" {
+		return TransportTCP
+	}
+	return e.Transport
+}
+
+// IsUnixSocket reports whether the endpoint listens on a Unix domain socket instead of a local port.
+// Anything in bind that isn't an IP address or localhost is a socket path.
+func (e Endpoint) IsUnixSocket() bool {
+	if e.Bind == "" || e.Bind == "localhost" {
+		return false
+	}
+	return net.ParseIP(strings.Trim(e.Bind, "[]")) == nil
+}
+
+// GetBind returns the local address the endpoint listens on (without brackets for IPv6). Defaults to loopback.
+func (e Endpoint) GetBind() string {
+	if e.Bind == "" {
+		return "127.0.0.1"
+	}
+	return strings.Trim(e.Bind, "[]")
+}
+
+// GetSocketPath returns the path of the Unix socket the endpoint listens on, with ~ expanded
+func (e Endpoint) GetSocketPath() string {
+	if strings.HasPrefix(e.Bind, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, e.Bind[2:])
+		}
+	}
+	return e.Bind
+}
+
+// GetLocalAddress returns where the endpoint listens locally: a host:port or a Unix socket path
+func (e Endpoint) GetLocalAddress() string {
+	if e.IsUnixSocket() {
+		return e.GetSocketPath()
+	}
+	return net.JoinHostPort(e.GetBind(), strconv.Itoa(e.Local))
+}
+
+// RequiresSSH reports whether the endpoint is forwarded through an SSH connection to the router
+func (e Endpoint) RequiresSSH() bool {
+	return e.Proto != ProtoSSMDirect && e.Proto != ProtoK8s
+}
+
+// RequiresSSH reports whether any of the endpoints needs an SSH connection to the router.
+// Reverse endpoints and the SOCKS and HTTP proxies always do.
+func (c *Config) RequiresSSH() bool {
+	if len(c.Reverse) > 0 || c.SocksPort > 0 || c.HTTPProxyPort > 0 {
+		return true
+	}
+	for _, host := range c.Hosts {
+		if host.RequiresSSH() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIdleTimeout returns how long the tunnel of the environment may go without connections before it's brought down.
+// An entry of the env in [idle_timeouts] wins over idle_timeout. Zero keeps the tunnel up until `atun down`.
+func (c *Config) GetIdleTimeout() time.Duration {
+	if timeout, ok := c.IdleTimeouts[c.Env]; ok {
+		return timeout
+	}
+	return c.IdleTimeout
+}
+
+// GetKubeContext returns the kubeconfig context k8s endpoints of the environment use.
+// An entry of the env in [kube_contexts] wins over kube_context. Empty is the current context of the kubeconfig.
+func (c *Config) GetKubeContext() string {
+	if context, ok := c.KubeContexts[c.Env]; ok {
+		return context
+	}
+	return c.KubeContext
+}
+
+// SSHRouter is a classic SSH bastion for environments without SSM (on-prem, other clouds, legacy VPCs).
+// It's defined per environment in atun.toml as [ssh_routers.<env>], with its endpoints as [[ssh_routers.<env>.hosts]],
+// and reached directly at Address instead of being discovered in AWS.
+type SSHRouter struct {
+	// Address is the host:port of the SSH server. The port defaults to 22.
+	Address string
+	User    string
+	// Key is the private key the router accepts. Defaults to ssh_key_path.
+	Key   string
+	Hosts []Endpoint
+}
+
+// GetAddress returns the host:port of the router
+func (r SSHRouter) GetAddress() (string, error) {
+	if r.Address == "" {
+		return "", errors.New("SSH router has no address")
+	}
+
+	if _, _, err := net.SplitHostPort(r.Address); err == nil {
+		return r.Address, nil
+	}
+
+	// Without a port (or a bare IPv6 address)
+	address := net.JoinHostPort(strings.Trim(r.Address, "[]"), "22")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("bad SSH router address %q: %w", r.Address, err)
+	}
+	return address, nil
+}
+
+// GetKeyPath returns the path of the router's private key with ~ expanded, or defaultPath if it has none
+func (r SSHRouter) GetKeyPath(defaultPath string) string {
+	if r.Key == "" {
+		return defaultPath
+	}
+	if strings.HasPrefix(r.Key, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, r.Key[2:])
+		}
+	}
+	return r.Key
+}
+
+// GetSSHRouter returns the SSH router of the environment. False means its router is an EC2 instance reached over SSM.
+func (c *Config) GetSSHRouter() (SSHRouter, bool) {
+	router, ok := c.SSHRouters[c.Env]
+	return router, ok
+}
+
+// IsSSHRouter reports whether the tunnel goes to an SSH router rather than an EC2 router
+func (c *Config) IsSSHRouter() bool {
+	return c.RouterAddress != ""
 }
 
 // RouterInfo represents the information about a router
@@ -73,6 +328,17 @@ type RouterInfo struct {
 	CreatedAt time.Time
 }
 
+// ExpiredRouter is an ad-hoc router whose atun.io/expires-at tag has passed
+type ExpiredRouter struct {
+	ID        string
+	Env       string
+	ExpiresAt time.Time
+	SubnetID  string
+	VPCID     string
+	// LocalState is set when the router was created from this machine, so its CDKTF stack can be destroyed
+	LocalState bool
+}
+
 var App *Atun
 var InitialApp *Atun
 
@@ -171,6 +437,19 @@ func LoadConfig() error {
 	viper.SetDefault("LOG_PLAIN_TEXT", false)               // Set LOG_PLAIN_TEXT to false by default
 	viper.SetDefault("TERRAFORM_VERSION", "latest")         // Default to latest Terraform version
 	viper.SetDefault("DEMO_MODE", false)                    // Default to false
+	viper.SetDefault("KEEPALIVE_INTERVAL", "30s")           // Probe the router every 30 seconds
+	viper.SetDefault("KEEPALIVE_COUNT_MAX", 3)              // Reconnect after 3 unanswered keepalives
+	viper.SetDefault("RECONNECT_MAX_BACKOFF", "1m")         // Back off reconnect attempts up to a minute
+	viper.SetDefault("RECONNECT_MAX_ATTEMPTS", 0)           // Keep reconnecting forever
+	viper.SetDefault("HOSTS_FILE", false)                   // Endpoints stay on 127.0.0.1 with rewritten ports unless opted in
+	viper.SetDefault("IDLE_TIMEOUT", 0)                     // Idle tunnels stay up until atun down
+	viper.SetDefault("MAX_SESSION", 0)                      // Tunnels have no maximum duration
+	viper.SetDefault("KUBECONFIG", "")                      // k8s endpoints use $KUBECONFIG or ~/.kube/config
+	viper.SetDefault("KUBE_CONTEXT", "")                    // k8s endpoints use the current context of the kubeconfig
+	viper.SetDefault("LAZY", false)                         // Tunnels connect to the router on atun up
+	viper.SetDefault("LAZY_GRACE", "1m")                    // Lazy tunnels close unused router connections after a minute
+	viper.SetDefault("SSM_DIRECT_MAX_SESSIONS", 0)          // ssm-direct endpoints open as many sessions as they have connections
+	viper.SetDefault("ROUTER_TTL", 0)                       // Ad-hoc routers don't expire
 
 	// TODO?: Move init a separate file with correct imports of config
 	App = &Atun{
@@ -197,6 +476,21 @@ func LoadConfig() error {
 			LogLevel:                    viper.GetString("LOG_LEVEL"),
 			LogPlainText:                viper.GetBool("LOG_PLAIN_TEXT"),
 			AutoAllocatePort:            viper.GetBool("AUTO_ALLOCATE_PORT"),
+			SocksPort:                   viper.GetInt("SOCKS_PORT"),
+			HTTPProxyPort:               viper.GetInt("HTTP_PROXY_PORT"),
+			HostsFile:                   viper.GetBool("HOSTS_FILE"),
+			KeepaliveInterval:           viper.GetDuration("KEEPALIVE_INTERVAL"),
+			KeepaliveCountMax:           viper.GetInt("KEEPALIVE_COUNT_MAX"),
+			ReconnectMaxBackoff:         viper.GetDuration("RECONNECT_MAX_BACKOFF"),
+			ReconnectMaxAttempts:        viper.GetInt("RECONNECT_MAX_ATTEMPTS"),
+			IdleTimeout:                 viper.GetDuration("IDLE_TIMEOUT"),
+			MaxSession:                  viper.GetDuration("MAX_SESSION"),
+			Kubeconfig:                  viper.GetString("KUBECONFIG"),
+			KubeContext:                 viper.GetString("KUBE_CONTEXT"),
+			Lazy:                        viper.GetBool("LAZY"),
+			LazyGrace:                   viper.GetDuration("LAZY_GRACE"),
+			SSMDirectMaxSessions:        viper.GetInt("SSM_DIRECT_MAX_SESSIONS"),
+			RouterTTL:                   viper.GetDuration("ROUTER_TTL"),
 			TerraformVersion:            viper.GetString("TERRAFORM_VERSION"),
 			DemoMode:                    viper.GetBool("DEMO_MODE"),
 		},
@@ -0,0 +1,191 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HostTagPrefix is the prefix of the router tags describing endpoints (atun.io/host/<name>)
+	HostTagPrefix = "atun.io/host/"
+	// ReverseTagPrefix is the prefix of the router tags describing reverse endpoints (atun.io/reverse/<name>)
+	ReverseTagPrefix = "atun.io/reverse/"
+	// ExpiresAtTag marks ad-hoc routers created with a time-to-live. `atun router gc` removes them once it's passed.
+	ExpiresAtTag = "atun.io/expires-at"
+)
+
+// PortMapping is a single forwarded port of a host as stored in the atun.io/host/<name> tag
+type PortMapping struct {
+	Proto     string  `json:"proto"`
+	Transport string  `json:"transport,omitempty"`
+	Remote    tagPort `json:"remote"`
+	Local     tagPort `json:"local"`
+	Health    string  `json:"health,omitempty"`
+	Bind      string  `json:"bind,omitempty"`
+}
+
+// tagPort is a port number that may be written either as a number or as a string ("local":"23306")
+type tagPort int
+
+func (p *tagPort) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" {
+		*p = 0
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", data)
+	}
+
+	*p = tagPort(n)
+	return nil
+}
+
+// HostTagKey returns the tag key for the host
+func HostTagKey(name string) string {
+	return HostTagPrefix + name
+}
+
+// HostTags groups endpoints by host name and builds atun.io/host/<name> tag values.
+// A host with a single port mapping is written as an object (readable by older clients), several mappings as an array.
+func HostTags(hosts []Endpoint) (map[string]string, error) {
+	mappings := make(map[string][]PortMapping)
+
+	for _, host := range hosts {
+		mappings[host.Name] = append(mappings[host.Name], PortMapping{
+			Proto:     host.Proto,
+			Transport: host.Transport,
+			Remote:    tagPort(host.Remote),
+			Local:     tagPort(host.Local),
+			Health:    host.Health,
+			Bind:      host.Bind,
+		})
+	}
+
+	tags := make(map[string]string, len(mappings))
+
+	for name, ports := range mappings {
+		var value interface{} = ports
+		if len(ports) == 1 {
+			value = ports[0]
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("can't marshal endpoints config of %s: %w", name, err)
+		}
+
+		tags[HostTagKey(name)] = string(data)
+	}
+
+	return tags, nil
+}
+
+// ParseHostTag parses the value of the atun.io/host/<name> tag into endpoints.
+// The value is either a single {proto, remote, local} object or an array of them.
+func ParseHostTag(name, value string) ([]Endpoint, error) {
+	var ports []PortMapping
+
+	trimmed := bytes.TrimSpace([]byte(value))
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &ports); err != nil {
+			return nil, err
+		}
+	} else {
+		var port PortMapping
+		if err := json.Unmarshal(trimmed, &port); err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+
+	endpoints := make([]Endpoint, 0, len(ports))
+	for _, port := range ports {
+		endpoints = append(endpoints, Endpoint{
+			Name:      name,
+			Proto:     port.Proto,
+			Transport: port.Transport,
+			Remote:    int(port.Remote),
+			Local:     int(port.Local),
+			Health:    port.Health,
+			Bind:      port.Bind,
+		})
+	}
+
+	return endpoints, nil
+}
+
+// ReverseTags builds atun.io/reverse/<name> tag values
+func ReverseTags(reverse []ReverseEndpoint) (map[string]string, error) {
+	tags := make(map[string]string, len(reverse))
+
+	for _, r := range reverse {
+		// The name is the tag key suffix, so it's left out of the value
+		data, err := json.Marshal(struct {
+			Bind      string `json:"bind,omitempty"`
+			Remote    int    `json:"remote"`
+			Local     int    `json:"local"`
+			LocalHost string `json:"local_host,omitempty"`
+		}{r.Bind, r.Remote, r.Local, r.LocalHost})
+		if err != nil {
+			return nil, fmt.Errorf("can't marshal reverse endpoint %s: %w", r.Name, err)
+		}
+
+		tags[ReverseTagPrefix+r.Name] = string(data)
+	}
+
+	return tags, nil
+}
+
+// ParseReverseTag parses the value of the atun.io/reverse/<name> tag
+func ParseReverseTag(name, value string) (ReverseEndpoint, error) {
+	var r struct {
+		Bind      string  `json:"bind"`
+		Remote    tagPort `json:"remote"`
+		Local     tagPort `json:"local"`
+		LocalHost string  `json:"local_host"`
+	}
+
+	if err := json.Unmarshal([]byte(value), &r); err != nil {
+		return ReverseEndpoint{}, err
+	}
+
+	return ReverseEndpoint{
+		Name:      name,
+		Bind:      r.Bind,
+		Remote:    int(r.Remote),
+		Local:     int(r.Local),
+		LocalHost: r.LocalHost,
+	}, nil
+}
+
+// ExpiresAtTagValue returns the atun.io/expires-at tag value of a router created now with the time-to-live
+func ExpiresAtTagValue(now time.Time, ttl time.Duration) string {
+	return now.Add(ttl).UTC().Format(time.RFC3339)
+}
+
+// RouterExpired reports whether the router with the tags has an atun.io/expires-at tag that has passed
+func RouterExpired(tags map[string]string, now time.Time) (bool, time.Time, error) {
+	value, ok := tags[ExpiresAtTag]
+	if !ok {
+		return false, time.Time{}, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid %s tag %q: %w", ExpiresAtTag, value, err)
+	}
+
+	return !now.Before(expiresAt), expiresAt, nil
+}
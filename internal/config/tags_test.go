@@ -0,0 +1,144 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHostTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []Endpoint
+	}{
+		{
+			name:  "single object",
+			value: `{"local":15432,"proto":"ssm","remote":5432}`,
+			want:  []Endpoint{{Name: "db", Proto: "ssm", Remote: 5432, Local: 15432}},
+		},
+		{
+			name:  "single object with string ports",
+			value: `{"local":"23306","proto":"ssm","remote":3306}`,
+			want:  []Endpoint{{Name: "db", Proto: "ssm", Remote: 3306, Local: 23306}},
+		},
+		{
+			name:  "array",
+			value: `[{"local":15432,"proto":"ssm","remote":5432},{"local":16432,"proto":"ssm-direct","remote":6432}]`,
+			want: []Endpoint{
+				{Name: "db", Proto: "ssm", Remote: 5432, Local: 15432},
+				{Name: "db", Proto: "ssm-direct", Remote: 6432, Local: 16432},
+			},
+		},
+		{
+			name:  "udp transport",
+			value: `{"local":10053,"proto":"ssm","transport":"udp","remote":53}`,
+			want:  []Endpoint{{Name: "db", Proto: "ssm", Transport: "udp", Remote: 53, Local: 10053}},
+		},
+		{
+			name:  "unix socket bind",
+			value: `{"local":0,"proto":"ssm","remote":5432,"bind":"/tmp/db.sock","health":"postgres"}`,
+			want:  []Endpoint{{Name: "db", Proto: "ssm", Remote: 5432, Bind: "/tmp/db.sock", Health: "postgres"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHostTag("db", tt.value)
+			if err != nil {
+				t.Fatalf("ParseHostTag: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHostTag() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostTagsRoundTrip(t *testing.T) {
+	hosts := []Endpoint{
+		{Name: "db", Proto: "ssm", Remote: 5432, Local: 15432},
+		{Name: "db", Proto: "ssm", Remote: 6432, Local: 16432},
+		{Name: "cache", Proto: "ssm", Remote: 6379, Local: 16379},
+	}
+
+	tags, err := HostTags(hosts)
+	if err != nil {
+		t.Fatalf("HostTags: %v", err)
+	}
+
+	// A single mapping stays an object so older clients can still read it
+	if got, want := tags["atun.io/host/cache"], `{"proto":"ssm","remote":6379,"local":16379}`; got != want {
+		t.Errorf("cache tag = %s, want %s", got, want)
+	}
+
+	got, err := ParseHostTag("db", tags["atun.io/host/db"])
+	if err != nil {
+		t.Fatalf("ParseHostTag: %v", err)
+	}
+	if !reflect.DeepEqual(got, hosts[:2]) {
+		t.Errorf("db round trip = %+v, want %+v", got, hosts[:2])
+	}
+}
+
+func TestReverseTagsRoundTrip(t *testing.T) {
+	reverse := []ReverseEndpoint{{Name: "webhook", Remote: 8080, Local: 3000}}
+
+	tags, err := ReverseTags(reverse)
+	if err != nil {
+		t.Fatalf("ReverseTags: %v", err)
+	}
+
+	got, err := ParseReverseTag("webhook", tags["atun.io/reverse/webhook"])
+	if err != nil {
+		t.Fatalf("ParseReverseTag: %v", err)
+	}
+	if got != reverse[0] {
+		t.Errorf("round trip = %+v, want %+v", got, reverse[0])
+	}
+}
+
+func TestRouterExpired(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tags := map[string]string{ExpiresAtTag: ExpiresAtTagValue(created, 4*time.Hour)}
+
+	if expired, _, err := RouterExpired(tags, created.Add(time.Hour)); err != nil || expired {
+		t.Errorf("RouterExpired() before the ttl = %v, %v", expired, err)
+	}
+	if expired, expiresAt, err := RouterExpired(tags, created.Add(5*time.Hour)); err != nil || !expired || !expiresAt.Equal(created.Add(4*time.Hour)) {
+		t.Errorf("RouterExpired() after the ttl = %v, %v, %v", expired, expiresAt, err)
+	}
+	if expired, _, err := RouterExpired(map[string]string{"atun.io/version": "1"}, created); err != nil || expired {
+		t.Errorf("RouterExpired() without the tag = %v, %v", expired, err)
+	}
+	if _, _, err := RouterExpired(map[string]string{ExpiresAtTag: "tomorrow"}, created); err == nil {
+		t.Error("RouterExpired() accepted an invalid tag")
+	}
+}
+
+func TestEndpointBind(t *testing.T) {
+	tests := []struct {
+		bind    string
+		socket  bool
+		address string
+	}{
+		{bind: "", address: "127.0.0.1:15432"},
+		{bind: "0.0.0.0", address: "0.0.0.0:15432"},
+		{bind: "[::1]", address: "[::1]:15432"},
+		{bind: "::1", address: "[::1]:15432"},
+		{bind: "localhost", address: "localhost:15432"},
+		{bind: "/tmp/db.sock", socket: true, address: "/tmp/db.sock"},
+	}
+
+	for _, tt := range tests {
+		e := Endpoint{Name: "db", Proto: "ssm", Remote: 5432, Local: 15432, Bind: tt.bind}
+		if e.IsUnixSocket() != tt.socket || e.GetLocalAddress() != tt.address {
+			t.Errorf("bind %q: socket %v, address %s", tt.bind, e.IsUnixSocket(), e.GetLocalAddress())
+		}
+	}
+}
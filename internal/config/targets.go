@@ -0,0 +1,61 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Target is an environment and AWS profile a tunnel runs for. Tunnels of different targets are independent.
+type Target struct {
+	Env        string
+	AWSProfile string
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s/%s", t.AWSProfile, t.Env)
+}
+
+// GetTargets combines environments and profiles (`--env dev --env staging --aws-profile a --aws-profile b`):
+// every environment with every profile, in the order given and without duplicates
+func GetTargets(envs, profiles []string) []Target {
+	var targets []Target
+	seen := map[Target]bool{}
+
+	for _, profile := range profiles {
+		for _, env := range envs {
+			t := Target{Env: env, AWSProfile: profile}
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+
+	return targets
+}
+
+// GetTunnelDir returns the directory with the tunnel and router files of the env and profile
+func GetTunnelDir(appDir, env, profile string) string {
+	return filepath.Join(appDir, fmt.Sprintf("%s-%s", env, profile))
+}
+
+// WithTarget returns a copy of the app for another env and profile, with its own tunnel directory.
+// The session and the router are left out: they belong to the profile and env, so they're set up again.
+func (a *Atun) WithTarget(t Target) *Atun {
+	c := *a.Config
+	c.Env = t.Env
+	c.AWSProfile = t.AWSProfile
+	c.TunnelDir = GetTunnelDir(c.AppDir, t.Env, t.AWSProfile)
+	c.RouterHostID = ""
+	c.RouterHostUser = ""
+	c.RouterAddress = ""
+	c.Hosts = []Endpoint{}
+
+	return &Atun{Version: a.Version, Config: &c}
+}
@@ -0,0 +1,140 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetTargets(t *testing.T) {
+	got := GetTargets([]string{"dev", "staging", "dev"}, []string{"a", "b"})
+	want := []Target{
+		{Env: "dev", AWSProfile: "a"},
+		{Env: "staging", AWSProfile: "a"},
+		{Env: "dev", AWSProfile: "b"},
+		{Env: "staging", AWSProfile: "b"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetTargets() = %v, want %v", got, want)
+	}
+}
+
+func TestWithTarget(t *testing.T) {
+	app := &Atun{Version: "1", Config: &Config{
+		AppDir:       "/home/user/.atun",
+		Env:          "dev",
+		AWSProfile:   "a",
+		RouterHostID: "i-0123456789abcdef0",
+		Hosts:        []Endpoint{{Name: "db.internal", Remote: 5432, Local: 15432}},
+		SocksPort:    1080,
+		IdleTimeout:  8 * time.Hour,
+		IdleTimeouts: map[string]time.Duration{"staging": 30 * time.Minute},
+		KubeContext:  "kind-dev",
+		KubeContexts: map[string]string{"staging": "arn:aws:eks:us-east-1:123456789012:cluster/staging"},
+	}}
+
+	staging := app.WithTarget(Target{Env: "staging", AWSProfile: "b"})
+
+	if staging.Config.TunnelDir != filepath.Join("/home/user/.atun", "staging-b") || staging.Config.RouterHostID != "" || len(staging.Config.Hosts) != 0 {
+		t.Fatalf("WithTarget() = %+v", staging.Config)
+	}
+	if staging.Config.SocksPort != 1080 || staging.Version != "1" {
+		t.Fatalf("WithTarget() didn't keep the settings: %+v", staging.Config)
+	}
+	if app.Config.GetIdleTimeout() != 8*time.Hour || staging.Config.GetIdleTimeout() != 30*time.Minute {
+		t.Fatalf("GetIdleTimeout() = %v/%v, want the staging one for staging", app.Config.GetIdleTimeout(), staging.Config.GetIdleTimeout())
+	}
+	if app.Config.GetKubeContext() != "kind-dev" || staging.Config.GetKubeContext() != "arn:aws:eks:us-east-1:123456789012:cluster/staging" {
+		t.Fatalf("GetKubeContext() = %q/%q, want the staging one for staging", app.Config.GetKubeContext(), staging.Config.GetKubeContext())
+	}
+	if app.Config.Env != "dev" || app.Config.RouterHostID == "" || len(app.Config.Hosts) != 1 {
+		t.Fatalf("WithTarget() changed the original: %+v", app.Config)
+	}
+}
+
+func TestLoadConfigIdleTimeouts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("ENV", "")
+	t.Setenv("ATUN_ENV", "")
+
+	toml := `env = "staging"
+idle_timeout = "8h"
+
+[idle_timeouts]
+staging = "30m"
+`
+	if err := os.WriteFile(filepath.Join(dir, "atun.toml"), []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+		viper.Reset()
+	})
+
+	if err := LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if got := App.Config.GetIdleTimeout(); got != 30*time.Minute {
+		t.Errorf("GetIdleTimeout() = %v, want 30m from [idle_timeouts]", got)
+	}
+	if got := App.WithTarget(Target{Env: "dev"}).Config.GetIdleTimeout(); got != 8*time.Hour {
+		t.Errorf("GetIdleTimeout() for dev = %v, want idle_timeout", got)
+	}
+}
+
+func TestGetSSHRouter(t *testing.T) {
+	c := &Config{Env: "onprem", SSHRouters: map[string]SSHRouter{
+		"onprem": {Address: "bastion.example.com", User: "ubuntu"},
+		"legacy": {Address: "10.0.0.1:2222", User: "admin", Key: "/keys/legacy"},
+	}}
+
+	router, ok := c.GetSSHRouter()
+	if !ok || router.User != "ubuntu" {
+		t.Fatalf("GetSSHRouter() = %+v, %v", router, ok)
+	}
+	if router.GetKeyPath("/keys/default") != "/keys/default" || c.SSHRouters["legacy"].GetKeyPath("/keys/default") != "/keys/legacy" {
+		t.Errorf("GetKeyPath() didn't default to ssh_key_path only without a key")
+	}
+
+	tests := []struct {
+		address string
+		want    string
+		err     bool
+	}{
+		{address: "bastion.example.com", want: "bastion.example.com:22"},
+		{address: "10.0.0.1:2222", want: "10.0.0.1:2222"},
+		{address: "::1", want: "[::1]:22"},
+		{address: "[2001:db8::1]:2222", want: "[2001:db8::1]:2222"},
+		{address: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := SSHRouter{Address: tt.address}.GetAddress()
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("GetAddress(%q) = %q, %v, want %q", tt.address, got, err, tt.want)
+		}
+	}
+
+	if _, ok := (&Config{Env: "prod", SSHRouters: c.SSHRouters}).GetSSHRouter(); ok {
+		t.Error("GetSSHRouter() found a router for an env without one")
+	}
+}
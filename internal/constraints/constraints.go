@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"github.com/Masterminds/semver"
 	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/health"
+	"github.com/automationd/atun/internal/k8s"
 	"github.com/pterm/pterm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -31,6 +33,7 @@ type constraints struct {
 	hostConfig   bool
 	routerHostID bool
 	awsCLI       bool
+	kubectl      bool
 }
 
 // CheckConstraints checks if the constraints are met
@@ -83,6 +86,13 @@ func CheckConstraints(options ...Option) error {
 		}
 	}
 
+	if r.kubectl {
+		_, err := exec.LookPath("kubectl")
+		if err != nil {
+			return fmt.Errorf("kubectl not found: %w", err)
+		}
+	}
+
 	if len(viper.ConfigFileUsed()) == 0 && r.configFile {
 		return fmt.Errorf("this command requires a config file. Please add atun.toml to %s", config.App.Config.AppDir)
 	}
@@ -175,6 +185,12 @@ func WithAWSCLI() Option {
 	}
 }
 
+func WithKubectl() Option {
+	return func(r *constraints) {
+		r.kubectl = true
+	}
+}
+
 // ValidateAwsProfile checks if AWS_PROFILE is set in the config
 func validateAwsProfile(cfg *config.Config) error {
 	if cfg.AWSProfile == "" {
@@ -228,6 +244,49 @@ func validateHostConfig(cfg *config.Atun) error {
 			}
 
 		}
+
+		if !config.IsValidProto(host.Proto) {
+			return fmt.Errorf("Endpoint Protocol %q is not supported. Supported protocols: %s", host.Proto, strings.Join(config.Protos, ", "))
+		}
+
+		// k8s endpoints are named after the Service or Pod they forward to
+		if host.Proto == config.ProtoK8s {
+			if _, err := k8s.ParseTarget(host.Name); err != nil {
+				return fmt.Errorf("Endpoint %s: %w", host.Name, err)
+			}
+		}
+
+		if !config.IsValidTransport(host.Transport) {
+			return fmt.Errorf("Endpoint Transport %q is not supported. Supported transports: %s", host.Transport, strings.Join(config.Transports, ", "))
+		}
+
+		// SSM port-forwarding sessions carry TCP only. UDP needs the relay started over SSH
+		if host.IsUDP() && !host.RequiresSSH() {
+			return fmt.Errorf("Endpoint %s: UDP transport is not supported with %s protocol", host.Name, host.Proto)
+		}
+
+		if host.IsUnixSocket() {
+			if host.IsUDP() {
+				return fmt.Errorf("Endpoint %s: UDP transport can't listen on a Unix socket", host.Name)
+			}
+			if !filepath.IsAbs(host.GetSocketPath()) {
+				return fmt.Errorf("Endpoint %s: bind %q is neither an IP address nor an absolute socket path", host.Name, host.Bind)
+			}
+		}
+
+		if !health.IsValidCheck(host.Health) {
+			return fmt.Errorf("Endpoint %s: health check %q is not supported. Supported checks: %s", host.Name, host.Health, strings.Join(health.Checks, ", "))
+		}
+	}
+
+	for _, r := range cfg.Config.Reverse {
+		if r.Name == "" {
+			return errors.New("Reverse endpoint Name is not set. Please set it via config file.")
+		}
+
+		if r.Remote <= 0 || r.Local <= 0 {
+			return fmt.Errorf("Reverse endpoint %s: both remote (router) and local ports must be set", r.Name)
+		}
 	}
 
 	return nil
@@ -0,0 +1,58 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"time"
+
+	"github.com/automationd/atun/internal/ssh"
+)
+
+// APIVersion is the version of the daemon API. It's the prefix of every path (/v1/tunnels).
+// Breaking changes get a new version, so other tools can rely on the API.
+const APIVersion = "v1"
+
+// VersionResponse is returned by GET /v1/version
+type VersionResponse struct {
+	APIVersion string `json:"api_version"`
+	Version    string `json:"version"`
+	PID        int    `json:"pid"`
+}
+
+// Credentials are the AWS credentials a tunnel connects with. `atun up` hands over the credentials of its
+// (possibly MFA) session, so the daemon never prompts.
+type Credentials struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token,omitempty"`
+	Expires         time.Time `json:"expires,omitempty"`
+}
+
+// StartRequest is the body of POST /v1/tunnels. Starting a tunnel that is already running only refreshes its credentials,
+// a different spec is refused with 409 Conflict.
+type StartRequest struct {
+	Spec        ssh.TunnelSpec `json:"spec"`
+	Credentials *Credentials   `json:"credentials,omitempty"`
+}
+
+// Tunnel is the state of a tunnel owned by the daemon
+type Tunnel struct {
+	ID                 string          `json:"id"`
+	Env                string          `json:"env"`
+	AWSProfile         string          `json:"aws_profile"`
+	AWSRegion          string          `json:"aws_region"`
+	RouterHostID       string          `json:"router_host_id"`
+	State              ssh.TunnelState `json:"state"`
+	Reconnects         int             `json:"reconnects"`
+	StartedAt          time.Time       `json:"started_at"`
+	CredentialsExpires time.Time       `json:"credentials_expires,omitempty"`
+	Endpoints          []ssh.Endpoint  `json:"endpoints"`
+}
+
+// errorResponse is returned with every non-2xx status
+type errorResponse struct {
+	Error string `json:"error"`
+}
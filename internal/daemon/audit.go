@@ -0,0 +1,64 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"fmt"
+	"os/user"
+	"time"
+
+	"github.com/automationd/atun/internal/audit"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/ssh"
+)
+
+// StartAudit records the start of the tunnel session in the history file of the spec, with the local user and the
+// AWS identity the tunnel runs as. Specs of older clients don't name a history file, their sessions aren't recorded.
+func StartAudit(spec ssh.TunnelSpec, startedAt time.Time, callerARN, account string) *audit.Tracker {
+	record := audit.Record{
+		Time:         startedAt,
+		SessionID:    fmt.Sprintf("%s-%d", spec.ID, startedAt.UnixNano()),
+		CallerARN:    callerARN,
+		Account:      account,
+		Env:          spec.Env,
+		AWSProfile:   spec.AWSProfile,
+		AWSRegion:    spec.AWSRegion,
+		RouterHostID: spec.RouterHostID,
+		Endpoints:    auditEndpoints(spec),
+	}
+
+	if u, err := user.Current(); err == nil {
+		record.User = u.Username
+	}
+
+	return audit.Start(spec.HistoryFile, record)
+}
+
+// auditEndpoints describes the endpoints of the tunnel as remote -> local
+func auditEndpoints(spec ssh.TunnelSpec) []string {
+	var endpoints []string
+
+	for _, h := range spec.Hosts {
+		e := fmt.Sprintf("%s:%d -> %s", h.Name, h.Remote, h.GetLocalAddress())
+		if h.GetTransport() == config.TransportUDP {
+			e += " udp"
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	for _, r := range spec.Reverse {
+		endpoints = append(endpoints, fmt.Sprintf("reverse %s:%d -> %s:%d", r.GetBind(), r.Remote, r.GetLocalHost(), r.Local))
+	}
+
+	if spec.SocksPort > 0 {
+		endpoints = append(endpoints, fmt.Sprintf("* -> 127.0.0.1:%d %s", spec.SocksPort, ssh.ProxySOCKS5))
+	}
+	if spec.HTTPProxyPort > 0 {
+		endpoints = append(endpoints, fmt.Sprintf("* -> 127.0.0.1:%d %s", spec.HTTPProxyPort, ssh.ProxyHTTP))
+	}
+
+	return endpoints
+}
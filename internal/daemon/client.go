@@ -0,0 +1,132 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrNotFound is returned for tunnels the daemon doesn't know about
+var ErrNotFound = errors.New("tunnel not found")
+
+// ErrConflict is returned when a tunnel is started again with another spec (endpoints, proxies, timeouts)
+var ErrConflict = errors.New("tunnel is running with a different configuration, run `atun down` first")
+
+// Client talks to the daemon API over its Unix socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client of the daemon listening on socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+			// Starting a tunnel waits for the SSM session and the SSH handshake
+			Timeout: 2 * time.Minute,
+		},
+	}
+}
+
+// Version returns the version of the running daemon. It fails if the daemon isn't running.
+func (c *Client) Version(ctx context.Context) (VersionResponse, error) {
+	var response VersionResponse
+	err := c.do(ctx, http.MethodGet, "/version", nil, &response)
+	return response, err
+}
+
+// List returns all tunnels owned by the daemon
+func (c *Client) List(ctx context.Context) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := c.do(ctx, http.MethodGet, "/tunnels", nil, &tunnels)
+	return tunnels, err
+}
+
+// Get returns the tunnel with the ID or ErrNotFound
+func (c *Client) Get(ctx context.Context, id string) (Tunnel, error) {
+	var tunnel Tunnel
+	err := c.do(ctx, http.MethodGet, "/tunnels/"+url.PathEscape(id), nil, &tunnel)
+	return tunnel, err
+}
+
+// Start brings the tunnel up (or refreshes its credentials if it's up already) and returns its state.
+// Returns ErrConflict if the tunnel is up with another spec.
+func (c *Client) Start(ctx context.Context, request StartRequest) (Tunnel, error) {
+	var tunnel Tunnel
+	err := c.do(ctx, http.MethodPost, "/tunnels", request, &tunnel)
+	return tunnel, err
+}
+
+// Stop brings the tunnel with the ID down. Returns ErrNotFound if there's no such tunnel.
+func (c *Client) Stop(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/tunnels/"+url.PathEscape(id), nil, nil)
+}
+
+// Shutdown stops all tunnels and the daemon
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/shutdown", nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored: every request goes to the Unix socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://atund/"+APIVersion+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return ErrConflict
+	}
+
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,155 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+)
+
+// startTimeout is how long EnsureRunning waits for a freshly started daemon to answer
+const startTimeout = 10 * time.Second
+
+// GetSocketPath returns the path of the daemon API socket in the app directory
+func GetSocketPath(appDir string) string {
+	return filepath.Join(appDir, "atund.sock")
+}
+
+// GetLogFilePath returns the path of the daemon log in the app directory
+func GetLogFilePath(appDir string) string {
+	return filepath.Join(appDir, "atund.log")
+}
+
+// Listen binds the daemon API socket. The socket is only accessible by the current user:
+// the API hands out tunnels and accepts AWS credentials.
+func Listen(socketPath string) (net.Listener, error) {
+	// A leftover socket from a daemon that is gone would prevent binding
+	if _, err := os.Stat(socketPath); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if v, err := NewClient(socketPath).Version(ctx); err == nil {
+			return nil, fmt.Errorf("daemon is already running with pid %d", v.PID)
+		}
+		_ = os.Remove(socketPath)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on daemon socket %s: %w", socketPath, err)
+	}
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Connect returns a client of the running daemon, or an error if the daemon isn't running
+func Connect(ctx context.Context, appDir string) (*Client, error) {
+	client := NewClient(GetSocketPath(appDir))
+
+	if _, err := client.Version(ctx); err != nil {
+		return nil, fmt.Errorf("daemon isn't running: %w", err)
+	}
+
+	return client, nil
+}
+
+// EnsureRunning returns a client of the daemon, starting `atun daemon` in the background if it isn't running
+func EnsureRunning(ctx context.Context, appDir, logLevel string) (*Client, error) {
+	if client, err := Connect(ctx, appDir); err == nil {
+		return client, nil
+	}
+
+	atunPath, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("can't get atun executable path: %w", err)
+	}
+
+	logFilePath := GetLogFilePath(appDir)
+	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open daemon log file: %w", err)
+	}
+	defer logFile.Close()
+
+	args := []string{"daemon"}
+	if logLevel != "" {
+		args = append(args, "--log-level", logLevel)
+	}
+
+	c := exec.Command(atunPath, args...)
+	logger.Debug("Daemon command", "command", c.String())
+
+	c.Dir = appDir
+	c.Stdout = logFile
+	c.Stderr = logFile
+
+	// Detach the process (platform-dependent)
+	// Platform-specific implementation is in sysproc_*.go files
+	setupSysProcAttr(c)
+
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	logger.Debug("Daemon started in the background", "pid", c.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+	}()
+
+	deadline := time.After(startTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("daemon exited: %v: %s", err, lastLines(logFilePath, 5))
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for the daemon to start: %s", lastLines(logFilePath, 5))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			if client, err := Connect(ctx, appDir); err == nil {
+				return client, nil
+			}
+		}
+	}
+}
+
+// lastLines returns up to n last non-empty lines of a file (for error reporting)
+func lastLines(filePath string, n int) string {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return ""
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "; ")
+}
@@ -0,0 +1,415 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/audit"
+	"github.com/automationd/atun/internal/aws"
+	"github.com/automationd/atun/internal/hostsfile"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ssh"
+	"github.com/automationd/atun/internal/version"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// stopTimeout is how long stopping a tunnel may take before the request gives up waiting
+const stopTimeout = 10 * time.Second
+
+// managedTunnel is a tunnel owned by the daemon
+type managedTunnel struct {
+	spec        ssh.TunnelSpec
+	supervisor  *ssh.Supervisor
+	session     *session.Session
+	credentials *credentialsProvider
+	startedAt   time.Time
+	audit       *audit.Tracker
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (t *managedTunnel) info() Tunnel {
+	state, reconnects := t.supervisor.State()
+
+	info := Tunnel{
+		ID:           t.spec.ID,
+		Env:          t.spec.Env,
+		AWSProfile:   t.spec.AWSProfile,
+		AWSRegion:    t.spec.AWSRegion,
+		RouterHostID: t.spec.RouterHostID,
+		State:        state,
+		Reconnects:   reconnects,
+		StartedAt:    t.startedAt,
+		Endpoints:    t.supervisor.Endpoints(),
+	}
+	if t.credentials != nil {
+		info.CredentialsExpires = t.credentials.expires()
+	}
+
+	return info
+}
+
+// writeJournal records the tunnel in its state file, so atun commands find it. Specs of older clients don't name one.
+func (t *managedTunnel) writeJournal() {
+	if t.spec.JournalFile == "" {
+		return
+	}
+
+	journal := ssh.NewJournal(t.spec, t.startedAt)
+	if t.credentials != nil {
+		journal.CredentialsExpires = t.credentials.expires()
+	}
+
+	if err := ssh.WriteJournal(journal); err != nil {
+		logger.Error("Can't write tunnel state", "id", t.spec.ID, "error", err)
+	}
+}
+
+// Server owns the tunnels of the machine and serves the daemon API
+type Server struct {
+	// newSupervisor builds the supervisor of a tunnel. It's replaced in tests.
+	newSupervisor func(sess *session.Session, spec ssh.TunnelSpec) (*ssh.Supervisor, error)
+	// callerIdentity returns the AWS ARN and account of a session for the session history. It's replaced in tests.
+	callerIdentity func(sess *session.Session) (string, string, error)
+
+	// startMu serializes starts, so concurrent `atun up` runs don't start the same tunnel twice
+	startMu sync.Mutex
+
+	mu      sync.Mutex
+	tunnels map[string]*managedTunnel
+
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+// NewServer creates a daemon server without tunnels
+func NewServer() *Server {
+	return &Server{
+		newSupervisor:  NewSupervisor,
+		callerIdentity: aws.GetCallerIdentity,
+		tunnels:        make(map[string]*managedTunnel),
+		shutdown:       make(chan struct{}),
+	}
+}
+
+// Handler returns the HTTP handler of the daemon API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /"+APIVersion+"/version", s.handleVersion)
+	mux.HandleFunc("GET /"+APIVersion+"/tunnels", s.handleListTunnels)
+	mux.HandleFunc("POST /"+APIVersion+"/tunnels", s.handleStartTunnel)
+	mux.HandleFunc("GET /"+APIVersion+"/tunnels/{id}", s.handleGetTunnel)
+	mux.HandleFunc("DELETE /"+APIVersion+"/tunnels/{id}", s.handleStopTunnel)
+	mux.HandleFunc("POST /"+APIVersion+"/shutdown", s.handleShutdown)
+
+	return mux
+}
+
+// Serve answers API requests on l until ctx is cancelled or a shutdown is requested. All tunnels are stopped on return.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	server := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case <-s.shutdown:
+		logger.Info("Shutdown requested")
+	case err = <-served:
+	}
+
+	s.stopAll(audit.ReasonShutdown)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, VersionResponse{
+		APIVersion: APIVersion,
+		Version:    version.Version,
+		PID:        os.Getpid(),
+	})
+}
+
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	tunnels := make([]Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t.info())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ID < tunnels[j].ID
+	})
+
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+func (s *Server) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	t, ok := s.tunnels[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tunnel %s not found", r.PathValue("id")))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.info())
+}
+
+func (s *Server) handleStartTunnel(w http.ResponseWriter, r *http.Request) {
+	var request StartRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	if request.Spec.ID == "" || request.Spec.RouterHostID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("tunnel spec requires id and router_host_id"))
+		return
+	}
+
+	t, err := s.start(request)
+	if errors.Is(err, ErrConflict) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		logger.Error("Can't start tunnel", "id", request.Spec.ID, "error", err)
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.info())
+}
+
+func (s *Server) handleStopTunnel(w http.ResponseWriter, r *http.Request) {
+	if !s.stop(r.PathValue("id"), audit.ReasonDown) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tunnel %s not found", r.PathValue("id")))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusAccepted)
+	s.once.Do(func() {
+		close(s.shutdown)
+	})
+}
+
+// start brings a tunnel up, or refreshes the credentials of the tunnel if it's running already.
+// A running tunnel isn't changed: a request with another spec fails with ErrConflict.
+func (s *Server) start(request StartRequest) (*managedTunnel, error) {
+	spec := request.Spec
+
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	s.mu.Lock()
+	existing, ok := s.tunnels[spec.ID]
+	s.mu.Unlock()
+
+	if ok {
+		// New endpoints, proxies or timeouts would be silently dropped otherwise
+		if !reflect.DeepEqual(existing.spec, spec) {
+			logger.Info("Tunnel is running with a different configuration", "id", spec.ID)
+			return nil, ErrConflict
+		}
+
+		if request.Credentials != nil && existing.credentials != nil {
+			existing.credentials.update(*request.Credentials)
+			existing.session.Config.Credentials.Expire()
+			existing.writeJournal()
+			logger.Info("Tunnel credentials refreshed", "id", spec.ID, "expires", request.Credentials.Expires)
+		}
+		return existing, nil
+	}
+
+	var provider *credentialsProvider
+	var sess *session.Session
+	var err error
+
+	switch {
+	case spec.RouterAddress != "":
+		// SSH routers are dialed directly, the tunnel doesn't need AWS
+	case request.Credentials != nil:
+		provider = &credentialsProvider{credentials: *request.Credentials}
+		sess, err = aws.GetDaemonSession(spec.AWSProfile, spec.AWSRegion, spec.AWSEndpointURL, provider)
+	default:
+		sess, err = aws.GetDaemonSession(spec.AWSProfile, spec.AWSRegion, spec.AWSEndpointURL, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	supervisor, err := s.newSupervisor(sess, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := supervisor.Start(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// `atun status` finds the tunnel by its journal and reads the socket directly, the same way as for tunnels running in the foreground
+	control, err := ssh.ServeControl(spec.SocketFile, supervisor, cancel)
+	if err != nil {
+		cancel()
+		// Run returns right away for a cancelled context, closing the listeners
+		_ = supervisor.Run(ctx)
+		return nil, err
+	}
+
+	var callerARN, account string
+	if spec.HistoryFile != "" && sess != nil {
+		if callerARN, account, err = s.callerIdentity(sess); err != nil {
+			logger.Debug("Can't get AWS caller identity for the session history", "id", spec.ID, "error", err)
+		}
+	}
+
+	startedAt := time.Now()
+	t := &managedTunnel{
+		spec:        spec,
+		supervisor:  supervisor,
+		session:     sess,
+		credentials: provider,
+		startedAt:   startedAt,
+		audit:       StartAudit(spec, startedAt, callerARN, account),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.tunnels[spec.ID] = t
+	s.mu.Unlock()
+
+	t.writeJournal()
+
+	logger.Info("Tunnel started", "id", spec.ID, "router", spec.RouterHostID, "endpoints", len(spec.Hosts), "reverse", len(spec.Reverse))
+
+	go func() {
+		defer close(t.done)
+
+		err := supervisor.Run(ctx)
+		if err != nil {
+			logger.Error("Tunnel stopped", "id", spec.ID, "error", err)
+		} else {
+			logger.Info("Tunnel stopped", "id", spec.ID)
+		}
+		t.audit.Stop(err)
+
+		_ = control.Close()
+		_ = os.Remove(spec.SocketFile)
+		if spec.JournalFile != "" {
+			_ = os.Remove(spec.JournalFile)
+		}
+		// Nothing points at the tunnel once it's gone, whatever brought it down
+		if len(spec.HostsEntries) > 0 {
+			if _, err := hostsfile.Rollback(spec.HostsFile, spec.ID); err != nil {
+				logger.Error("Can't roll back hosts file", "id", spec.ID, "path", spec.HostsFile, "error", err)
+			}
+		}
+
+		s.mu.Lock()
+		if s.tunnels[spec.ID] == t {
+			delete(s.tunnels, spec.ID)
+		}
+		s.mu.Unlock()
+	}()
+
+	// An idle tunnel is brought down the same way as by `atun down`, its hosts file block is rolled back on exit
+	go supervisor.WatchIdle(ctx, spec.IdleTimeout, func(idle time.Duration) {
+		logger.Info("Tunnel has been idle. Bringing it down", "id", spec.ID, "idle", idle.Round(time.Second), "idleTimeout", spec.IdleTimeout)
+		s.stop(spec.ID, audit.ReasonIdle)
+	})
+
+	go ssh.WatchMaxSession(ctx, spec.MaxSession, func() {
+		logger.Info("Tunnel reached its maximum session duration. Bringing it down", "id", spec.ID, "maxSession", spec.MaxSession)
+		s.stop(spec.ID, audit.ReasonMaxSession)
+	})
+
+	return t, nil
+}
+
+// stop brings the tunnel down for the reason recorded in the session history and waits for it.
+// Returns false if there's no such tunnel.
+func (s *Server) stop(id, reason string) bool {
+	s.mu.Lock()
+	t, ok := s.tunnels[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	t.audit.SetReason(reason)
+	t.cancel()
+
+	select {
+	case <-t.done:
+	case <-time.After(stopTimeout):
+		logger.Warn("Tunnel didn't stop in time", "id", id)
+	}
+
+	return true
+}
+
+func (s *Server) stopAll(reason string) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.tunnels))
+	for id := range s.tunnels {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.stop(id, reason)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,269 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/automationd/atun/internal/audit"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/hostsfile"
+	"github.com/automationd/atun/internal/ssh"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// serveTestDaemon runs a daemon whose tunnels don't connect anywhere in a temporary directory
+func serveTestDaemon(t *testing.T, ctx context.Context) (string, *Client, chan error) {
+	t.Helper()
+
+	// Unix socket paths are limited to ~100 characters, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "atund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	socketPath := GetSocketPath(dir)
+	l, err := Listen(socketPath)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	server := NewServer()
+	// A tunnel without endpoints doesn't connect anywhere
+	server.newSupervisor = func(sess *session.Session, spec ssh.TunnelSpec) (*ssh.Supervisor, error) {
+		return ssh.NewSupervisor(func() *ssh.Forwarder {
+			return ssh.NewForwarder(nil, nil, spec.Hosts)
+		}, spec.Reconnect, nil), nil
+	}
+	server.callerIdentity = func(sess *session.Session) (string, string, error) {
+		return "arn:aws:iam::123456789012:user/dev", "123456789012", nil
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, l)
+	}()
+
+	return dir, NewClient(socketPath), served
+}
+
+// freePort returns a local port for ssm-direct endpoints, which only bind it until a client connects
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServerTunnelLifecycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, client, served := serveTestDaemon(t, ctx)
+
+	v, err := client.Version(ctx)
+	if err != nil || v.APIVersion != APIVersion || v.PID != os.Getpid() {
+		t.Fatalf("Version: %+v, %v", v, err)
+	}
+
+	spec := ssh.TunnelSpec{
+		ID:           "dev-default-i-0123456789abcdef0",
+		Env:          "dev",
+		AWSProfile:   "default",
+		AWSRegion:    "us-east-1",
+		RouterHostID: "i-0123456789abcdef0",
+		SocketFile:   filepath.Join(dir, "i-0123456789abcdef0-tunnel.sock"),
+		JournalFile:  filepath.Join(dir, "i-0123456789abcdef0-tunnel.json"),
+		HistoryFile:  audit.GetHistoryFilePath(dir),
+		Hosts:        []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: freePort(t)}},
+	}
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tunnel, err := client.Start(ctx, StartRequest{Spec: spec, Credentials: &Credentials{AccessKeyID: "AKIA", SecretAccessKey: "secret", Expires: expires}})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if tunnel.ID != spec.ID || tunnel.State != ssh.TunnelStateConnected {
+		t.Fatalf("started tunnel %+v", tunnel)
+	}
+	if _, err := os.Stat(spec.SocketFile); err != nil {
+		t.Fatalf("tunnel socket isn't served: %v", err)
+	}
+	if journal, err := ssh.ReadJournal(spec.JournalFile); err != nil || journal.PID != os.Getpid() || journal.RouterHostID != spec.RouterHostID {
+		t.Fatalf("tunnel state: %+v, %v", journal, err)
+	}
+
+	// Starting it again only refreshes the credentials
+	refreshed := expires.Add(time.Hour)
+	tunnel, err = client.Start(ctx, StartRequest{Spec: spec, Credentials: &Credentials{AccessKeyID: "AKIA2", SecretAccessKey: "secret2", Expires: refreshed}})
+	if err != nil || !tunnel.CredentialsExpires.Equal(refreshed) {
+		t.Fatalf("refresh: %+v, %v", tunnel, err)
+	}
+	if journal, err := ssh.ReadJournal(spec.JournalFile); err != nil || !journal.CredentialsExpires.Equal(refreshed) {
+		t.Fatalf("tunnel state after refresh: %+v, %v", journal, err)
+	}
+
+	// Another spec isn't silently dropped, the running tunnel stays as it is
+	changed := spec
+	changed.SocksPort = 1080
+	if _, err := client.Start(ctx, StartRequest{Spec: changed}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Start with another spec: %v, want ErrConflict", err)
+	}
+
+	tunnels, err := client.List(ctx)
+	if err != nil || len(tunnels) != 1 || tunnels[0].RouterHostID != spec.RouterHostID {
+		t.Fatalf("List: %+v, %v", tunnels, err)
+	}
+
+	// The API is versioned, endpoints use the same snake_case keys as the tunnels
+	var raw []struct {
+		Endpoints []map[string]json.RawMessage `json:"endpoints"`
+	}
+	if err := client.do(ctx, http.MethodGet, "/tunnels", nil, &raw); err != nil || len(raw) != 1 || len(raw[0].Endpoints) != 1 {
+		t.Fatalf("GET /tunnels: %+v, %v", raw, err)
+	}
+	var keys []string
+	for key := range raw[0].Endpoints[0] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range []string{"local_host", "local_port", "remote_host", "remote_port", "protocol", "transport", "status",
+		"check", "active_connections", "total_connections", "bytes_in", "bytes_out", "last_activity"} {
+		if _, ok := raw[0].Endpoints[0][key]; !ok {
+			t.Errorf("endpoint has no %q key, got %v", key, keys)
+		}
+	}
+	if string(raw[0].Endpoints[0]["remote_host"]) != `"db.internal"` {
+		t.Errorf("remote_host = %s", raw[0].Endpoints[0]["remote_host"])
+	}
+
+	if err := client.Stop(ctx, spec.ID); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if _, err := client.Get(ctx, spec.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after stop: %v", err)
+	}
+	if err := client.Stop(ctx, spec.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stop of a stopped tunnel: %v", err)
+	}
+	if _, err := os.Stat(spec.SocketFile); !os.IsNotExist(err) {
+		t.Fatalf("tunnel socket wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(spec.JournalFile); !os.IsNotExist(err) {
+		t.Fatalf("tunnel state wasn't removed: %v", err)
+	}
+
+	records, err := audit.Read(spec.HistoryFile)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	sessions := audit.Sessions(records)
+	if len(sessions) != 1 || sessions[0].RouterHostID != spec.RouterHostID || sessions[0].Account != "123456789012" ||
+		sessions[0].StoppedAt.IsZero() || sessions[0].ExitReason != audit.ReasonDown {
+		t.Fatalf("history sessions: %+v", sessions)
+	}
+
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon didn't shut down")
+	}
+}
+
+func TestServerRollsBackHostsFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, client, _ := serveTestDaemon(t, ctx)
+
+	original := "127.0.0.1 localhost\n"
+	hostsFile := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hostsFile, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		modify func(spec *ssh.TunnelSpec)
+		reason string
+	}{
+		{"max session", "dev-default-i-1", func(spec *ssh.TunnelSpec) { spec.MaxSession = 200 * time.Millisecond }, audit.ReasonMaxSession},
+		{"idle timeout", "dev-default-i-2", func(spec *ssh.TunnelSpec) { spec.IdleTimeout = 200 * time.Millisecond }, audit.ReasonIdle},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := []hostsfile.Entry{{Address: "127.0.0.2", Hostname: "db.internal"}}
+			if err := hostsfile.Apply(hostsFile, tc.id, entries); err != nil {
+				t.Fatal(err)
+			}
+
+			spec := ssh.TunnelSpec{
+				ID:           tc.id,
+				RouterHostID: tc.id,
+				SocketFile:   filepath.Join(dir, tc.id+".sock"),
+				HistoryFile:  audit.GetHistoryFilePath(dir),
+				Hosts:        []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: freePort(t)}},
+				HostsFile:    hostsFile,
+				HostsEntries: entries,
+			}
+			tc.modify(&spec)
+
+			if _, err := client.Start(ctx, StartRequest{Spec: spec}); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				if _, err := client.Get(ctx, spec.ID); errors.Is(err, ErrNotFound) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("tunnel wasn't brought down")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			if data, err := os.ReadFile(hostsFile); err != nil || string(data) != original {
+				t.Fatalf("hosts file after the tunnel stopped:\n%s, %v", data, err)
+			}
+
+			records, err := audit.Read(spec.HistoryFile)
+			if err != nil {
+				t.Fatalf("history: %v", err)
+			}
+			var reason string
+			for _, session := range audit.Sessions(records) {
+				if session.RouterHostID == spec.RouterHostID {
+					reason = session.ExitReason
+				}
+			}
+			if reason != tc.reason {
+				t.Fatalf("exit reason = %q, want %q", reason, tc.reason)
+			}
+		})
+	}
+}
@@ -6,7 +6,7 @@
  * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
  */
 
-package ssh
+package daemon
 
 import (
 	"os/exec"
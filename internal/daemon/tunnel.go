@@ -0,0 +1,121 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/k8s"
+	"github.com/automationd/atun/internal/ssh"
+	"github.com/automationd/atun/internal/ssm"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	ssh2 "golang.org/x/crypto/ssh"
+)
+
+// NewSupervisor builds the supervisor of the tunnel described by spec. SSM sessions are opened with sess.
+// SSH routers are dialed directly, so sess isn't used for them.
+func NewSupervisor(sess *session.Session, spec ssh.TunnelSpec) (*ssh.Supervisor, error) {
+	var dial ssh.Dialer
+	var clientConfig *ssh2.ClientConfig
+	var err error
+
+	// SSH key and user are only needed when some of the endpoints go through SSH
+	if spec.RequiresSSH() {
+		clientConfig, err = ssh.NewClientConfig(spec.RouterHostUser, spec.SSHKeyPath, spec.SSHStrictHostKeyChecking)
+		if err != nil {
+			return nil, err
+		}
+
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return ssm.DialSSH(ctx, sess, spec.RouterHostID, 22)
+		}
+		if spec.RouterAddress != "" {
+			dial = func(ctx context.Context) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", spec.RouterAddress)
+			}
+		}
+	}
+
+	dialDirect := func(ctx context.Context, host string, port, localPort int) (net.Conn, error) {
+		return ssm.DialRemoteHost(ctx, sess, spec.RouterHostID, host, port, localPort)
+	}
+
+	var dialKube ssh.KubeDialer
+	if spec.RequiresKube() {
+		client, err := k8s.NewClient(spec.Kubeconfig, spec.KubeContext)
+		if err != nil {
+			return nil, fmt.Errorf("can't use kubeconfig for k8s endpoints: %w", err)
+		}
+		dialKube = client.Dial
+	}
+
+	options := []ssh.ForwarderOption{
+		ssh.WithDirectDialer(dialDirect),
+		ssh.WithDirectSessionLimit(spec.SSMDirectMaxSessions),
+		ssh.WithKubeDialer(dialKube),
+		ssh.WithReverse(spec.Reverse),
+		ssh.WithSOCKS(spec.SocksPort),
+		ssh.WithHTTPProxy(spec.HTTPProxyPort, spec.ProxyCIDRs, spec.ProxyDomains),
+		ssh.WithKeepalive(spec.KeepaliveInterval, spec.KeepaliveCountMax),
+	}
+	if spec.Lazy {
+		options = append(options, ssh.WithLazy(spec.LazyGrace))
+	}
+	if spec.RouterAddress != "" {
+		options = append(options, ssh.WithSSHRouter(spec.RouterAddress))
+	}
+
+	newForwarder := func() *ssh.Forwarder {
+		return ssh.NewForwarder(dial, clientConfig, spec.Hosts, options...)
+	}
+
+	return ssh.NewSupervisor(newForwarder, spec.Reconnect, nil), nil
+}
+
+// credentialsProvider serves the credentials handed over by `atun up`. They're replaced when `atun up` runs again,
+// so a tunnel can reconnect after the original credentials have expired.
+type credentialsProvider struct {
+	mu          sync.Mutex
+	credentials Credentials
+}
+
+func (p *credentialsProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return credentials.Value{
+		AccessKeyID:     p.credentials.AccessKeyID,
+		SecretAccessKey: p.credentials.SecretAccessKey,
+		SessionToken:    p.credentials.SessionToken,
+		ProviderName:    "AtunDaemonProvider",
+	}, nil
+}
+
+// IsExpired makes the SDK retrieve the credentials again, picking up the ones set by update
+func (p *credentialsProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !p.credentials.Expires.IsZero() && time.Now().After(p.credentials.Expires)
+}
+
+func (p *credentialsProvider) update(c Credentials) {
+	p.mu.Lock()
+	p.credentials = c
+	p.mu.Unlock()
+}
+
+func (p *credentialsProvider) expires() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.credentials.Expires
+}
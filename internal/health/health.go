@@ -0,0 +1,315 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package health probes forwarded endpoints through the tunnel: it connects to the local end of an endpoint
+// and, where the protocol is known, performs a handshake with the remote service.
+package health
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// State is the health of an endpoint as seen through the tunnel
+type State string
+
+const (
+	// StateDown means nothing accepts connections on the local end
+	StateDown State = "down"
+	// StateListening means the local end accepts connections but the probe can't tell more (e.g. UDP endpoints)
+	StateListening State = "listening"
+	// StateReachable means the remote end accepted the connection through the tunnel. The protocol isn't verified.
+	StateReachable State = "reachable"
+	// StateHealthy means the remote service answered the protocol handshake
+	StateHealthy State = "healthy"
+	// StateArmed means the local end accepts connections, but the tunnel only connects to the router for the first one.
+	// It isn't probed, so the probe doesn't open the connection.
+	StateArmed State = "armed"
+	// StateFailing means the tunnel is up but the remote end refused the connection or failed the handshake
+	StateFailing State = "failing"
+)
+
+// Check kinds. CheckAuto picks one by the remote port.
+const (
+	CheckAuto     = ""
+	CheckNone     = "none"
+	CheckTCP      = "tcp"
+	CheckTLS      = "tls"
+	CheckHTTP     = "http"
+	CheckHTTPS    = "https"
+	CheckPostgres = "postgres"
+	CheckMySQL    = "mysql"
+	CheckRedis    = "redis"
+)
+
+// Checks lists the check kinds that can be configured for an endpoint
+var Checks = []string{CheckNone, CheckTCP, CheckTLS, CheckHTTP, CheckHTTPS, CheckPostgres, CheckMySQL, CheckRedis}
+
+// IsValidCheck reports whether check is a supported check kind. Empty means auto.
+func IsValidCheck(check string) bool {
+	if check == CheckAuto {
+		return true
+	}
+	for _, c := range Checks {
+		if c == check {
+			return true
+		}
+	}
+	return false
+}
+
+// wellKnownPorts maps remote ports to the check used when none is configured
+var wellKnownPorts = map[int]string{
+	80:   CheckHTTP,
+	443:  CheckHTTPS,
+	3306: CheckMySQL,
+	5432: CheckPostgres,
+	6379: CheckRedis,
+	8080: CheckHTTP,
+	8443: CheckHTTPS,
+	9200: CheckHTTP,
+}
+
+// CheckFor returns the check to run for an endpoint: the configured one, or one picked by the remote port
+func CheckFor(configured string, remotePort int) string {
+	if configured != CheckAuto {
+		return configured
+	}
+	if check, ok := wellKnownPorts[remotePort]; ok {
+		return check
+	}
+	return CheckTCP
+}
+
+const (
+	// probeTimeout bounds a single probe
+	probeTimeout = 5 * time.Second
+	// closeGracePeriod is how long a plain TCP probe waits for the forwarder to drop the connection.
+	// The local end always accepts, a failed connection to the remote end shows up as an immediate close.
+	closeGracePeriod = 500 * time.Millisecond
+)
+
+// Target is an endpoint to probe
+type Target struct {
+	// Network of the local end: tcp (default) or unix
+	Network string
+	// Address is the local end of the endpoint (127.0.0.1:15432 or a socket path)
+	Address string
+	// ServerName is the remote host, used as TLS server name and HTTP Host
+	ServerName string
+	// Check is the kind of the probe (see CheckFor)
+	Check string
+}
+
+// Result is the outcome of a probe
+type Result struct {
+	State   State
+	Latency time.Duration
+	Error   string
+}
+
+// OK reports whether the endpoint is as healthy as the probe can tell
+func (r Result) OK(check string) bool {
+	switch check {
+	case CheckNone:
+		return r.State != StateDown
+	case CheckTCP:
+		return r.State == StateReachable || r.State == StateHealthy
+	default:
+		return r.State == StateHealthy
+	}
+}
+
+// Probe checks the target through the tunnel
+func Probe(ctx context.Context, target Target) Result {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	network := target.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, target.Address)
+	if err != nil {
+		return Result{State: StateDown, Error: err.Error()}
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if target.Check == CheckNone {
+		return Result{State: StateListening}
+	}
+
+	if target.Check == CheckTCP {
+		return probeTCP(conn, start)
+	}
+
+	switch target.Check {
+	case CheckTLS:
+		err = handshakeTLS(conn, target.ServerName)
+	case CheckHTTP:
+		err = requestHTTP(conn, "http", target.ServerName)
+	case CheckHTTPS:
+		err = requestHTTPS(conn, target.ServerName)
+	case CheckPostgres:
+		err = handshakePostgres(conn)
+	case CheckMySQL:
+		err = handshakeMySQL(conn)
+	case CheckRedis:
+		err = handshakeRedis(conn)
+	default:
+		err = fmt.Errorf("unknown check %q", target.Check)
+	}
+
+	latency := time.Since(start)
+	if err != nil {
+		return Result{State: StateFailing, Latency: latency, Error: err.Error()}
+	}
+
+	return Result{State: StateHealthy, Latency: latency}
+}
+
+// probeTCP treats a connection that stays open (or sends a banner) as reachable
+func probeTCP(conn net.Conn, start time.Time) Result {
+	_ = conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+
+	_, err := conn.Read(make([]byte, 1))
+	latency := time.Since(start)
+
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return Result{State: StateReachable, Latency: latency}
+	}
+
+	return Result{State: StateFailing, Latency: latency, Error: "connection closed by the tunnel: " + err.Error()}
+}
+
+func handshakeTLS(conn net.Conn, serverName string) error {
+	// Only the availability is checked, not the identity: private CAs and IP-only endpoints are common
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) // #nosec G402
+	return tlsConn.Handshake()
+}
+
+func requestHTTPS(conn net.Conn, serverName string) error {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) // #nosec G402
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return requestHTTP(tlsConn, "https", serverName)
+}
+
+// requestHTTP sends a HEAD request. Any response but a server error means the service is up.
+func requestHTTP(conn net.Conn, scheme, host string) error {
+	req, err := http.NewRequest(http.MethodHead, scheme+"://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "atun-health")
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// handshakePostgres sends an SSLRequest. The server answers S or N before any authentication.
+func handshakePostgres(conn net.Conn) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103)
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return fmt.Errorf("unexpected postgres reply %q", reply[0])
+	}
+	return nil
+}
+
+// handshakeMySQL reads the initial handshake packet the server sends on connect
+func handshakeMySQL(conn net.Conn) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 {
+		return errors.New("empty mysql handshake")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+
+	switch payload[0] {
+	case 0x0a:
+		return nil
+	case 0xff:
+		// Error packet: 0xff, 2-byte code, an optional #SQLSTATE, then the message (e.g. "Host is blocked")
+		if len(payload) < 3 {
+			return errors.New("mysql error")
+		}
+		message := payload[3:]
+		if len(message) >= 6 && message[0] == '#' {
+			message = message[6:]
+		}
+		return fmt.Errorf("mysql error %d: %s", binary.LittleEndian.Uint16(payload[1:3]), message)
+	default:
+		return fmt.Errorf("unexpected mysql protocol version %d", payload[0])
+	}
+}
+
+// handshakeRedis sends PING. An authentication error still means the server is up.
+func handshakeRedis(conn net.Conn) error {
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-NOAUTH") || strings.HasPrefix(line, "-WRONGPASS") {
+		return nil
+	}
+	return fmt.Errorf("unexpected redis reply %q", strings.TrimSpace(line))
+}
@@ -0,0 +1,133 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package health
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve accepts connections on a local port and hands them to handle, like a forwarder would
+func serve(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	postgres := serve(t, func(conn net.Conn) {
+		_, _ = io.ReadFull(conn, make([]byte, 8))
+		_, _ = conn.Write([]byte("N"))
+	})
+	mysql := serve(t, func(conn net.Conn) {
+		payload := append([]byte{0x0a}, []byte("8.0.36\x00")...)
+		_, _ = conn.Write(append([]byte{byte(len(payload)), 0, 0, 0}, payload...))
+	})
+	mysqlBlocked := serve(t, func(conn net.Conn) {
+		payload := append([]byte{0xff, 0x69, 0x04}, []byte("Host is blocked")...)
+		_, _ = conn.Write(append([]byte{byte(len(payload)), 0, 0, 0}, payload...))
+	})
+	redis := serve(t, func(conn net.Conn) {
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); strings.HasPrefix(line, "PING") {
+			_, _ = conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		}
+	})
+	// The forwarder accepts locally and drops the connection when the remote end refuses it
+	refused := serve(t, func(conn net.Conn) {})
+	open := serve(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	web := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(web.Close)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(broken.Close)
+	secure := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(secure.Close)
+
+	tests := []struct {
+		name    string
+		address string
+		check   string
+		want    State
+	}{
+		{name: "postgres", address: postgres, check: CheckPostgres, want: StateHealthy},
+		{name: "mysql", address: mysql, check: CheckMySQL, want: StateHealthy},
+		{name: "mysql error packet", address: mysqlBlocked, check: CheckMySQL, want: StateFailing},
+		{name: "redis requiring auth", address: redis, check: CheckRedis, want: StateHealthy},
+		{name: "postgres refused through the tunnel", address: refused, check: CheckPostgres, want: StateFailing},
+		{name: "http", address: strings.TrimPrefix(web.URL, "http://"), check: CheckHTTP, want: StateHealthy},
+		{name: "http server error", address: strings.TrimPrefix(broken.URL, "http://"), check: CheckHTTP, want: StateFailing},
+		{name: "https", address: strings.TrimPrefix(secure.URL, "https://"), check: CheckHTTPS, want: StateHealthy},
+		{name: "tls", address: strings.TrimPrefix(secure.URL, "https://"), check: CheckTLS, want: StateHealthy},
+		{name: "tcp", address: open, check: CheckTCP, want: StateReachable},
+		{name: "tcp refused through the tunnel", address: refused, check: CheckTCP, want: StateFailing},
+		{name: "none", address: refused, check: CheckNone, want: StateListening},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Probe(context.Background(), Target{Address: tt.address, ServerName: "localhost", Check: tt.check})
+			if result.State != tt.want {
+				t.Fatalf("Probe() = %+v, want %s", result, tt.want)
+			}
+			if tt.want == StateHealthy && result.Latency <= 0 {
+				t.Fatalf("Probe() latency = %s", result.Latency)
+			}
+		})
+	}
+
+	// Nothing listens on the local port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	_ = l.Close()
+
+	if result := Probe(context.Background(), Target{Address: address, Check: CheckTCP}); result.State != StateDown {
+		t.Fatalf("Probe() of a closed port = %+v", result)
+	}
+}
+
+func TestCheckFor(t *testing.T) {
+	if got := CheckFor(CheckAuto, 5432); got != CheckPostgres {
+		t.Fatalf("CheckFor(5432) = %s", got)
+	}
+	if got := CheckFor(CheckAuto, 6432); got != CheckTCP {
+		t.Fatalf("CheckFor(6432) = %s", got)
+	}
+	if got := CheckFor(CheckTLS, 5432); got != CheckTLS {
+		t.Fatalf("CheckFor(tls, 5432) = %s", got)
+	}
+}
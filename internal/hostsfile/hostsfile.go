@@ -0,0 +1,248 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package hostsfile maps remote hostnames to loopback aliases in the system hosts file.
+// Entries of a tunnel live in a marked block, so they can be replaced and rolled back without touching anything else.
+package hostsfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/automationd/atun/internal/logger"
+)
+
+const (
+	beginMarker = "# BEGIN atun "
+	endMarker   = "# END atun "
+)
+
+// Entry maps a remote hostname to the loopback alias its endpoints listen on
+type Entry struct {
+	Address  string `json:"address"`
+	Hostname string `json:"hostname"`
+}
+
+// Path returns the location of the system hosts file
+func Path() string {
+	if runtime.GOOS == "windows" {
+		return os.ExpandEnv(`${SystemRoot}\System32\drivers\etc\hosts`)
+	}
+	return "/etc/hosts"
+}
+
+// Read returns the entries of the block of the tunnel with the ID, and the addresses used by blocks of other tunnels
+func Read(path, id string) (entries []Entry, taken map[string]bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	taken = map[string]bool{}
+	block := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, beginMarker):
+			block = strings.TrimPrefix(line, beginMarker)
+			continue
+		case strings.HasPrefix(line, endMarker):
+			block = ""
+			continue
+		case block == "":
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if block != id {
+			taken[fields[0]] = true
+			continue
+		}
+		for _, hostname := range fields[1:] {
+			entries = append(entries, Entry{Address: fields[0], Hostname: hostname})
+		}
+	}
+
+	return entries, taken, nil
+}
+
+// Assign gives every hostname a loopback alias (127.0.0.2 and up). Hostnames keep the aliases of existing entries,
+// and aliases taken by other tunnels are skipped.
+func Assign(hostnames []string, existing []Entry, taken map[string]bool) ([]Entry, error) {
+	current := map[string]string{}
+	for _, e := range existing {
+		current[e.Hostname] = e.Address
+	}
+
+	used := map[string]bool{}
+	for address := range taken {
+		used[address] = true
+	}
+
+	unique := make([]string, 0, len(hostnames))
+	seen := map[string]bool{}
+	for _, hostname := range hostnames {
+		if !seen[hostname] {
+			seen[hostname] = true
+			unique = append(unique, hostname)
+		}
+	}
+	sort.Strings(unique)
+
+	entries := make([]Entry, 0, len(unique))
+	var pending []string
+	for _, hostname := range unique {
+		if address, ok := current[hostname]; ok && !used[address] {
+			used[address] = true
+			entries = append(entries, Entry{Address: address, Hostname: hostname})
+			continue
+		}
+		pending = append(pending, hostname)
+	}
+
+	next := 2
+	for _, hostname := range pending {
+		for ; next < 255 && used[fmt.Sprintf("127.0.0.%d", next)]; next++ {
+		}
+		if next >= 255 {
+			return nil, errors.New("no free loopback addresses left in 127.0.0.0/24")
+		}
+
+		address := fmt.Sprintf("127.0.0.%d", next)
+		used[address] = true
+		entries = append(entries, Entry{Address: address, Hostname: hostname})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hostname < entries[j].Hostname })
+	return entries, nil
+}
+
+// IsHostname reports whether name can be mapped in the hosts file (IP addresses can't)
+func IsHostname(name string) bool {
+	return name != "" && net.ParseIP(name) == nil && name != "localhost"
+}
+
+// Apply replaces the block of the tunnel with the entries. An empty list removes the block.
+func Apply(path, id string, entries []Entry) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	updated := replaceBlock(data, id, entries)
+	if bytes.Equal(updated, data) {
+		return nil
+	}
+
+	return write(path, updated)
+}
+
+// Remove rolls back the block of the tunnel
+func Remove(path, id string) error {
+	return Apply(path, id, nil)
+}
+
+// Rollback removes the block of the tunnel and the loopback aliases no other tunnel uses.
+// Returns the entries that were rolled back.
+func Rollback(path, id string) ([]Entry, error) {
+	entries, taken, err := Read(path, id)
+	if err != nil {
+		return nil, fmt.Errorf("can't read hosts file: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	if err := Remove(path, id); err != nil {
+		return entries, err
+	}
+
+	for _, e := range entries {
+		// Another tunnel may still use the address
+		if taken[e.Address] {
+			continue
+		}
+		if err := RemoveLoopbackAlias(e.Address); err != nil {
+			logger.Debug("Can't remove loopback alias", "address", e.Address, "error", err)
+		}
+	}
+
+	return entries, nil
+}
+
+// replaceBlock drops the block of the tunnel from the hosts file content and appends the new one (if any)
+func replaceBlock(data []byte, id string, entries []Entry) []byte {
+	var lines []string
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == beginMarker+id {
+			inBlock = true
+			continue
+		}
+		if inBlock {
+			if trimmed == endMarker+id {
+				inBlock = false
+			}
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	content := strings.Join(lines, "")
+	if len(entries) == 0 {
+		return []byte(content)
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	content += beginMarker + id + "\n"
+	for _, e := range entries {
+		content += fmt.Sprintf("%s %s\n", e.Address, e.Hostname)
+	}
+	content += endMarker + id + "\n"
+
+	return []byte(content)
+}
+
+// write replaces the hosts file content. The file belongs to root, so unless atun runs as root it goes through sudo.
+func write(path string, data []byte) error {
+	err := os.WriteFile(path, data, 0644)
+	if err == nil || !errors.Is(err, os.ErrPermission) || runtime.GOOS == "windows" {
+		if err != nil {
+			return fmt.Errorf("can't write %s (run atun as administrator): %w", path, err)
+		}
+		return nil
+	}
+
+	logger.Debug("Hosts file isn't writable, updating it with sudo", "path", path)
+
+	c := exec.Command("sudo", "tee", path)
+	c.Stdin = bytes.NewReader(data)
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("can't update %s with sudo: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package hostsfile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyAndRemove(t *testing.T) {
+	original := "127.0.0.1 localhost\n::1 localhost\n"
+	other := "# BEGIN atun prod-i-2\n127.0.0.2 cache.example.internal\n# END atun prod-i-2\n"
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(original+other), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, taken, err := Read(path, "dev-i-1")
+	if err != nil || len(existing) != 0 || !taken["127.0.0.2"] {
+		t.Fatalf("Read() = %+v, %+v, %v", existing, taken, err)
+	}
+
+	// The alias of the other tunnel is skipped
+	entries, err := Assign([]string{"db.example.internal", "api.example.internal", "db.example.internal"}, existing, taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{Address: "127.0.0.3", Hostname: "api.example.internal"}, {Address: "127.0.0.4", Hostname: "db.example.internal"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("Assign() = %+v", entries)
+	}
+
+	if err := Apply(path, "dev-i-1", entries); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// Hostnames keep their aliases when the tunnel comes up again
+	existing, taken, _ = Read(path, "dev-i-1")
+	again, err := Assign([]string{"db.example.internal", "new.example.internal", "api.example.internal"}, existing, taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[0] != entries[0] || again[1] != entries[1] || again[2].Address != "127.0.0.5" {
+		t.Fatalf("Assign() after Apply = %+v", again)
+	}
+
+	if err := Remove(path, "dev-i-1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != original+other {
+		t.Fatalf("hosts file after Remove:\n%s", data)
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	for name, want := range map[string]bool{"db.example.internal": true, "10.0.0.5": false, "::1": false, "localhost": false, "": false} {
+		if IsHostname(name) != want {
+			t.Errorf("IsHostname(%q) = %v", name, !want)
+		}
+	}
+}
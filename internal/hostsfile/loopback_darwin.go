@@ -0,0 +1,63 @@
+//go:build darwin
+// +build darwin
+
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package hostsfile
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// AddLoopbackAlias makes the address bindable. macOS only configures 127.0.0.1 on lo0, other addresses need an alias.
+func AddLoopbackAlias(address string) error {
+	if loopbackAliasExists(address) {
+		return nil
+	}
+
+	c := exec.Command("sudo", "ifconfig", "lo0", "alias", address, "up")
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("can't add loopback alias %s: %w", address, err)
+	}
+	return nil
+}
+
+// RemoveLoopbackAlias removes an alias added by AddLoopbackAlias
+func RemoveLoopbackAlias(address string) error {
+	if !loopbackAliasExists(address) {
+		return nil
+	}
+
+	c := exec.Command("sudo", "ifconfig", "lo0", "-alias", address)
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("can't remove loopback alias %s: %w", address, err)
+	}
+	return nil
+}
+
+func loopbackAliasExists(address string) bool {
+	iface, err := net.InterfaceByName("lo0")
+	if err != nil {
+		return false
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.String() == address {
+			return true
+		}
+	}
+	return false
+}
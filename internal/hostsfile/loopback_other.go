@@ -0,0 +1,19 @@
+//go:build !darwin
+// +build !darwin
+
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package hostsfile
+
+// AddLoopbackAlias makes the address bindable. Linux and Windows route all of 127.0.0.0/8 to loopback already.
+func AddLoopbackAlias(address string) error {
+	return nil
+}
+
+// RemoveLoopbackAlias removes an alias added by AddLoopbackAlias
+func RemoveLoopbackAlias(address string) error {
+	return nil
+}
@@ -6,11 +6,11 @@
 package infra
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
@@ -70,27 +70,28 @@ func createStack(c *config.Config) {
 	// Set Env
 	tags["atun.io/env"] = atun.Config.Env
 
-	// TODO: Support multiple port configurations per host
-	// Group hosts by their Name and create slices for their configurations
-	hostConfigs := make(map[string]map[string]interface{})
-
-	// Process each host and add it to the final map using the Name as the key
-	for _, host := range atun.Config.Hosts {
-		key := fmt.Sprintf("atun.io/host/%s", host.Name)
-		hostConfig := map[string]interface{}{
-			"proto":  host.Proto,
-			"local":  host.Local,
-			"remote": host.Remote,
-		}
+	// Ad-hoc routers with a time-to-live are removed by `atun router gc` once it's passed
+	if atun.Config.RouterTTL > 0 {
+		tags[config.ExpiresAtTag] = config.ExpiresAtTagValue(time.Now(), atun.Config.RouterTTL)
+	}
 
-		hostConfigs[key] = hostConfig
+	// Group port mappings by host name. Each host gets a single atun.io/host/<name> tag
+	hostTags, err := config.HostTags(atun.Config.Hosts)
+	if err != nil {
+		logger.Error("Error marshalling endpoints config", "error", err)
+	}
 
+	for key, value := range hostTags {
+		tags[key] = value
+	}
+
+	reverseTags, err := config.ReverseTags(atun.Config.Reverse)
+	if err != nil {
+		logger.Error("Error marshalling reverse endpoints config", "error", err)
 	}
 
-	// Marshal each grouped configuration into a JSON string and store in finalMap
-	for key, configs := range hostConfigs {
-		configsJSON, _ := json.Marshal(configs)
-		tags[key] = string(configsJSON)
+	for key, value := range reverseTags {
+		tags[key] = value
 	}
 
 	//// Convert struct to JSON
@@ -109,7 +110,6 @@ func createStack(c *config.Config) {
 	// Add the module
 
 	if err := constraints.CheckConstraints(
-		constraints.WithSSMPlugin(),
 		constraints.WithAWSProfile(),
 		constraints.WithAWSRegion(),
 		constraints.WithENV(),
@@ -170,7 +170,6 @@ func createStack(c *config.Config) {
 func ApplyCDKTF(c *config.Config) error {
 
 	if err := constraints.CheckConstraints(
-		constraints.WithSSMPlugin(),
 		constraints.WithAWSProfile(),
 		constraints.WithAWSRegion(),
 		constraints.WithENV(),
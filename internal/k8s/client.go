@@ -0,0 +1,382 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	KindService = "svc"
+	KindPod     = "pod"
+)
+
+// Target is the Service or Pod a k8s endpoint forwards to. In the config it's written like a kubectl resource,
+// optionally with a namespace: `svc/postgres`, `pod/worker-0` or `db/svc/postgres`. A bare name is a Service.
+type Target struct {
+	Namespace string
+	Kind      string
+	Name      string
+}
+
+// ParseTarget parses the name of a k8s endpoint. Without a namespace the one of the kubeconfig context is used.
+func ParseTarget(name string) (Target, error) {
+	parts := strings.Split(name, "/")
+
+	var t Target
+	switch len(parts) {
+	case 1:
+		t = Target{Kind: KindService, Name: parts[0]}
+	case 2:
+		t = Target{Kind: parts[0], Name: parts[1]}
+	case 3:
+		t = Target{Namespace: parts[0], Kind: parts[1], Name: parts[2]}
+	default:
+		return Target{}, fmt.Errorf("bad k8s target %q, expected [namespace/]svc/name or [namespace/]pod/name", name)
+	}
+
+	switch t.Kind {
+	case "svc", "service", "services":
+		t.Kind = KindService
+	case "pod", "po", "pods":
+		t.Kind = KindPod
+	default:
+		return Target{}, fmt.Errorf("bad k8s target %q: kind %q isn't svc or pod", name, t.Kind)
+	}
+
+	if t.Name == "" || (len(parts) == 3 && t.Namespace == "") {
+		return Target{}, fmt.Errorf("bad k8s target %q, expected [namespace/]svc/name or [namespace/]pod/name", name)
+	}
+
+	return t, nil
+}
+
+// Client talks to the API server of a kubeconfig context
+type Client struct {
+	config *restConfig
+	http   *http.Client
+}
+
+// NewClient creates a client for the kubeconfig context (the current context if empty).
+// kubeconfigPath may be empty or a list of files like $KUBECONFIG (see GetKubeconfigPaths).
+func NewClient(kubeconfigPath, contextName string) (*Client, error) {
+	c, err := loadKubeconfig(GetKubeconfigPaths(kubeconfigPath))
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := newRestConfig(c, contextName)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.tls
+
+	return &Client{
+		config: config,
+		http:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Namespace returns the default namespace of the context
+func (c *Client) Namespace() string {
+	return c.config.namespace
+}
+
+// get decodes the JSON resource at the API path into v
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	u := c.config.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.authorize(req.Header); err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) authorize(header http.Header) error {
+	authorization, err := c.config.authorization()
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	return nil
+}
+
+// apiError returns the message of a Status returned by the API server
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var status struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &status) == nil && status.Message != "" {
+		return fmt.Errorf("kubernetes API: %s (%s)", status.Message, resp.Status)
+	}
+	return fmt.Errorf("kubernetes API: %s", resp.Status)
+}
+
+// servicePort is the targetPort of a Service: a number or the name of a container port
+type servicePort string
+
+// UnmarshalJSON accepts the targetPort of a Service, which is either a number or a name
+func (p *servicePort) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*p = servicePort(s)
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*p = servicePort(strconv.Itoa(n))
+	return nil
+}
+
+// pod is the part of a Pod atun uses to pick the pod of a Service
+type pod struct {
+	Metadata struct {
+		Name              string     `json:"name"`
+		DeletionTimestamp *time.Time `json:"deletionTimestamp"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// ready reports whether the pod runs and passes its readiness checks
+func (p pod) ready() bool {
+	if p.Status.Phase != "Running" || p.Metadata.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// containerPort returns the number of the named port of the pod
+func (p pod) containerPort(name string) (int, bool) {
+	for _, c := range p.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.Name == name {
+				return port.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Resolve returns the pod and its port that serve port of the target. Like `kubectl port-forward svc/...`,
+// a Service is resolved to one of its ready pods and the service port to the target port.
+func (c *Client) Resolve(ctx context.Context, t Target, port int) (string, string, int, error) {
+	namespace := t.Namespace
+	if namespace == "" {
+		namespace = c.config.namespace
+	}
+
+	if t.Kind == KindPod {
+		return namespace, t.Name, port, nil
+	}
+
+	var svc struct {
+		Spec struct {
+			Selector map[string]string `json:"selector"`
+			Ports    []struct {
+				Port       int         `json:"port"`
+				TargetPort servicePort `json:"targetPort"`
+			} `json:"ports"`
+		} `json:"spec"`
+	}
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(namespace), url.PathEscape(t.Name)), nil, &svc); err != nil {
+		return "", "", 0, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return "", "", 0, fmt.Errorf("service %s/%s has no selector, its pods can't be found", namespace, t.Name)
+	}
+
+	targetPort := servicePort("")
+	var portFound bool
+	for _, p := range svc.Spec.Ports {
+		if p.Port == port {
+			targetPort, portFound = p.TargetPort, true
+			break
+		}
+	}
+	if !portFound {
+		return "", "", 0, fmt.Errorf("service %s/%s has no port %d", namespace, t.Name, port)
+	}
+
+	var selector []string
+	for k, v := range svc.Spec.Selector {
+		selector = append(selector, k+"="+v)
+	}
+	sort.Strings(selector)
+
+	var pods struct {
+		Items []pod `json:"items"`
+	}
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(namespace)), url.Values{"labelSelector": {strings.Join(selector, ",")}}, &pods); err != nil {
+		return "", "", 0, err
+	}
+
+	for _, p := range pods.Items {
+		if !p.ready() {
+			continue
+		}
+
+		// The target port defaults to the service port
+		if targetPort == "" {
+			return namespace, p.Metadata.Name, port, nil
+		}
+		if n, err := strconv.Atoi(string(targetPort)); err == nil {
+			return namespace, p.Metadata.Name, n, nil
+		}
+		if n, ok := p.containerPort(string(targetPort)); ok {
+			return namespace, p.Metadata.Name, n, nil
+		}
+	}
+
+	return "", "", 0, fmt.Errorf("service %s/%s has no ready pods serving port %d", namespace, t.Name, port)
+}
+
+// Dial opens a connection to port of the target (see ParseTarget) through the API server
+func (c *Client) Dial(ctx context.Context, target string, port int) (net.Conn, error) {
+	t, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, podName, podPort, err := c.Resolve(ctx, t, port)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(c.config.server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path += fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", url.PathEscape(namespace), url.PathEscape(podName))
+	u.RawQuery = url.Values{"ports": {strconv.Itoa(podPort)}}.Encode()
+
+	header := http.Header{}
+	if err := c.authorize(header); err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  c.config.tls,
+		HandshakeTimeout: 30 * time.Second,
+		Subprotocols:     []string{portForwardProtocol},
+	}
+
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return nil, fmt.Errorf("can't forward to pod %s/%s: %w", namespace, podName, apiError(resp))
+			}
+		}
+		return nil, fmt.Errorf("can't forward to pod %s/%s: %w", namespace, podName, err)
+	}
+	if ws.Subprotocol() != portForwardProtocol {
+		_ = ws.Close()
+		return nil, errors.New("kubernetes API server doesn't support websocket port forwarding")
+	}
+
+	logger.Debug("Forwarding to pod", "target", target, "namespace", namespace, "pod", podName, "port", podPort)
+
+	return newPortForwardConn(ws), nil
+}
+
+// ConnectToShell opens an interactive shell in the pod of the target with kubectl (bash if the pod has it)
+func ConnectToShell(kubeconfigPath, contextName string, t Target) error {
+	if t.Kind != KindPod {
+		return fmt.Errorf("a shell needs a pod, %s/%s is a service", t.Kind, t.Name)
+	}
+
+	var args []string
+	if kubeconfigPath != "" {
+		args = append(args, "--kubeconfig", kubeconfigPath)
+	}
+	if contextName != "" {
+		args = append(args, "--context", contextName)
+	}
+	if t.Namespace != "" {
+		args = append(args, "--namespace", t.Namespace)
+	}
+	args = append(args, "exec", "-it", t.Name, "--", "sh", "-c", "command -v bash >/dev/null && exec bash || exec sh")
+
+	shellCommand := exec.Command("kubectl", args...)
+	shellCommand.Stdout = os.Stdout
+	shellCommand.Stderr = os.Stderr
+	shellCommand.Stdin = os.Stdin
+
+	if err := shellCommand.Run(); err != nil {
+		return fmt.Errorf("failed to start shell in pod %s: %w", t.Name, err)
+	}
+
+	return nil
+}
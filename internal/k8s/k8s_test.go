@@ -0,0 +1,244 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newFakeAPIServer serves a postgres Service in the db namespace backed by two pods, one of them not ready,
+// and echoes the data forwarded to the ready one
+func newFakeAPIServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{portForwardProtocol}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/db/services/postgres", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"spec": {"selector": {"app": "postgres"}, "ports": [{"port": 5432, "targetPort": "pg"}]}}`)
+	})
+	mux.HandleFunc("/api/v1/namespaces/db/pods", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "app=postgres" {
+			http.Error(w, `{"message": "bad selector"}`, http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"items": [
+			{"metadata": {"name": "postgres-0"}, "status": {"phase": "Pending"}},
+			{"metadata": {"name": "postgres-1"}, "spec": {"containers": [{"ports": [{"name": "pg", "containerPort": 15432}]}]},
+			 "status": {"phase": "Running", "conditions": [{"type": "Ready", "status": "True"}]}}
+		]}`)
+	})
+	mux.HandleFunc("/api/v1/namespaces/db/pods/postgres-1/portforward", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		port, err := strconv.Atoi(r.URL.Query().Get("ports"))
+		if err != nil || port != 15432 {
+			http.Error(w, `{"message": "bad port"}`, http.StatusBadRequest)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		// Every channel starts with the port
+		for _, channel := range []byte{dataChannel, errorChannel} {
+			header := []byte{channel, 0, 0}
+			binary.LittleEndian.PutUint16(header[1:], uint16(port))
+			if err := ws.WriteMessage(websocket.BinaryMessage, header); err != nil {
+				return
+			}
+		}
+
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if len(message) > 0 && message[0] == dataChannel {
+				if err := ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeKubeconfig writes a kubeconfig with a kind-test context for the server (authenticated with a credential
+// plugin printing token) and a broken current context
+func writeKubeconfig(t *testing.T, srv *httptest.Server, token string) string {
+	t.Helper()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	credential, err := json.Marshal(map[string]interface{}{"status": map[string]string{"token": token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: broken
+clusters:
+- name: kind-test
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+contexts:
+- name: kind-test
+  context:
+    cluster: kind-test
+    user: kind-test
+    namespace: db
+- name: broken
+  context:
+    cluster: missing
+users:
+- name: kind-test
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: sh
+      args:
+      - -c
+      - %q
+`, srv.URL, base64.StdEncoding.EncodeToString(ca), "echo '"+string(credential)+"'")
+
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDial(t *testing.T) {
+	srv := newFakeAPIServer(t, "exec-token")
+	path := writeKubeconfig(t, srv, "exec-token")
+
+	if _, err := NewClient(path, ""); err == nil {
+		t.Error("NewClient() with the broken current context didn't fail")
+	}
+
+	client, err := NewClient(path, "kind-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The service port is mapped to the named container port of the ready pod
+	conn, err := client.Dial(ctx, "svc/postgres", 5432)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	if _, err := client.Dial(ctx, "db/svc/postgres", 6379); err == nil {
+		t.Error("Dial() to a port the service doesn't have didn't fail")
+	}
+}
+
+func TestDialUnauthorized(t *testing.T) {
+	srv := newFakeAPIServer(t, "exec-token")
+
+	client, err := NewClient(writeKubeconfig(t, srv, "stale-token"), "kind-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Dial(context.Background(), "pod/postgres-1", 15432); err == nil {
+		t.Fatal("Dial() with a bad token didn't fail")
+	}
+}
+
+func TestNewClientAuthProvider(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: oidc
+clusters:
+- name: oidc
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: oidc
+  context:
+    cluster: oidc
+    user: oidc
+users:
+- name: oidc
+  user:
+    auth-provider:
+      name: oidc
+      config:
+        idp-issuer-url: https://issuer.example.com
+`
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests would go out unauthenticated and fail with a bare 401
+	_, err := NewClient(path, "")
+	if err == nil || !strings.Contains(err.Error(), "auth-provider is not supported, use an exec plugin") {
+		t.Fatalf("NewClient() = %v, want an auth-provider error", err)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		want Target
+		err  bool
+	}{
+		{name: "postgres", want: Target{Kind: KindService, Name: "postgres"}},
+		{name: "svc/postgres", want: Target{Kind: KindService, Name: "postgres"}},
+		{name: "db/service/postgres", want: Target{Namespace: "db", Kind: KindService, Name: "postgres"}},
+		{name: "db/po/postgres-0", want: Target{Namespace: "db", Kind: KindPod, Name: "postgres-0"}},
+		{name: "deploy/postgres", err: true},
+		{name: "/svc/postgres", err: true},
+		{name: "a/b/c/d", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.name)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseTarget(%q) = %+v, %v", tt.name, got, err)
+		}
+	}
+}
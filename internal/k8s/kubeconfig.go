@@ -0,0 +1,379 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package k8s forwards endpoints to Services and Pods of a Kubernetes cluster (the k8s endpoint protocol).
+// It talks to the API server directly: clusters, users and contexts are read from the kubeconfig,
+// and connections are forwarded with the port-forward subresource of the pod over a websocket.
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is the part of a kubeconfig file atun uses
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string  `yaml:"name"`
+		Cluster cluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User authInfo `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+type cluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	TLSServerName            string `yaml:"tls-server-name"`
+}
+
+type authInfo struct {
+	Token                 string      `yaml:"token"`
+	TokenFile             string      `yaml:"tokenFile"`
+	ClientCertificate     string      `yaml:"client-certificate"`
+	ClientCertificateData string      `yaml:"client-certificate-data"`
+	ClientKey             string      `yaml:"client-key"`
+	ClientKeyData         string      `yaml:"client-key-data"`
+	Username              string      `yaml:"username"`
+	Password              string      `yaml:"password"`
+	Exec                  *execConfig `yaml:"exec"`
+	// AuthProvider (oidc, gcp, azure) isn't supported. It's only read to refuse such users with a clear error.
+	AuthProvider *struct {
+		Name string `yaml:"name"`
+	} `yaml:"auth-provider"`
+}
+
+// execConfig runs a credential plugin (e.g. `aws eks get-token`)
+type execConfig struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+// GetKubeconfigPaths returns the kubeconfig files to read: path if set (a list like $KUBECONFIG), else $KUBECONFIG,
+// else ~/.kube/config
+func GetKubeconfigPaths(path string) []string {
+	if path == "" {
+		path = os.Getenv("KUBECONFIG")
+	}
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		return []string{filepath.Join(homeDir, ".kube", "config")}
+	}
+
+	var paths []string
+	for _, p := range filepath.SplitList(path) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// loadKubeconfig reads and merges the kubeconfig files. Like kubectl, the first file to set a value wins.
+func loadKubeconfig(paths []string) (kubeconfig, error) {
+	var merged kubeconfig
+	var found bool
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return kubeconfig{}, err
+		}
+		found = true
+
+		var c kubeconfig
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return kubeconfig{}, fmt.Errorf("can't parse kubeconfig %s: %w", path, err)
+		}
+
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = c.CurrentContext
+		}
+		// Relative file references are relative to the kubeconfig
+		for i := range c.Clusters {
+			c.Clusters[i].Cluster.CertificateAuthority = resolvePath(path, c.Clusters[i].Cluster.CertificateAuthority)
+		}
+		for i := range c.Users {
+			c.Users[i].User.TokenFile = resolvePath(path, c.Users[i].User.TokenFile)
+			c.Users[i].User.ClientCertificate = resolvePath(path, c.Users[i].User.ClientCertificate)
+			c.Users[i].User.ClientKey = resolvePath(path, c.Users[i].User.ClientKey)
+		}
+
+		merged.Clusters = append(merged.Clusters, c.Clusters...)
+		merged.Users = append(merged.Users, c.Users...)
+		merged.Contexts = append(merged.Contexts, c.Contexts...)
+	}
+
+	if !found {
+		return kubeconfig{}, fmt.Errorf("no kubeconfig found in %s", strings.Join(paths, ", "))
+	}
+
+	return merged, nil
+}
+
+func resolvePath(kubeconfigPath, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(kubeconfigPath), path)
+}
+
+// restConfig is how to reach and authenticate with the API server of a context
+type restConfig struct {
+	server    string
+	namespace string
+	tls       *tls.Config
+	auth      *authInfo
+
+	mu         sync.Mutex
+	execCred   execCredential
+	execExpiry time.Time
+}
+
+// newRestConfig picks the context (the current one if empty) from the kubeconfig
+func newRestConfig(c kubeconfig, contextName string) (*restConfig, error) {
+	if contextName == "" {
+		contextName = c.CurrentContext
+	}
+	if contextName == "" {
+		return nil, errors.New("no kubeconfig context set and no current-context in the kubeconfig")
+	}
+
+	var clusterName, userName, namespace string
+	var contextFound bool
+	for _, ctx := range c.Contexts {
+		if ctx.Name == contextName {
+			clusterName, userName, namespace = ctx.Context.Cluster, ctx.Context.User, ctx.Context.Namespace
+			contextFound = true
+			break
+		}
+	}
+	if !contextFound {
+		return nil, fmt.Errorf("kubeconfig context %q not found", contextName)
+	}
+
+	var cl *cluster
+	for i := range c.Clusters {
+		if c.Clusters[i].Name == clusterName {
+			cl = &c.Clusters[i].Cluster
+			break
+		}
+	}
+	if cl == nil || cl.Server == "" {
+		return nil, fmt.Errorf("cluster %q of kubeconfig context %q not found", clusterName, contextName)
+	}
+
+	auth := &authInfo{}
+	for i := range c.Users {
+		if c.Users[i].Name == userName {
+			auth = &c.Users[i].User
+			break
+		}
+	}
+
+	if auth.AuthProvider != nil && auth.Exec == nil {
+		return nil, fmt.Errorf("user %q of kubeconfig context %q authenticates with the %s auth-provider, auth-provider is not supported, use an exec plugin (e.g. kubelogin or gke-gcloud-auth-plugin)", userName, contextName, auth.AuthProvider.Name)
+	}
+
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	r := &restConfig{
+		server:    strings.TrimSuffix(cl.Server, "/"),
+		namespace: namespace,
+		auth:      auth,
+		tls: &tls.Config{
+			ServerName:         cl.TLSServerName,
+			InsecureSkipVerify: cl.InsecureSkipTLSVerify,
+		},
+	}
+
+	ca, err := dataOrFile(cl.CertificateAuthorityData, cl.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("can't read certificate authority of cluster %q: %w", clusterName, err)
+	}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in the certificate authority of cluster %q", clusterName)
+		}
+		r.tls.RootCAs = pool
+	}
+
+	cert, err := dataOrFile(auth.ClientCertificateData, auth.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("can't read client certificate of user %q: %w", userName, err)
+	}
+	key, err := dataOrFile(auth.ClientKeyData, auth.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't read client key of user %q: %w", userName, err)
+	}
+	if len(cert) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("bad client certificate of user %q: %w", userName, err)
+		}
+		r.tls.Certificates = []tls.Certificate{pair}
+	}
+
+	// Credential plugins may also hand out client certificates
+	if auth.Exec != nil {
+		r.tls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cred, err := r.execCredential()
+			if err != nil {
+				return nil, err
+			}
+			if cred.Status.ClientCertificateData == "" {
+				return &tls.Certificate{}, nil
+			}
+			pair, err := tls.X509KeyPair([]byte(cred.Status.ClientCertificateData), []byte(cred.Status.ClientKeyData))
+			if err != nil {
+				return nil, err
+			}
+			return &pair, nil
+		}
+	}
+
+	return r, nil
+}
+
+// dataOrFile returns the base64 encoded inline data, or the content of the file
+func dataOrFile(data, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+// authorization returns the Authorization header of the user, if any
+func (r *restConfig) authorization() (string, error) {
+	switch {
+	case r.auth.Token != "":
+		return "Bearer " + r.auth.Token, nil
+	case r.auth.TokenFile != "":
+		// Token files are rotated (e.g. projected service account tokens), they're read for every request
+		token, err := os.ReadFile(r.auth.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + strings.TrimSpace(string(token)), nil
+	case r.auth.Exec != nil:
+		cred, err := r.execCredential()
+		if err != nil {
+			return "", err
+		}
+		if cred.Status.Token == "" {
+			return "", nil
+		}
+		return "Bearer " + cred.Status.Token, nil
+	case r.auth.Username != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(r.auth.Username+":"+r.auth.Password)), nil
+	}
+	return "", nil
+}
+
+// execCredential is the output of a credential plugin
+type execCredential struct {
+	Status struct {
+		Token                 string    `json:"token"`
+		ClientCertificateData string    `json:"clientCertificateData"`
+		ClientKeyData         string    `json:"clientKeyData"`
+		ExpirationTimestamp   time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// execCredential runs the credential plugin of the user. Credentials are reused until shortly before they expire.
+func (r *restConfig) execCredential() (execCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.execExpiry.IsZero() && time.Now().Before(r.execExpiry) {
+		return r.execCred, nil
+	}
+
+	e := r.auth.Exec
+	apiVersion := e.APIVersion
+	if apiVersion == "" {
+		apiVersion = "client.authentication.k8s.io/v1"
+	}
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return execCredential{}, err
+	}
+
+	c := exec.Command(e.Command, e.Args...)
+	c.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, env := range e.Env {
+		c.Env = append(c.Env, env.Name+"="+env.Value)
+	}
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+
+	out, err := c.Output()
+	if err != nil {
+		return execCredential{}, fmt.Errorf("kubeconfig credential plugin %s failed: %w: %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var cred execCredential
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return execCredential{}, fmt.Errorf("can't parse the output of kubeconfig credential plugin %s: %w", e.Command, err)
+	}
+
+	r.execCred = cred
+	r.execExpiry = time.Time{}
+	if !cred.Status.ExpirationTimestamp.IsZero() {
+		r.execExpiry = cred.Status.ExpirationTimestamp.Add(-time.Minute)
+	} else {
+		// Credentials without an expiry are kept for the life of the tunnel
+		r.execExpiry = time.Now().Add(100 * 365 * 24 * time.Hour)
+	}
+
+	return cred, nil
+}
@@ -0,0 +1,129 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package k8s
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// portForwardProtocol is the websocket subprotocol of the port-forward subresource. Every message starts with
+// the channel: 0 carries the data of the (single) forwarded port, 1 its errors. The first message of each channel
+// from the server is the port number (2 bytes, little endian).
+const portForwardProtocol = "v4.channel.k8s.io"
+
+const (
+	dataChannel  = 0
+	errorChannel = 1
+)
+
+// portForwardConn is a connection to a pod port over a port-forward websocket
+type portForwardConn struct {
+	ws *websocket.Conn
+
+	writeMu sync.Mutex
+
+	// Only accessed by Read, which isn't called concurrently
+	buf      []byte
+	portRead [2]bool
+}
+
+func newPortForwardConn(ws *websocket.Conn) *portForwardConn {
+	return &portForwardConn{ws: ws}
+}
+
+func (c *portForwardConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if len(message) == 0 {
+			continue
+		}
+
+		channel, data := message[0], message[1:]
+		if channel > errorChannel {
+			continue
+		}
+
+		if !c.portRead[channel] {
+			if len(data) < 2 {
+				return 0, errors.New("kubernetes port forward: bad port header")
+			}
+			c.portRead[channel] = true
+			data = data[2:]
+		}
+
+		if channel == errorChannel {
+			if len(data) > 0 {
+				return 0, fmt.Errorf("kubernetes port forward: %s", data)
+			}
+			continue
+		}
+
+		c.buf = data
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *portForwardConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	message := make([]byte, len(b)+1)
+	message[0] = dataChannel
+	copy(message[1:], b)
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *portForwardConn) Close() error {
+	c.writeMu.Lock()
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+
+	return c.ws.Close()
+}
+
+func (c *portForwardConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *portForwardConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *portForwardConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *portForwardConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *portForwardConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,119 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package netstat finds the process that owns a local port or Unix socket without external tools like lsof.
+// On Linux it reads procfs, elsewhere (or when procfs isn't readable) it falls back to gopsutil.
+package netstat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/automationd/atun/internal/logger"
+	gopsnet "github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// ErrNotFound is returned when no process owns the port (or it belongs to a process of another user)
+var ErrNotFound = errors.New("no process found")
+
+// PortOwner is the process holding a local port or Unix socket
+type PortOwner struct {
+	PID     int
+	Name    string
+	Cmdline string
+	// Atun is set for atun processes (the daemon or a foreground tunnel) and for ssh started with an atun-generated config
+	Atun bool
+}
+
+func (o PortOwner) String() string {
+	return fmt.Sprintf("'%s' (pid %d)", o.Name, o.PID)
+}
+
+// FindOwner returns the process that listens on the address. network is tcp, udp or unix;
+// address is host:port, or a socket path for unix.
+func FindOwner(network, address string) (*PortOwner, error) {
+	var port int
+	if network != "unix" {
+		_, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return nil, fmt.Errorf("invalid port in %s", address)
+		}
+	}
+
+	pid, err := findPIDProc(network, port, address)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		logger.Debug("Can't find port owner in procfs, falling back to gopsutil", "address", address, "error", err)
+		pid, err = findPIDGopsutil(network, port, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newPortOwner(pid), nil
+}
+
+// findPIDGopsutil looks the address up in the connections reported by gopsutil (works on macOS and Windows)
+func findPIDGopsutil(network string, port int, address string) (int, error) {
+	connections, err := gopsnet.Connections(network)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range connections {
+		if c.Pid == 0 {
+			continue
+		}
+
+		switch network {
+		case "unix":
+			if c.Laddr.IP == address {
+				return int(c.Pid), nil
+			}
+		case "tcp":
+			if c.Status == "LISTEN" && int(c.Laddr.Port) == port {
+				return int(c.Pid), nil
+			}
+		default:
+			if int(c.Laddr.Port) == port {
+				return int(c.Pid), nil
+			}
+		}
+	}
+
+	return 0, ErrNotFound
+}
+
+// newPortOwner describes the process. Details that can't be read are left empty.
+func newPortOwner(pid int) *PortOwner {
+	owner := &PortOwner{PID: pid}
+
+	proc, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return owner
+	}
+
+	owner.Name, _ = proc.Name()
+	owner.Cmdline, _ = proc.Cmdline()
+	owner.Atun = isAtun(owner.Name, owner.Cmdline)
+
+	return owner
+}
+
+func isAtun(name, cmdline string) bool {
+	name = strings.TrimSuffix(filepath.Base(name), ".exe")
+	if name == "atun" {
+		return true
+	}
+	// Tunnels of older versions ran OpenSSH with the config written to ~/.atun
+	return name == "ssh" && strings.Contains(cmdline, "-ssh.config") && strings.Contains(cmdline, ".atun")
+}
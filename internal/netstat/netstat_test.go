@@ -0,0 +1,65 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package netstat
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNet(t *testing.T) {
+	content := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:3C28 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 123456 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:3C28 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 123457 1 0000000000000000 20 4 30 10 -1
+   2: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 22222 1 0000000000000000 100 0 0 10 0
+`
+	// 0x3C28 is 15400. The established connection on the same port isn't the listener.
+	if got := parseProcNet(strings.NewReader(content), 15400, true); !reflect.DeepEqual(got, []uint64{123456}) {
+		t.Errorf("parseProcNet(listen) = %v", got)
+	}
+	if got := parseProcNet(strings.NewReader(content), 15400, false); !reflect.DeepEqual(got, []uint64{123456, 123457}) {
+		t.Errorf("parseProcNet(any) = %v", got)
+	}
+
+	unix := `Num       RefCount Protocol Flags    Type St Inode Path
+0000000000000000: 00000002 00000000 00010000 0001 01 33333 /tmp/atun/db.sock
+0000000000000000: 00000002 00000000 00000000 0002 01 44444
+`
+	if got := parseProcNetUnix(strings.NewReader(unix), "/tmp/atun/db.sock"); !reflect.DeepEqual(got, []uint64{33333}) {
+		t.Errorf("parseProcNetUnix() = %v", got)
+	}
+}
+
+func TestFindOwner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	owner, err := FindOwner("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("FindOwner: %v", err)
+	}
+	if owner.PID != os.Getpid() || owner.Atun {
+		t.Errorf("FindOwner() = %+v, want this (non-atun) test process", owner)
+	}
+}
+
+func TestIsAtun(t *testing.T) {
+	if !isAtun("atun", "/usr/local/bin/atun daemon") || !isAtun("atun.exe", "") {
+		t.Error("atun processes aren't recognized")
+	}
+	if !isAtun("ssh", "ssh -F /home/me/.atun/dev/i-0123-ssh.config i-0123") {
+		t.Error("ssh started with an atun config isn't recognized")
+	}
+	if isAtun("postgres", "postgres -D /var/lib/postgres") || isAtun("ssh", "ssh bastion") {
+		t.Error("unrelated processes are recognized as atun")
+	}
+}
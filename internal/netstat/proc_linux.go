@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package netstat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findPIDProc finds the socket inodes of the address in /proc/net and the process that has one of them open
+func findPIDProc(network string, port int, address string) (int, error) {
+	var inodes []uint64
+
+	switch network {
+	case "unix":
+		f, err := os.Open("/proc/net/unix")
+		if err != nil {
+			return 0, err
+		}
+		inodes = parseProcNetUnix(f, address)
+		_ = f.Close()
+	default:
+		for _, suffix := range []string{"", "6"} {
+			f, err := os.Open("/proc/net/" + network + suffix)
+			if err != nil {
+				// IPv6 may be disabled
+				continue
+			}
+			inodes = append(inodes, parseProcNet(f, port, network == "tcp")...)
+			_ = f.Close()
+		}
+	}
+
+	if len(inodes) == 0 {
+		return 0, ErrNotFound
+	}
+
+	return findPIDByInodes(inodes)
+}
+
+// findPIDByInodes scans the open file descriptors of all processes for one of the socket inodes.
+// Processes of other users can't be inspected and are skipped.
+func findPIDByInodes(inodes []uint64) (int, error) {
+	targets := make(map[string]bool, len(inodes))
+	for _, inode := range inodes {
+		targets[fmt.Sprintf("socket:[%d]", inode)] = true
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if targets[link] {
+				return pid, nil
+			}
+		}
+	}
+
+	return 0, ErrNotFound
+}
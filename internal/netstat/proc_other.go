@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package netstat
+
+import "errors"
+
+// findPIDProc is only implemented on Linux, other platforms use gopsutil
+func findPIDProc(network string, port int, address string) (int, error) {
+	return 0, errors.New("procfs is not available")
+}
@@ -0,0 +1,82 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package netstat
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tcpListen is the st column of listening sockets in /proc/net/tcp
+	tcpListen = "0A"
+)
+
+// parseProcNet returns the inodes of sockets bound to the port in /proc/net/{tcp,tcp6,udp,udp6} content.
+// For TCP only listening sockets count.
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 0100007F:3C28 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 123456 ...
+func parseProcNet(r io.Reader, port int, listenOnly bool) []uint64 {
+	var inodes []uint64
+
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		p, err := strconv.ParseUint(hexPort, 16, 16)
+		if err != nil || int(p) != port {
+			continue
+		}
+
+		if listenOnly && fields[3] != tcpListen {
+			continue
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		inodes = append(inodes, inode)
+	}
+
+	return inodes
+}
+
+// parseProcNetUnix returns the inodes of Unix sockets bound to the path in /proc/net/unix content
+//
+//	Num       RefCount Protocol Flags    Type St Inode Path
+//	0000000000000000: 00000002 00000000 00010000 0001 01 123456 /tmp/atun/db.sock
+func parseProcNetUnix(r io.Reader, path string) []uint64 {
+	var inodes []uint64
+
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[7] != path {
+			continue
+		}
+
+		inode, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			continue
+		}
+		inodes = append(inodes, inode)
+	}
+
+	return inodes
+}
@@ -0,0 +1,257 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+// Package ports keeps the local ports of endpoints stable across `atun up` runs.
+// The registry in the app directory remembers the port of every (profile, env, host, remote port),
+// so saved DB client connections keep working, and two endpoints are never given the same port.
+package ports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// minPort and maxPort bound automatically assigned ports. Ports below are often used by local services.
+	minPort = 10000
+	maxPort = 65535
+)
+
+// Key identifies an endpoint across profiles and environments
+type Key struct {
+	Profile string `json:"profile"`
+	Env     string `json:"env"`
+	Host    string `json:"host"`
+	Remote  int    `json:"remote"`
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%s %s:%d", k.Profile, k.Env, k.Host, k.Remote)
+}
+
+// Assignment is the local port of an endpoint. Pinned assignments win over the local port in the endpoint config.
+type Assignment struct {
+	Key
+	Local     int       `json:"local"`
+	Pinned    bool      `json:"pinned,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registry is the set of assignments stored in a JSON file
+type Registry struct {
+	path        string
+	Assignments []Assignment `json:"assignments"`
+}
+
+// GetRegistryPath returns the path of the port registry in the app directory
+func GetRegistryPath(appDir string) string {
+	return filepath.Join(appDir, "ports.json")
+}
+
+// Load reads the registry. A missing file is an empty registry.
+func Load(path string) (*Registry, error) {
+	r := &Registry{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("can't parse port registry %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+// Update loads the registry, runs fn on it and saves it. The registry stays locked meanwhile, so concurrent
+// `atun up` runs don't lose each other's assignments. Nothing is saved if fn fails.
+func Update(path string, fn func(r *Registry) error) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("can't lock port registry %s: %w", path, err)
+	}
+	defer unlock()
+
+	r, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(r); err != nil {
+		return err
+	}
+
+	return r.Save()
+}
+
+// Save writes the registry. The file is replaced atomically, so concurrent readers never see a partial write.
+func (r *Registry) Save() error {
+	sort.Slice(r.Assignments, func(i, j int) bool {
+		a, b := r.Assignments[i], r.Assignments[j]
+		if a.Profile != b.Profile {
+			return a.Profile < b.Profile
+		}
+		if a.Env != b.Env {
+			return a.Env < b.Env
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Remote < b.Remote
+	})
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".ports-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// Get returns the assignment of the endpoint
+func (r *Registry) Get(key Key) (Assignment, bool) {
+	for _, a := range r.Assignments {
+		if a.Key == key {
+			return a, true
+		}
+	}
+	return Assignment{}, false
+}
+
+// Owner returns the assignment other than key holding the port
+func (r *Registry) Owner(port int, key Key) (Assignment, bool) {
+	for _, a := range r.Assignments {
+		if a.Local == port && a.Key != key {
+			return a, true
+		}
+	}
+	return Assignment{}, false
+}
+
+// Resolve returns the local port of the endpoint and records it:
+// the pinned port if there is one, else the configured port, else the port assigned before.
+// A new port is assigned starting from preferred, skipping ports of other endpoints and ports isFree rejects.
+// Fails if the configured port is assigned to another endpoint.
+func (r *Registry) Resolve(key Key, configured, preferred int, isFree func(port int) bool) (int, error) {
+	existing, ok := r.Get(key)
+	if ok && existing.Pinned {
+		return existing.Local, nil
+	}
+
+	if configured > 0 {
+		if owner, taken := r.Owner(configured, key); taken {
+			return 0, fmt.Errorf("local port %d is assigned to %s, pin another port with atun ports pin %s %d <port>", configured, owner.Key, key.Host, key.Remote)
+		}
+		r.set(key, configured, false)
+		return configured, nil
+	}
+
+	if ok {
+		return existing.Local, nil
+	}
+
+	port, err := r.next(key, preferred, isFree)
+	if err != nil {
+		return 0, err
+	}
+
+	r.set(key, port, false)
+	return port, nil
+}
+
+// Lookup returns the local port of the endpoint the same way as Resolve, without assigning or recording anything.
+// Endpoints without an assignment keep the configured port.
+func (r *Registry) Lookup(key Key, configured int) int {
+	existing, ok := r.Get(key)
+	if ok && (existing.Pinned || configured <= 0) {
+		return existing.Local
+	}
+	return configured
+}
+
+// Pin assigns the port to the endpoint for good. Fails if another endpoint holds the port.
+func (r *Registry) Pin(key Key, port int) error {
+	if port <= 0 || port > maxPort {
+		return fmt.Errorf("invalid port number: %d", port)
+	}
+
+	if owner, ok := r.Owner(port, key); ok {
+		return fmt.Errorf("port %d is assigned to %s, release it first", port, owner.Key)
+	}
+
+	r.set(key, port, true)
+	return nil
+}
+
+// Release forgets the assignment of the endpoint. Returns false if there was none.
+func (r *Registry) Release(key Key) bool {
+	for i, a := range r.Assignments {
+		if a.Key == key {
+			r.Assignments = append(r.Assignments[:i], r.Assignments[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) set(key Key, port int, pinned bool) {
+	for i, a := range r.Assignments {
+		if a.Key == key {
+			if a.Local != port || a.Pinned != pinned {
+				r.Assignments[i].Local = port
+				r.Assignments[i].Pinned = pinned
+				r.Assignments[i].UpdatedAt = time.Now().UTC()
+			}
+			return
+		}
+	}
+
+	r.Assignments = append(r.Assignments, Assignment{Key: key, Local: port, Pinned: pinned, UpdatedAt: time.Now().UTC()})
+}
+
+// next finds a port for a new assignment, starting from preferred and wrapping around the range once
+func (r *Registry) next(key Key, preferred int, isFree func(port int) bool) (int, error) {
+	if preferred < minPort || preferred > maxPort {
+		preferred = minPort
+	}
+
+	for i := 0; i <= maxPort-minPort; i++ {
+		port := minPort + (preferred-minPort+i)%(maxPort-minPort+1)
+
+		if _, taken := r.Owner(port, key); taken {
+			continue
+		}
+		if isFree != nil && !isFree(port) {
+			continue
+		}
+
+		return port, nil
+	}
+
+	return 0, errors.New("no free local ports left")
+}
@@ -0,0 +1,156 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+	free := func(int) bool { return true }
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := Key{Profile: "default", Env: "dev", Host: "db.internal", Remote: 5432}
+	prod := Key{Profile: "default", Env: "prod", Host: "db.internal", Remote: 5432}
+
+	port, err := r.Resolve(dev, 0, 15432, free)
+	if err != nil || port != 15432 {
+		t.Fatalf("Resolve(dev) = %d, %v", port, err)
+	}
+
+	// The same endpoint of another env doesn't get the port of dev
+	port, err = r.Resolve(prod, 0, 15432, free)
+	if err != nil || port != 15433 {
+		t.Fatalf("Resolve(prod) = %d, %v", port, err)
+	}
+
+	// Ports taken by other processes are skipped
+	other := Key{Profile: "default", Env: "stage", Host: "db.internal", Remote: 5432}
+	port, err = r.Resolve(other, 0, 15432, func(p int) bool { return p != 15434 })
+	if err != nil || port != 15435 {
+		t.Fatalf("Resolve(stage) = %d, %v", port, err)
+	}
+
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The assignments survive a restart
+	r, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := r.Resolve(prod, 0, 15432, free); port != 15433 {
+		t.Fatalf("Resolve(prod) after Load = %d", port)
+	}
+
+	// A configured port wins over the assignment, a pinned one wins over both
+	if port, _ := r.Resolve(dev, 25432, 15432, free); port != 25432 {
+		t.Fatalf("Resolve(dev, configured) = %d", port)
+	}
+	if err := r.Pin(dev, 35432); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := r.Resolve(dev, 25432, 15432, free); port != 35432 {
+		t.Fatalf("Resolve(dev, pinned) = %d", port)
+	}
+
+	if err := r.Pin(prod, 35432); err == nil {
+		t.Fatal("Pin() of a port assigned to another endpoint succeeded")
+	}
+
+	if !r.Release(dev) || r.Release(dev) {
+		t.Fatal("Release() didn't forget the assignment once")
+	}
+	if _, ok := r.Get(dev); ok {
+		t.Fatal("Get() found a released assignment")
+	}
+}
+
+func TestResolveConfiguredCollision(t *testing.T) {
+	r, err := Load(filepath.Join(t.TempDir(), "ports.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := Key{Profile: "default", Env: "dev", Host: "db.internal", Remote: 5432}
+	prod := Key{Profile: "default", Env: "prod", Host: "db.internal", Remote: 5432}
+
+	if port, err := r.Resolve(dev, 15432, 15432, nil); err != nil || port != 15432 {
+		t.Fatalf("Resolve(dev) = %d, %v", port, err)
+	}
+
+	// The port configured for prod is recorded for dev already
+	if _, err := r.Resolve(prod, 15432, 15432, nil); err == nil {
+		t.Fatal("Resolve() recorded a configured port assigned to another endpoint")
+	}
+	if _, ok := r.Get(prod); ok {
+		t.Fatal("Resolve() recorded the colliding port")
+	}
+
+	// The endpoint holding the port keeps resolving it
+	if port, err := r.Resolve(dev, 15432, 15432, nil); err != nil || port != 15432 {
+		t.Fatalf("Resolve(dev) again = %d, %v", port, err)
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+
+	// Every update sees the assignments of the others, none of them gets lost
+	const updates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := Key{Profile: "default", Env: fmt.Sprintf("env%d", i), Host: "db.internal", Remote: 5432}
+			if err := Update(path, func(r *Registry) error {
+				_, err := r.Resolve(key, 0, 15432, nil)
+				return err
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Assignments) != updates {
+		t.Fatalf("registry has %d assignments, want %d", len(r.Assignments), updates)
+	}
+
+	seen := map[int]bool{}
+	for _, a := range r.Assignments {
+		if seen[a.Local] {
+			t.Fatalf("local port %d is assigned twice", a.Local)
+		}
+		seen[a.Local] = true
+	}
+
+	// A failing update doesn't save anything
+	if err := Update(path, func(r *Registry) error {
+		r.Release(r.Assignments[0].Key)
+		return errors.New("failed")
+	}); err == nil {
+		t.Fatal("Update() didn't return the error")
+	}
+	if r, _ := Load(path); len(r.Assignments) != updates {
+		t.Fatalf("failed Update() saved the registry")
+	}
+}
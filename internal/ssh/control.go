@@ -0,0 +1,246 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/automationd/atun/internal/audit"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/hostsfile"
+	"github.com/automationd/atun/internal/logger"
+)
+
+// TunnelSpec describes a tunnel for the process running it (`atun daemon` or `atun up --foreground`)
+type TunnelSpec struct {
+	ID                       string                   `json:"id"`
+	Env                      string                   `json:"env"`
+	AWSProfile               string                   `json:"aws_profile"`
+	AWSRegion                string                   `json:"aws_region"`
+	AWSEndpointURL           string                   `json:"aws_endpoint_url,omitempty"`
+	RouterHostID             string                   `json:"router_host_id"`
+	RouterHostUser           string                   `json:"router_host_user"`
+	RouterAddress            string                   `json:"router_address,omitempty"`
+	SSHKeyPath               string                   `json:"ssh_key_path"`
+	SSHStrictHostKeyChecking bool                     `json:"ssh_strict_host_key_checking"`
+	SocketFile               string                   `json:"socket_file"`
+	JournalFile              string                   `json:"journal_file,omitempty"`
+	HistoryFile              string                   `json:"history_file,omitempty"`
+	Hosts                    []config.Endpoint        `json:"hosts"`
+	Reverse                  []config.ReverseEndpoint `json:"reverse,omitempty"`
+	SocksPort                int                      `json:"socks_port,omitempty"`
+	HTTPProxyPort            int                      `json:"http_proxy_port,omitempty"`
+	ProxyCIDRs               []string                 `json:"proxy_cidrs,omitempty"`
+	ProxyDomains             []string                 `json:"proxy_domains,omitempty"`
+	KeepaliveInterval        time.Duration            `json:"keepalive_interval,omitempty"`
+	KeepaliveCountMax        int                      `json:"keepalive_count_max,omitempty"`
+	Reconnect                ReconnectPolicy          `json:"reconnect"`
+	// IdleTimeout brings the tunnel down after that long without connections
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+	// MaxSession brings the tunnel down that long after it started, however busy it is
+	MaxSession time.Duration `json:"max_session,omitempty"`
+	// Lazy tunnels connect to the router for their first client and disconnect after LazyGrace without clients
+	Lazy      bool          `json:"lazy,omitempty"`
+	LazyGrace time.Duration `json:"lazy_grace,omitempty"`
+	// SSMDirectMaxSessions caps the SSM sessions open at the same time for each ssm-direct endpoint
+	SSMDirectMaxSessions int `json:"ssm_direct_max_sessions,omitempty"`
+	// Kubeconfig and KubeContext are used by k8s endpoints
+	Kubeconfig  string `json:"kubeconfig,omitempty"`
+	KubeContext string `json:"kube_context,omitempty"`
+	// HostsEntries are mapped in a block of HostsFile for the tunnel. The block is rolled back whenever the tunnel stops.
+	HostsFile    string            `json:"hosts_file,omitempty"`
+	HostsEntries []hostsfile.Entry `json:"hosts_entries,omitempty"`
+}
+
+// routerProto returns the protocol of the endpoints forwarded through the router. SSH routers (RouterAddress)
+// are dialed directly instead of over SSM.
+func (s TunnelSpec) routerProto() string {
+	if s.RouterAddress != "" {
+		return config.ProtoSSH
+	}
+	return config.ProtoSSM
+}
+
+// RequiresKube reports whether any of the spec's endpoints is forwarded to a Kubernetes cluster
+func (s TunnelSpec) RequiresKube() bool {
+	for _, host := range s.Hosts {
+		if host.Proto == config.ProtoK8s {
+			return true
+		}
+	}
+	return false
+}
+
+// kubeconfig returns the configured kubeconfig, or $KUBECONFIG
+func kubeconfig(path string) string {
+	if path != "" {
+		return path
+	}
+	return os.Getenv("KUBECONFIG")
+}
+
+// RequiresSSH reports whether any of the spec's endpoints is forwarded through SSH
+func (s TunnelSpec) RequiresSSH() bool {
+	if len(s.Reverse) > 0 || s.SocksPort > 0 || s.HTTPProxyPort > 0 {
+		return true
+	}
+	for _, host := range s.Hosts {
+		if host.RequiresSSH() {
+			return true
+		}
+	}
+	return false
+}
+
+// controlRequest is sent by atun commands to the forwarder over its control socket
+type controlRequest struct {
+	Command string `json:"command"`
+}
+
+// controlResponse is the forwarder's answer to a controlRequest
+type controlResponse struct {
+	Running    bool        `json:"running"`
+	State      TunnelState `json:"state,omitempty"`
+	Reconnects int         `json:"reconnects,omitempty"`
+	Endpoints  []Endpoint  `json:"endpoints"`
+	Error      string      `json:"error,omitempty"`
+}
+
+const (
+	controlCommandStatus = "status"
+	controlCommandExit   = "exit"
+
+	controlTimeout = 5 * time.Second
+)
+
+// NewTunnelSpec builds the spec of the tunnel described by the app config
+func NewTunnelSpec(app *config.Atun) TunnelSpec {
+	return TunnelSpec{
+		ID:                       GetTunnelID(app),
+		Env:                      app.Config.Env,
+		AWSProfile:               app.Config.AWSProfile,
+		AWSRegion:                app.Config.AWSRegion,
+		AWSEndpointURL:           app.Config.AWSEndpointUrl,
+		RouterHostID:             app.Config.RouterHostID,
+		RouterHostUser:           app.Config.RouterHostUser,
+		RouterAddress:            app.Config.RouterAddress,
+		SSHKeyPath:               app.Config.SSHKeyPath,
+		SSHStrictHostKeyChecking: app.Config.SSHStrictHostKeyChecking,
+		SocketFile:               GetRouterSockFilePath(app),
+		JournalFile:              GetJournalFilePath(app),
+		HistoryFile:              audit.GetHistoryFilePath(app.Config.AppDir),
+		Hosts:                    app.Config.Hosts,
+		Reverse:                  app.Config.Reverse,
+		SocksPort:                app.Config.SocksPort,
+		HTTPProxyPort:            app.Config.HTTPProxyPort,
+		ProxyCIDRs:               app.Config.ProxyCIDRs,
+		ProxyDomains:             app.Config.ProxyDomains,
+		KeepaliveInterval:        app.Config.KeepaliveInterval,
+		KeepaliveCountMax:        app.Config.KeepaliveCountMax,
+		Reconnect: ReconnectPolicy{
+			InitialBackoff: DefaultReconnectPolicy.InitialBackoff,
+			MaxBackoff:     app.Config.ReconnectMaxBackoff,
+			MaxAttempts:    app.Config.ReconnectMaxAttempts,
+		},
+		IdleTimeout:          app.Config.GetIdleTimeout(),
+		MaxSession:           app.Config.MaxSession,
+		Lazy:                 app.Config.Lazy,
+		LazyGrace:            app.Config.LazyGrace,
+		SSMDirectMaxSessions: app.Config.SSMDirectMaxSessions,
+		// The daemon may run with another environment, the kubeconfig of `atun up` is used
+		Kubeconfig:  kubeconfig(app.Config.Kubeconfig),
+		KubeContext: app.Config.GetKubeContext(),
+	}
+}
+
+// ServeControl listens on the control socket and answers status/exit requests for the supervised tunnel.
+// exit is called when an exit request is received.
+func ServeControl(socketPath string, s *Supervisor, exit func()) (net.Listener, error) {
+	// A leftover socket from a process that is gone would prevent binding
+	if _, err := os.Stat(socketPath); err == nil {
+		if _, err := controlRoundTrip(socketPath, controlCommandStatus); err == nil {
+			return nil, fmt.Errorf("another forwarder is already listening on %s", socketPath)
+		}
+		_ = os.Remove(socketPath)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on control socket %s: %w", socketPath, err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn, s, exit)
+		}
+	}()
+
+	return l, nil
+}
+
+func handleControlConn(conn net.Conn, s *Supervisor, exit func()) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var request controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+		logger.Debug("Invalid control request", "error", err)
+		return
+	}
+
+	state, reconnects := s.State()
+	response := controlResponse{Running: true, State: state, Reconnects: reconnects, Endpoints: s.Endpoints()}
+
+	switch request.Command {
+	case controlCommandStatus:
+	case controlCommandExit:
+		response.Running = false
+	default:
+		response.Error = fmt.Sprintf("unknown command %q", request.Command)
+	}
+
+	_ = json.NewEncoder(conn).Encode(response)
+
+	if request.Command == controlCommandExit {
+		exit()
+	}
+}
+
+// controlRoundTrip sends a command to the forwarder listening on socketPath
+func controlRoundTrip(socketPath, command string) (controlResponse, error) {
+	var response controlResponse
+
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command}); err != nil {
+		return response, err
+	}
+
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, err
+	}
+
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+
+	return response, nil
+}
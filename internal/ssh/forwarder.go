@@ -0,0 +1,781 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+	ssh2 "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Dialer opens the transport connection to the router's SSH server (e.g. an SSM session)
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// DirectDialer opens a connection to host:port without SSH (e.g. an SSM port-forwarding session).
+// It's used for ssm-direct endpoints.
+type DirectDialer func(ctx context.Context, host string, port, localPort int) (net.Conn, error)
+
+// KubeDialer opens a connection to port of a Service or Pod of a Kubernetes cluster (see k8s.ParseTarget).
+// It's used for k8s endpoints.
+type KubeDialer func(ctx context.Context, target string, port int) (net.Conn, error)
+
+// keepaliveRequest is the global request OpenSSH clients use for ServerAliveInterval
+const keepaliveRequest = "keepalive@openssh.com"
+
+// DefaultLazyGrace is how long a lazy forwarder keeps an unused connection to the router
+const DefaultLazyGrace = time.Minute
+
+// directSessionWait bounds how long a connection to an ssm-direct endpoint waits for a session slot and its session
+const directSessionWait = time.Minute
+
+// ForwarderOption configures optional Forwarder behaviour
+type ForwarderOption func(*Forwarder)
+
+// WithSOCKS adds a dynamic SOCKS5 endpoint on the local port (equivalent of `ssh -D`)
+func WithSOCKS(port int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.socksPort = port
+	}
+}
+
+// WithHTTPProxy adds an HTTP CONNECT proxy on the local port. It also serves a PAC file
+// that routes the given CIDRs and domains through the proxy and everything else directly.
+func WithHTTPProxy(port int, cidrs, domains []string) ForwarderOption {
+	return func(f *Forwarder) {
+		f.httpProxyPort = port
+		f.pac = GeneratePAC(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), cidrs, domains)
+	}
+}
+
+// WithReverse adds reverse endpoints: ports on the router forwarded to local services
+func WithReverse(reverse []config.ReverseEndpoint) ForwarderOption {
+	return func(f *Forwarder) {
+		f.reverse = reverse
+	}
+}
+
+// WithKeepalive makes the forwarder probe the router every interval and drop the connection
+// after countMax probes in a row go unanswered (equivalent of ServerAliveInterval/ServerAliveCountMax)
+func WithKeepalive(interval time.Duration, countMax int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.keepaliveInterval = interval
+		f.keepaliveCountMax = countMax
+	}
+}
+
+// WithDirectDialer sets the dialer used for endpoints that don't go through SSH
+func WithDirectDialer(dial DirectDialer) ForwarderOption {
+	return func(f *Forwarder) {
+		f.dialDirect = dial
+	}
+}
+
+// WithDirectSessionLimit caps the SSM sessions open at the same time for each ssm-direct endpoint. Every connection
+// needs its own session, so connection pools would otherwise start a burst of sessions and hit the SSM API rate
+// limits. Connections over the limit wait for a session to close. 0 means no limit.
+func WithDirectSessionLimit(limit int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.directSessionLimit = limit
+	}
+}
+
+// WithKubeDialer sets the dialer used for k8s endpoints
+func WithKubeDialer(dial KubeDialer) ForwarderOption {
+	return func(f *Forwarder) {
+		f.dialKube = dial
+	}
+}
+
+// WithSSHRouter makes the forwarder talk to an SSH router at address (host:port) instead of an EC2 router.
+// The router's host key is checked against known_hosts for the address, not for the IP it resolves to.
+func WithSSHRouter(address string) ForwarderOption {
+	return func(f *Forwarder) {
+		f.routerAddress = address
+		f.routerProto = config.ProtoSSH
+	}
+}
+
+// WithLazy binds the local listeners right away but connects to the router only when the first client connects.
+// The connection is closed after it has had no client connections for grace, and opened again on the next one.
+// Reverse endpoints need the router to listen, so they can't be lazy.
+func WithLazy(grace time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		if grace <= 0 {
+			grace = DefaultLazyGrace
+		}
+		f.lazy = true
+		f.lazyGrace = grace
+	}
+}
+
+// Forwarder is an in-process SSH client that owns local listeners and forwards
+// every accepted connection to its endpoint through a direct-tcpip channel.
+// Endpoints that don't require SSH are dialed with the DirectDialer instead.
+type Forwarder struct {
+	dial          Dialer
+	dialDirect    DirectDialer
+	dialKube      KubeDialer
+	clientConfig  *ssh2.ClientConfig
+	hosts         []config.Endpoint
+	reverse       []config.ReverseEndpoint
+	socksPort     int
+	httpProxyPort int
+	pac           string
+	// routerAddress is set for SSH routers, routerProto is the protocol of the endpoints forwarded through the router
+	routerAddress string
+	routerProto   string
+	// directSessionLimit caps the sessions of each ssm-direct endpoint, directSessions holds their slots
+	directSessionLimit int
+	directSessions     map[string]chan struct{}
+
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+
+	lazy      bool
+	lazyGrace time.Duration
+	// ctx is the context the forwarder was started with. Lazy forwarders connect to the router with it.
+	ctx       context.Context
+	connectMu sync.Mutex
+
+	mu          sync.Mutex
+	client      *ssh2.Client
+	connectedAt time.Time
+	listeners   []io.Closer
+	endpoints   []Endpoint
+	metrics     []*endpointMetrics
+	closed      bool
+
+	done    chan struct{}
+	doneErr error
+}
+
+// NewForwarder creates a forwarder for the given endpoints. Nothing is dialed until Start is called.
+// dial and clientConfig may be nil when none of the endpoints requires SSH.
+func NewForwarder(dial Dialer, clientConfig *ssh2.ClientConfig, hosts []config.Endpoint, options ...ForwarderOption) *Forwarder {
+	f := &Forwarder{
+		dial:         dial,
+		clientConfig: clientConfig,
+		hosts:        hosts,
+		routerProto:  config.ProtoSSM,
+		done:         make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(f)
+	}
+
+	for _, host := range hosts {
+		f.endpoints = append(f.endpoints, newHostEndpoint(host))
+	}
+
+	if f.directSessionLimit > 0 {
+		f.directSessions = map[string]chan struct{}{}
+		for _, e := range f.endpoints {
+			if e.Protocol == config.ProtoSSMDirect {
+				f.directSessions[e.LocalAddress()] = make(chan struct{}, f.directSessionLimit)
+			}
+		}
+	}
+
+	for _, r := range f.reverse {
+		f.endpoints = append(f.endpoints, Endpoint{
+			LocalHost:  r.GetLocalHost(),
+			LocalPort:  r.Local,
+			RemoteHost: r.GetBind(),
+			RemotePort: r.Remote,
+			Protocol:   f.routerProto,
+			Transport:  config.TransportTCP,
+			Reverse:    true,
+			Status:     false,
+		})
+	}
+
+	if f.socksPort > 0 {
+		socks := newSOCKSEndpoint(f.socksPort)
+		socks.Protocol = f.routerProto
+		f.endpoints = append(f.endpoints, socks)
+	}
+
+	if f.httpProxyPort > 0 {
+		httpProxy := newHTTPProxyEndpoint(f.httpProxyPort)
+		httpProxy.Protocol = f.routerProto
+		f.endpoints = append(f.endpoints, httpProxy)
+	}
+
+	f.metrics = newEndpointMetrics(len(f.endpoints))
+
+	return f
+}
+
+// NewClientConfig builds an SSH client config that authenticates with the private key at keyPath
+func NewClientConfig(user, keyPath string, strictHostKeyChecking bool) (*ssh2.ClientConfig, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read SSH key %s: %w", keyPath, err)
+	}
+
+	signer, err := ssh2.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse SSH key %s: %w", keyPath, err)
+	}
+
+	hostKeyCallback := ssh2.InsecureIgnoreHostKey()
+	if strictHostKeyChecking {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+
+		hostKeyCallback, err = knownhosts.New(filepath.Join(homeDir, ".ssh", "known_hosts"))
+		if err != nil {
+			return nil, fmt.Errorf("can't load known hosts: %w", err)
+		}
+	}
+
+	return &ssh2.ClientConfig{
+		User:            user,
+		Auth:            []ssh2.AuthMethod{ssh2.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// Start connects to the router (if any endpoint requires SSH) and binds all local listeners.
+// Lazy forwarders only bind the listeners.
+func (f *Forwarder) Start(ctx context.Context) error {
+	var client *ssh2.Client
+
+	if f.lazy && len(f.reverse) > 0 {
+		return errors.New("reverse endpoints can't be forwarded lazily")
+	}
+	f.ctx = ctx
+
+	if f.requiresSSH() && !f.lazy {
+		var err error
+		if client, err = f.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	for i := range f.endpoints {
+		address := f.endpoints[i].LocalAddress()
+
+		var listener io.Closer
+		if f.endpoints[i].Proxy != "" {
+			l, err := net.Listen("tcp", address)
+			if err != nil {
+				_ = f.Close()
+				return fmt.Errorf("can't listen on %s: %w", address, err)
+			}
+			listener = l
+			if f.endpoints[i].Proxy == ProxyHTTP {
+				go f.serveHTTPProxy(f.metrics[i].listener(l), i)
+			} else {
+				go f.serveSOCKS(f.metrics[i].listener(l), i)
+			}
+		} else if f.endpoints[i].Reverse {
+			// The router listens and hands accepted connections back over SSH
+			remoteAddress := net.JoinHostPort(f.endpoints[i].RemoteHost, strconv.Itoa(f.endpoints[i].RemotePort))
+			l, err := client.Listen("tcp", remoteAddress)
+			if err != nil {
+				_ = f.Close()
+				return fmt.Errorf("router can't listen on %s: %w", remoteAddress, err)
+			}
+			listener = l
+			go f.serve(f.metrics[i].listener(l), i)
+		} else if f.endpoints[i].Transport == config.TransportUDP {
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				_ = f.Close()
+				return fmt.Errorf("can't listen on %s/udp: %w", address, err)
+			}
+			listener = conn
+			go f.serveUDP(conn, i)
+		} else {
+			l, err := listenLocal(f.endpoints[i].LocalNetwork(), address)
+			if err != nil {
+				_ = f.Close()
+				return fmt.Errorf("can't listen on %s: %w", address, err)
+			}
+			listener = l
+			go f.serve(f.metrics[i].listener(l), i)
+		}
+
+		f.mu.Lock()
+		f.listeners = append(f.listeners, listener)
+		f.endpoints[i].Status = true
+		f.mu.Unlock()
+
+		logger.Debug("Forwarding", "local", address, "transport", f.endpoints[i].Transport, "reverse", f.endpoints[i].Reverse, "remote", net.JoinHostPort(f.endpoints[i].RemoteHost, strconv.Itoa(f.endpoints[i].RemotePort)))
+	}
+
+	if client != nil {
+		f.watch(client)
+	}
+
+	if f.lazy && f.requiresSSH() {
+		go f.disconnectIdle()
+	}
+
+	return nil
+}
+
+// connect opens the SSH connection to the router and makes it the client of the forwarder
+func (f *Forwarder) connect(ctx context.Context) (*ssh2.Client, error) {
+	if f.dial == nil || f.clientConfig == nil {
+		return nil, errors.New("endpoints require SSH but no SSH dialer is configured")
+	}
+
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to router: %w", err)
+	}
+
+	address := conn.RemoteAddr().String()
+	if f.routerAddress != "" {
+		address = f.routerAddress
+	}
+
+	sshConn, chans, reqs, err := ssh2.NewClientConn(conn, address, f.clientConfig)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("ssh handshake with router failed: %w", err)
+	}
+
+	client := ssh2.NewClient(sshConn, chans, reqs)
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		_ = client.Close()
+		return nil, errors.New("forwarder is closed")
+	}
+	f.client = client
+	f.connectedAt = time.Now()
+	f.mu.Unlock()
+
+	return client, nil
+}
+
+// watch notices when the connection to the router is closed or stops answering keepalives
+func (f *Forwarder) watch(client *ssh2.Client) {
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = errors.New("router closed the connection")
+		}
+		f.lost(client, err)
+	}()
+
+	if f.keepaliveInterval > 0 {
+		go f.keepalive(client)
+	}
+}
+
+// lost handles a dropped connection to the router. A lazy forwarder keeps its listeners and connects again
+// for the next client, others stop (and are replaced by the supervisor).
+func (f *Forwarder) lost(client *ssh2.Client, err error) {
+	if !f.lazy {
+		f.finish(err)
+		return
+	}
+
+	f.mu.Lock()
+	current := f.client == client
+	if current {
+		f.client = nil
+	}
+	f.mu.Unlock()
+
+	// Connections closed on purpose (see disconnectIdle) are no longer current
+	if current {
+		_ = client.Close()
+		logger.Info("Lost connection to router, endpoints are armed", "reason", err)
+	}
+}
+
+// routerClient returns the SSH connection to the router. A lazy forwarder connects when it's first needed.
+func (f *Forwarder) routerClient() (*ssh2.Client, error) {
+	f.mu.Lock()
+	client := f.client
+	f.mu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+	if !f.lazy {
+		return nil, errors.New("not connected to router")
+	}
+
+	// Clients connecting at the same time share a connection
+	f.connectMu.Lock()
+	defer f.connectMu.Unlock()
+
+	f.mu.Lock()
+	client = f.client
+	f.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	logger.Info("Connecting to router for the first client")
+	client, err := f.connect(f.ctx)
+	if err != nil {
+		logger.Warn("Can't connect to router", "error", err)
+		return nil, err
+	}
+	f.watch(client)
+
+	return client, nil
+}
+
+// disconnectIdle closes the connection to the router of a lazy forwarder when it has had no client connections
+// for the grace period. The endpoints stay armed.
+func (f *Forwarder) disconnectIdle() {
+	ticker := time.NewTicker(min(f.lazyGrace/4, 5*time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		client := f.client
+		connectedAt := f.connectedAt
+		f.mu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		idle := time.Since(lastActivity(f.Endpoints(), connectedAt))
+		if idle < f.lazyGrace {
+			continue
+		}
+
+		f.mu.Lock()
+		current := f.client == client
+		if current {
+			f.client = nil
+		}
+		f.mu.Unlock()
+
+		if current {
+			logger.Info("Closing unused connection to router, endpoints are armed", "idle", idle.Round(time.Second))
+			_ = client.Close()
+		}
+	}
+}
+
+// listenLocal binds the local end of an endpoint. For Unix sockets the directory is created, and a socket file
+// left behind by a tunnel that is gone is replaced (a socket somebody still listens on is not).
+func listenLocal(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(address); err == nil {
+			if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("%s is in use", address)
+			}
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+// keepalive probes the router and drops the connection when it stops answering.
+// A connection that went stale during sleep or a network change is otherwise only noticed by the next dial.
+func (f *Forwarder) keepalive(client *ssh2.Client) {
+	countMax := f.keepaliveCountMax
+	if countMax <= 0 {
+		countMax = 1
+	}
+
+	ticker := time.NewTicker(f.keepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		// A lazy forwarder may have closed or replaced the connection
+		f.mu.Lock()
+		current := f.client == client
+		f.mu.Unlock()
+		if !current {
+			return
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// Any reply (even a refusal) proves the router is there
+			_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-f.done:
+			return
+		case err := <-reply:
+			if err == nil {
+				missed = 0
+				continue
+			}
+			missed = countMax
+		case <-time.After(f.keepaliveInterval):
+			missed++
+			logger.Debug("Router didn't answer keepalive", "missed", missed)
+		}
+
+		if missed >= countMax {
+			f.lost(client, fmt.Errorf("router didn't answer %d keepalives", missed))
+			return
+		}
+	}
+}
+
+// requiresSSH reports whether any of the endpoints is forwarded through SSH
+func (f *Forwarder) requiresSSH() bool {
+	if len(f.reverse) > 0 || f.socksPort > 0 || f.httpProxyPort > 0 {
+		return true
+	}
+	for _, host := range f.hosts {
+		if host.RequiresSSH() {
+			return true
+		}
+	}
+	return false
+}
+
+// serve accepts connections for the endpoint with the given index.
+// For reverse endpoints the listener is on the router and connections are forwarded to the local service.
+func (f *Forwarder) serve(l net.Listener, index int) {
+	f.mu.Lock()
+	endpoint := f.endpoints[index]
+	f.mu.Unlock()
+
+	for {
+		local, err := l.Accept()
+		if err != nil {
+			f.mu.Lock()
+			f.endpoints[index].Status = false
+			f.mu.Unlock()
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Debug("Stopped accepting connections", "local", l.Addr(), "error", err)
+			}
+			return
+		}
+
+		go f.forward(local, endpoint)
+	}
+}
+
+// forward pipes an accepted connection to the endpoint's remote address through the router
+// (or to the local service for reverse endpoints)
+func (f *Forwarder) forward(local net.Conn, endpoint Endpoint) {
+	defer local.Close()
+
+	remote := net.JoinHostPort(endpoint.RemoteHost, strconv.Itoa(endpoint.RemotePort))
+
+	upstream, err := f.dialEndpoint(endpoint)
+	if err != nil {
+		logger.Debug("Can't open connection to remote", "remote", remote, "proto", endpoint.Protocol, "error", err)
+		return
+	}
+	defer upstream.Close()
+
+	pipe(local, upstream)
+}
+
+// dialEndpoint opens the upstream connection for the endpoint according to its protocol
+func (f *Forwarder) dialEndpoint(endpoint Endpoint) (net.Conn, error) {
+	if endpoint.Reverse {
+		return net.Dial("tcp", net.JoinHostPort(endpoint.LocalHost, strconv.Itoa(endpoint.LocalPort)))
+	}
+
+	if endpoint.Protocol == config.ProtoSSMDirect {
+		return f.dialDirectEndpoint(endpoint)
+	}
+
+	if endpoint.Protocol == config.ProtoK8s {
+		if f.dialKube == nil {
+			return nil, errors.New("no kubernetes dialer configured")
+		}
+		return f.dialKube(context.Background(), endpoint.RemoteHost, endpoint.RemotePort)
+	}
+
+	client, err := f.routerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Dial("tcp", net.JoinHostPort(endpoint.RemoteHost, strconv.Itoa(endpoint.RemotePort)))
+}
+
+// dialDirectEndpoint opens an SSM port-forwarding session for a connection to an ssm-direct endpoint.
+// The agent forwards a single connection per session, so sessions aren't shared between connections.
+func (f *Forwarder) dialDirectEndpoint(endpoint Endpoint) (net.Conn, error) {
+	if f.dialDirect == nil {
+		return nil, errors.New("no direct dialer configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), directSessionWait)
+	defer cancel()
+
+	slots := f.directSessions[endpoint.LocalAddress()]
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			logger.Debug("All SSM sessions of the endpoint are in use, waiting for one to close", "local", endpoint.LocalAddress(), "limit", cap(slots))
+			select {
+			case slots <- struct{}{}:
+			case <-f.done:
+				return nil, errors.New("forwarder is closed")
+			case <-ctx.Done():
+				return nil, fmt.Errorf("all %d SSM sessions of the endpoint are in use", cap(slots))
+			}
+		}
+	}
+
+	conn, err := f.dialDirect(ctx, endpoint.RemoteHost, endpoint.RemotePort, endpoint.LocalPort)
+	if err != nil {
+		if slots != nil {
+			<-slots
+		}
+		return nil, err
+	}
+	if slots == nil {
+		return conn, nil
+	}
+
+	return &sessionConn{Conn: conn, release: func() { <-slots }}, nil
+}
+
+// sessionConn gives the session slot of an ssm-direct endpoint back when the connection is closed
+type sessionConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *sessionConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// pipe copies data in both directions until one of the sides is done
+func pipe(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
+
+// Endpoints returns a snapshot of the endpoints, whether they're being forwarded (or armed) and their traffic
+func (f *Forwarder) Endpoints() []Endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	endpoints := make([]Endpoint, len(f.endpoints))
+	copy(endpoints, f.endpoints)
+	for i := range endpoints {
+		f.metrics[i].apply(&endpoints[i])
+		// ssm-direct and k8s endpoints don't use the connection to the router
+		endpoints[i].Armed = f.lazy && f.client == nil && endpoints[i].Status && endpoints[i].Protocol == f.routerProto
+	}
+	return endpoints
+}
+
+// armed reports whether the forwarder is lazy and waits for a client to connect to the router
+func (f *Forwarder) armed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lazy && f.client == nil && !f.closed && f.requiresSSH()
+}
+
+// keepMetrics makes the forwarder count on top of the metrics of prev, so a reconnect doesn't reset them.
+// Must be called before Start.
+func (f *Forwarder) keepMetrics(prev *Forwarder) {
+	if prev == nil || len(prev.metrics) != len(f.metrics) {
+		return
+	}
+	f.metrics = prev.metrics
+}
+
+// Done is closed when the forwarder stops (closed or lost the connection to the router)
+func (f *Forwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the reason the forwarder stopped
+func (f *Forwarder) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.doneErr
+}
+
+// Close stops all listeners and the SSH connection
+func (f *Forwarder) Close() error {
+	f.finish(nil)
+	return nil
+}
+
+func (f *Forwarder) finish(err error) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	f.doneErr = err
+	listeners := f.listeners
+	client := f.client
+	for i := range f.endpoints {
+		f.endpoints[i].Status = false
+	}
+	f.mu.Unlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	if client != nil {
+		_ = client.Close()
+	}
+
+	close(f.done)
+}
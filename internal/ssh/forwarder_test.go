@@ -0,0 +1,1050 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+	ssh2 "golang.org/x/crypto/ssh"
+)
+
+// testRouter is a local stand-in for the router's sshd.
+// It accepts any public key and serves direct-tcpip channels by dialing the requested address.
+type testRouter struct {
+	t            *testing.T
+	serverConfig *ssh2.ServerConfig
+	// noPython makes the router fail the python3 check of the UDP relay
+	noPython bool
+	// relayChecks counts the python3 checks of the UDP relay
+	relayChecks atomic.Int32
+}
+
+func newTestRouter(t *testing.T) *testRouter {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh2.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh2.ServerConfig{
+		PublicKeyCallback: func(conn ssh2.ConnMetadata, key ssh2.PublicKey) (*ssh2.Permissions, error) {
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	return &testRouter{t: t, serverConfig: serverConfig}
+}
+
+// dialer returns a Dialer that serves an SSH connection over loopback TCP.
+// net.Pipe is unbuffered and would deadlock on the simultaneous version exchange.
+func (r *testRouter) dialer() Dialer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}
+}
+
+func (r *testRouter) serve(conn net.Conn) {
+	serverConn, chans, reqs, err := ssh2.NewServerConn(conn, r.serverConfig)
+	if err != nil {
+		return
+	}
+	go r.serveGlobalRequests(serverConn, reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "session" {
+			go r.serveSession(newChannel)
+			continue
+		}
+
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh2.UnknownChannelType, "unsupported")
+			continue
+		}
+
+		// RFC 4254 7.2: host to connect, port to connect, originator address, originator port
+		data := newChannel.ExtraData()
+		hostLength := binary.BigEndian.Uint32(data)
+		host := string(data[4 : 4+hostLength])
+		port := binary.BigEndian.Uint32(data[4+hostLength:])
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh2.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			_ = upstream.Close()
+			continue
+		}
+		go ssh2.DiscardRequests(requests)
+		go func() {
+			defer channel.Close()
+			defer upstream.Close()
+			pipe(channel, upstream)
+		}()
+	}
+}
+
+// serveGlobalRequests handles tcpip-forward (remote forwarding) requests by listening locally
+// and opening forwarded-tcpip channels back to the client for every accepted connection
+func (r *testRouter) serveGlobalRequests(conn *ssh2.ServerConn, reqs <-chan *ssh2.Request) {
+	for request := range reqs {
+		if request.Type != "tcpip-forward" {
+			_ = request.Reply(false, nil)
+			continue
+		}
+
+		// RFC 4254 7.1: address to bind, port number to bind
+		var forward struct {
+			Address string
+			Port    uint32
+		}
+		if err := ssh2.Unmarshal(request.Payload, &forward); err != nil {
+			_ = request.Reply(false, nil)
+			continue
+		}
+
+		l, err := net.Listen("tcp", net.JoinHostPort(forward.Address, strconv.Itoa(int(forward.Port))))
+		if err != nil {
+			_ = request.Reply(false, nil)
+			continue
+		}
+		r.t.Cleanup(func() { _ = l.Close() })
+		_ = request.Reply(true, nil)
+
+		go func() {
+			for {
+				accepted, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				origin := accepted.RemoteAddr().(*net.TCPAddr)
+				payload := ssh2.Marshal(struct {
+					Address       string
+					Port          uint32
+					OriginAddress string
+					OriginPort    uint32
+				}{forward.Address, forward.Port, origin.IP.String(), uint32(origin.Port)})
+
+				channel, requests, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					_ = accepted.Close()
+					continue
+				}
+				go ssh2.DiscardRequests(requests)
+				go func() {
+					defer channel.Close()
+					defer accepted.Close()
+					pipe(channel, accepted)
+				}()
+			}
+		}()
+	}
+}
+
+// serveSession stands in for the UDP relay script: it takes host and port from the end of the exec command
+// and relays framed datagrams the same way the script does
+func (r *testRouter) serveSession(newChannel ssh2.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	var command string
+	for request := range requests {
+		if request.Type != "exec" {
+			_ = request.Reply(false, nil)
+			continue
+		}
+		// RFC 4254 6.5: string command
+		command = string(request.Payload[4:])
+		_ = request.Reply(true, nil)
+		break
+	}
+	go ssh2.DiscardRequests(requests)
+
+	if command == udpRelayCheckCommand {
+		r.relayChecks.Add(1)
+		status := uint32(0)
+		if r.noPython {
+			status = 1
+		}
+		// RFC 4254 6.10: uint32 exit_status
+		_, _ = channel.SendRequest("exit-status", false, ssh2.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+
+	fields := strings.Fields(command)
+	if len(fields) < 2 {
+		return
+	}
+	upstream, err := net.Dial("udp", net.JoinHostPort(fields[len(fields)-2], fields[len(fields)-1]))
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := writeDatagram(channel, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		datagram, err := readDatagram(channel)
+		if err != nil {
+			return
+		}
+		_, _ = upstream.Write(datagram)
+	}
+}
+
+// startUDPEchoServer starts a UDP server that echoes every datagram back
+func startUDPEchoServer(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startEchoServer starts a TCP server that echoes everything back
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// freePort returns a local TCP port that is free at the moment of the call
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func testClientConfig(t *testing.T) *ssh2.ClientConfig {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh2.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ssh2.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh2.AuthMethod{ssh2.PublicKeys(signer)},
+		HostKeyCallback: ssh2.InsecureIgnoreHostKey(),
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Remote: remotePort, Local: localPort},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	endpoints := f.Endpoints()
+	if len(endpoints) != 1 || !endpoints[0].Status {
+		t.Fatalf("Endpoints() = %+v, want one active endpoint", endpoints)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	e := f.Endpoints()[0]
+	if e.ActiveConnections != 1 || e.TotalConnections != 1 || e.BytesOut != 4 || e.BytesIn != 4 || e.LastActivity.IsZero() {
+		t.Errorf("metrics = %d/%d conns, %d out, %d in, last %v, want 1/1 conns, 4 out, 4 in", e.ActiveConnections, e.TotalConnections, e.BytesOut, e.BytesIn, e.LastActivity)
+	}
+
+	_ = conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for f.Endpoints()[0].ActiveConnections != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e := f.Endpoints()[0]; e.ActiveConnections != 0 || e.TotalConnections != 1 {
+		t.Errorf("after close: %d/%d conns, want 0/1", e.ActiveConnections, e.TotalConnections)
+	}
+
+	_ = f.Close()
+	select {
+	case <-f.Done():
+	case <-time.After(time.Second):
+		t.Fatal("forwarder didn't stop")
+	}
+
+	if endpoints := f.Endpoints(); endpoints[0].Status {
+		t.Errorf("endpoint is still active after Close")
+	}
+}
+
+func TestForwarderKube(t *testing.T) {
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	// k8s endpoints don't need the router
+	var dialed string
+	f := NewForwarder(nil, nil, []config.Endpoint{
+		{Name: "db/svc/postgres", Proto: config.ProtoK8s, Remote: 5432, Local: localPort},
+	}, WithKubeDialer(func(ctx context.Context, target string, port int) (net.Conn, error) {
+		dialed = fmt.Sprintf("%s:%d", target, port)
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort)))
+	}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if dialed != "db/svc/postgres:5432" {
+		t.Errorf("dialed %q, want db/svc/postgres:5432", dialed)
+	}
+}
+
+// echo writes msg to conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != msg {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestForwarderSSMDirect(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	directPort, sshPort := freePort(t), freePort(t)
+
+	// ssm-direct endpoints get a session of their own, ssm endpoints go through SSH
+	var dialed []string
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: directPort},
+		{Name: "127.0.0.1", Proto: config.ProtoSSM, Remote: remotePort, Local: sshPort},
+	}, WithDirectDialer(func(ctx context.Context, host string, port, localPort int) (net.Conn, error) {
+		dialed = append(dialed, fmt.Sprintf("%s:%d/%d", host, port, localPort))
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort)))
+	}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	for _, port := range []int{directPort, sshPort} {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+		if err != nil {
+			t.Fatalf("dial forwarded port: %v", err)
+		}
+		echo(t, conn, "ping")
+		_ = conn.Close()
+	}
+
+	if want := fmt.Sprintf("db.internal:5432/%d", directPort); len(dialed) != 1 || dialed[0] != want {
+		t.Errorf("direct dialer dialed %v, want [%s]", dialed, want)
+	}
+}
+
+func TestForwarderSSMDirectOnly(t *testing.T) {
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	// Routers without sshd: there's no SSH dialer or client config at all
+	f := NewForwarder(nil, nil, []config.Endpoint{
+		{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: localPort},
+	}, WithDirectDialer(func(ctx context.Context, host string, port, localPort int) (net.Conn, error) {
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort)))
+	}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if f.requiresSSH() || f.armed() {
+		t.Error("forwarder of ssm-direct endpoints requires SSH")
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	// Endpoints going through SSH can't be started without an SSH dialer
+	ssm := NewForwarder(nil, nil, []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSM, Remote: 5432, Local: freePort(t)}})
+	if err := ssm.Start(context.Background()); err == nil {
+		_ = ssm.Close()
+		t.Error("Start() of an ssm endpoint without SSH dialer succeeded")
+	}
+}
+
+func TestForwarderSSMDirectNoDialer(t *testing.T) {
+	localPort := freePort(t)
+
+	f := NewForwarder(nil, nil, []config.Endpoint{
+		{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: localPort},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+	defer conn.Close()
+
+	// The connection is closed, it can't be forwarded anywhere
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() = %v, want EOF", err)
+	}
+}
+
+func TestForwarderSSMDirectSessionLimit(t *testing.T) {
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	var sessions atomic.Int32
+	f := NewForwarder(nil, nil, []config.Endpoint{
+		{Name: "db.internal", Proto: config.ProtoSSMDirect, Remote: 5432, Local: localPort},
+	}, WithDirectSessionLimit(1), WithDirectDialer(func(ctx context.Context, host string, port, localPort int) (net.Conn, error) {
+		sessions.Add(1)
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort)))
+	}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))
+	first, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	echo(t, first, "one")
+
+	second, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := second.Write([]byte("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second connection waits for the session of the first one
+	_ = second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := second.Read(make([]byte, 3)); n != 0 || err == nil {
+		t.Fatalf("second connection was forwarded over the limit: %d, %v", n, err)
+	}
+	if got := sessions.Load(); got != 1 {
+		t.Fatalf("%d sessions were opened, want 1", got)
+	}
+
+	_ = first.Close()
+	got := make([]byte, 3)
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(second, got); err != nil || string(got) != "two" {
+		t.Fatalf("got %q, %v after the first connection closed", got, err)
+	}
+}
+
+func TestForwarderSSHRouter(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+	socksPort := freePort(t)
+
+	// The host key is looked up for the configured address, not for the IP the connection went to
+	var hostname string
+	clientConfig := testClientConfig(t)
+	clientConfig.HostKeyCallback = func(name string, remote net.Addr, key ssh2.PublicKey) error {
+		hostname = name
+		return nil
+	}
+
+	f := NewForwarder(router.dialer(), clientConfig, []config.Endpoint{
+		{Name: "127.0.0.1", Proto: config.ProtoSSH, Remote: remotePort, Local: localPort},
+	}, WithSSHRouter("bastion.example.com:2222"), WithSOCKS(socksPort))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if hostname != "bastion.example.com:2222" {
+		t.Errorf("host key checked for %q, want bastion.example.com:2222", hostname)
+	}
+	for _, e := range f.Endpoints() {
+		if e.Protocol != config.ProtoSSH || !e.Status {
+			t.Errorf("endpoint %s:%d = %s (active %v), want an active ssh endpoint", e.RemoteHost, e.RemotePort, e.Protocol, e.Status)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestForwarderLazy(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	var dials atomic.Int32
+	dial := router.dialer()
+	f := NewForwarder(func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		return dial(ctx)
+	}, testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Remote: remotePort, Local: localPort},
+	}, WithLazy(200*time.Millisecond))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if e := f.Endpoints()[0]; !e.Status || !e.Armed || dials.Load() != 0 {
+		t.Fatalf("Endpoints() = %+v after %d dials, want an armed endpoint without a connection to the router", e, dials.Load())
+	}
+
+	ping := func() {
+		t.Helper()
+
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+		if err != nil {
+			t.Fatalf("dial forwarded port: %v", err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		if e := f.Endpoints()[0]; e.Armed {
+			t.Errorf("endpoint is armed while a client is connected")
+		}
+	}
+
+	// The first client connects the router, the connection is closed after the grace period without clients
+	ping()
+	deadline := time.Now().Add(3 * time.Second)
+	for !f.Endpoints()[0].Armed && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if e := f.Endpoints()[0]; !e.Armed || !e.Status {
+		t.Fatalf("endpoint = %+v, want armed again after the grace period", e)
+	}
+
+	ping()
+	if dials.Load() != 2 {
+		t.Errorf("router was dialed %d times, want 2", dials.Load())
+	}
+
+	// Reverse endpoints need the router to listen
+	reverse := NewForwarder(router.dialer(), testClientConfig(t), nil, WithLazy(0), WithReverse([]config.ReverseEndpoint{{Remote: 8080, Local: localPort}}))
+	if err := reverse.Start(context.Background()); err == nil {
+		_ = reverse.Close()
+		t.Error("Start() of a lazy forwarder with reverse endpoints didn't fail")
+	}
+}
+
+func TestForwarderUDP(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startUDPEchoServer(t)
+
+	// The local UDP port is picked the same way as TCP ones
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	_ = conn.Close()
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Transport: "udp", Remote: remotePort, Local: localPort},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if endpoints := f.Endpoints(); endpoints[0].Transport != "udp" || !endpoints[0].Status {
+		t.Fatalf("Endpoints() = %+v, want one active UDP endpoint", endpoints)
+	}
+
+	// Two clients must get their own replies
+	for _, payload := range []string{"first", "second"} {
+		client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, 64)
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(got)
+		if err != nil || string(got[:n]) != payload {
+			t.Fatalf("got %q, %v, want %q", got[:n], err, payload)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestForwarderUDPConcurrentClients(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startUDPEchoServer(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	_ = conn.Close()
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Transport: "udp", Remote: remotePort, Local: localPort},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	// Relays of new clients start in the background, the first datagram of every client is delivered once its relay is up
+	const clients = 5
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func(payload string) {
+			client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+
+			if _, err := client.Write([]byte(payload)); err != nil {
+				errs <- err
+				return
+			}
+
+			got := make([]byte, 64)
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := client.Read(got)
+			if err == nil && string(got[:n]) != payload {
+				err = fmt.Errorf("got %q, want %q", got[:n], payload)
+			}
+			errs <- err
+		}(fmt.Sprintf("client %d", i))
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if checks := router.relayChecks.Load(); checks != 1 {
+		t.Errorf("router was checked for python3 %d times, want once", checks)
+	}
+}
+
+func TestForwarderUnixSocket(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+
+	// Unix socket paths are limited to ~100 characters, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "atun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "db.sock")
+	// A socket file left behind by a tunnel that is gone doesn't prevent binding
+	if err := os.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Remote: remotePort, Bind: socketPath},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if endpoints := f.Endpoints(); endpoints[0].LocalSocket != socketPath || endpoints[0].LocalAddress() != socketPath || !endpoints[0].Status {
+		t.Fatalf("Endpoints() = %+v, want one active Unix socket endpoint", endpoints)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	occupied, owner, err := CheckPort(f.Endpoints()[0])
+	if !occupied || err != nil || owner.PID != os.Getpid() {
+		t.Errorf("CheckPort() = %v, %+v, %v, want this process", occupied, owner, err)
+	}
+}
+
+func TestForwarderUDPNoPython(t *testing.T) {
+	router := newTestRouter(t)
+	router.noPython = true
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	_ = conn.Close()
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), []config.Endpoint{
+		{Name: "127.0.0.1", Proto: "ssm", Transport: "udp", Remote: 53, Local: localPort},
+	})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	client, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint is stopped instead of dropping every datagram
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Endpoints()[0].Status && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Endpoints()[0].Status {
+		t.Error("UDP endpoint is still active on a router without python3")
+	}
+}
+
+func TestUDPRelayCommand(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"10.0.0.2":                  true,
+		"fd00::53":                  true,
+		"dns.internal":              true,
+		"ip-10-0-0-2.ec2.internal":  true,
+		"":                          false,
+		"-c":                        false,
+		"x';reboot;'":               false,
+		"h>/tmp/x":                  false,
+		"h</etc/passwd":             false,
+		"$(reboot)":                 false,
+		"(reboot)":                  false,
+		"*":                         false,
+		"host?":                     false,
+		"~root":                     false,
+		"{a,b}":                     false,
+		"dns.internal 53; reboot #": false,
+		"a\nreboot":                 false,
+	} {
+		command, err := udpRelayCommand(host, 53)
+		if valid && (err != nil || !strings.HasSuffix(command, "' "+host+" 53")) {
+			t.Errorf("udpRelayCommand(%q) = %q, %v", host, command, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("udpRelayCommand(%q) accepted a host that isn't a hostname or IP address: %q", host, command)
+		}
+	}
+	if strings.Contains(udpRelayScript, "'") {
+		t.Errorf("relay script must not contain single quotes")
+	}
+}
+
+func TestForwarderReverse(t *testing.T) {
+	router := newTestRouter(t)
+	localPort := startEchoServer(t)
+	routerPort := freePort(t)
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), nil, WithReverse([]config.ReverseEndpoint{
+		{Name: "webhook", Bind: "127.0.0.1", Remote: routerPort, Local: localPort},
+	}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	if endpoints := f.Endpoints(); len(endpoints) != 1 || !endpoints[0].Reverse || !endpoints[0].Status {
+		t.Fatalf("Endpoints() = %+v, want one active reverse endpoint", endpoints)
+	}
+
+	// A workload "in the VPC" connects to the router port and reaches the local service
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(routerPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial router port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hook")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hook" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestForwarderSOCKS(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	socksPort := freePort(t)
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), nil, WithSOCKS(socksPort))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socksPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial SOCKS port: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Greeting with no authentication, then CONNECT by domain name (resolved on the router side)
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[1] != 0 {
+		t.Fatalf("greeting reply %v, %v", greeting, err)
+	}
+
+	host := "localhost"
+	request := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(remotePort))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("connect reply %v, %v", reply, err)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestForwarderHTTPProxy(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	proxyPort := freePort(t)
+
+	f := NewForwarder(router.dialer(), testClientConfig(t), nil,
+		WithHTTPProxy(proxyPort, []string{"10.0.0.0/16"}, []string{"ec2.internal"}))
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer f.Close()
+
+	resp, err := http.Get(GetPACURL(proxyPort))
+	if err != nil {
+		t.Fatalf("get PAC: %v", err)
+	}
+	pac, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	for _, want := range []string{`"ec2.internal"`, `isInNet(host, "10.0.0.0", "255.255.0.0")`, "PROXY 127.0.0.1:" + strconv.Itoa(proxyPort)} {
+		if !strings.Contains(string(pac), want) {
+			t.Errorf("PAC file doesn't contain %s:\n%s", want, pac)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy port: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	address := net.JoinHostPort("localhost", strconv.Itoa(remotePort))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	connectResp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || connectResp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response %v, %v", connectResp, err)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
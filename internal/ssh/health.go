@@ -0,0 +1,94 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"sync"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/health"
+	"github.com/automationd/atun/internal/logger"
+)
+
+// hostCheck returns the health check of a forwarded host. UDP endpoints can't be probed with a connection.
+func hostCheck(host config.Endpoint) string {
+	if host.IsUDP() {
+		return health.CheckNone
+	}
+	return health.CheckFor(host.Health, host.Remote)
+}
+
+// CheckEndpoints probes the endpoints through the tunnel and fills in their health.
+// Reverse and proxy endpoints don't lead to a single remote service, they are only reported as listening.
+func CheckEndpoints(ctx context.Context, endpoints []Endpoint) []Endpoint {
+	checked := make([]Endpoint, len(endpoints))
+	copy(checked, endpoints)
+
+	var wg sync.WaitGroup
+	for i := range checked {
+		e := &checked[i]
+		if e.Check == health.CheckAuto {
+			e.Check = health.CheckFor(health.CheckAuto, e.RemotePort)
+		}
+
+		if !e.Status {
+			e.Health = health.StateDown
+			continue
+		}
+
+		if e.Armed {
+			e.Health = health.StateArmed
+			continue
+		}
+
+		if e.Reverse || e.Proxy != "" || e.Check == health.CheckNone {
+			e.Health = health.StateListening
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := health.Probe(ctx, health.Target{
+				Network:    e.LocalNetwork(),
+				Address:    e.LocalAddress(),
+				ServerName: e.RemoteHost,
+				Check:      e.Check,
+			})
+			logger.Debug("Endpoint health", "remote", e.RemoteHost, "port", e.RemotePort, "check", e.Check, "state", result.State, "latency", result.Latency, "error", result.Error)
+
+			e.Health = result.State
+			e.Latency = result.Latency
+			e.HealthError = result.Error
+		}()
+	}
+	wg.Wait()
+
+	return checked
+}
+
+// EndpointsHealthy reports whether every endpoint passed its health check (see CheckEndpoints)
+func EndpointsHealthy(endpoints []Endpoint) bool {
+	for _, e := range endpoints {
+		if !e.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// Healthy reports whether the endpoint is as healthy as its check can tell
+func (e Endpoint) Healthy() bool {
+	if e.Health == health.StateArmed {
+		return true
+	}
+	if e.Reverse || e.Proxy != "" {
+		return e.Health == health.StateListening
+	}
+	return health.Result{State: e.Health}.OK(e.Check)
+}
@@ -0,0 +1,189 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+)
+
+const (
+	// ProxyHTTP marks the HTTP CONNECT proxy endpoint (`atun up --http-proxy <port>`)
+	ProxyHTTP = "http"
+
+	// PACPath is where the HTTP proxy serves its proxy auto-config file
+	PACPath = "/proxy.pac"
+)
+
+// newHTTPProxyEndpoint describes the HTTP proxy listener in the endpoints list
+func newHTTPProxyEndpoint(port int) Endpoint {
+	return Endpoint{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "*",
+		Protocol:   config.ProtoSSM,
+		Transport:  config.TransportTCP,
+		Proxy:      ProxyHTTP,
+		Status:     false,
+	}
+}
+
+// GetPACURL returns the URL of the PAC file served by the HTTP proxy on the port
+func GetPACURL(port int) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", port, PACPath)
+}
+
+// GeneratePAC builds a proxy auto-config file that sends the VPC's domains and address ranges
+// through the proxy and everything else directly
+func GeneratePAC(proxyAddress string, cidrs, domains []string) string {
+	var b strings.Builder
+
+	b.WriteString("// Generated by atun.io\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "    var proxy = \"PROXY %s\";\n", proxyAddress)
+
+	quoted := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		quoted = append(quoted, strconv.Quote(strings.TrimPrefix(domain, ".")))
+	}
+	fmt.Fprintf(&b, "    var domains = [%s];\n", strings.Join(quoted, ", "))
+	b.WriteString("    for (var i = 0; i < domains.length; i++) {\n")
+	b.WriteString("        if (host == domains[i] || dnsDomainIs(host, \".\" + domains[i])) return proxy;\n")
+	b.WriteString("    }\n")
+
+	// Only IP literals are matched against CIDRs: resolving private names locally would fail or leak
+	b.WriteString("    if (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host)) {\n")
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "        if (isInNet(host, %q, %q)) return proxy;\n", ipNet.IP.String(), net.IP(ipNet.Mask).String())
+	}
+	b.WriteString("    }\n")
+
+	b.WriteString("    return \"DIRECT\";\n")
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// httpProxy is an HTTP proxy that connects to targets through the router.
+// It handles CONNECT (HTTPS and any TCP), plain HTTP requests with absolute URLs and serves the PAC file.
+type httpProxy struct {
+	f       *Forwarder
+	pac     string
+	forward *httputil.ReverseProxy
+}
+
+func newHTTPProxy(f *Forwarder, pac string) *httpProxy {
+	p := &httpProxy{f: f, pac: pac}
+
+	p.forward = &httputil.ReverseProxy{
+		// Proxy requests carry absolute URLs already
+		Director: func(r *http.Request) {},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return p.dial(address)
+			},
+			MaxIdleConns:    10,
+			IdleConnTimeout: 90 * time.Second,
+		},
+	}
+
+	return p
+}
+
+func (p *httpProxy) dial(address string) (net.Conn, error) {
+	client, err := p.f.routerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Dial("tcp", address)
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		p.connect(w, r)
+	case r.URL.Host == "" && r.URL.Path == PACPath:
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(p.pac))
+	case r.URL.Host == "":
+		http.Error(w, "atun HTTP proxy: use an absolute URL or CONNECT", http.StatusBadRequest)
+	default:
+		logger.Debug("HTTP proxy request", "client", r.RemoteAddr, "url", r.URL.String())
+		p.forward.ServeHTTP(w, r)
+	}
+}
+
+// connect tunnels the client connection to the requested host:port
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.dial(r.Host)
+	if err != nil {
+		logger.Debug("HTTP proxy CONNECT failed", "address", r.Host, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Bytes the client sent right after the CONNECT request
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err := upstream.Write(data); err != nil {
+			return
+		}
+	}
+
+	logger.Debug("HTTP proxy CONNECT", "client", r.RemoteAddr, "address", r.Host)
+
+	pipe(conn, upstream)
+}
+
+// serveHTTPProxy serves the HTTP proxy for the endpoint with the given index
+func (f *Forwarder) serveHTTPProxy(l net.Listener, index int) {
+	server := &http.Server{
+		Handler:           newHTTPProxy(f, f.pac),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	err := server.Serve(l)
+
+	f.mu.Lock()
+	f.endpoints[index].Status = false
+	f.mu.Unlock()
+
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		logger.Debug("Stopped serving HTTP proxy", "local", l.Addr(), "error", err)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+const journalFileSuffix = "-tunnel.json"
+
+// Journal is the state file of a running tunnel. The process running the tunnel (`atun daemon` or
+// `atun up --foreground`) writes it to the tunnel directory and removes it on exit, so other commands
+// find the tunnel, its socket and the ports it listens on without looking at the process table.
+type Journal struct {
+	TunnelSpec
+	PID                int       `json:"pid"`
+	StartedAt          time.Time `json:"started_at"`
+	CredentialsExpires time.Time `json:"credentials_expires,omitempty"`
+	// SessionExpires is when the tunnel is brought down by its max_session
+	SessionExpires time.Time `json:"session_expires,omitempty"`
+}
+
+// NewJournal returns the journal of a tunnel started by the current process
+func NewJournal(spec TunnelSpec, startedAt time.Time) Journal {
+	j := Journal{TunnelSpec: spec, PID: os.Getpid(), StartedAt: startedAt}
+	if spec.MaxSession > 0 {
+		j.SessionExpires = startedAt.Add(spec.MaxSession)
+	}
+	return j
+}
+
+// GetJournalFilePath returns the path of the state file of the tunnel to the router
+func GetJournalFilePath(app *config.Atun) string {
+	return path.Join(app.Config.TunnelDir, fmt.Sprintf("%s%s", app.Config.RouterHostID, journalFileSuffix))
+}
+
+// WriteJournal writes the state file of the tunnel. The file is replaced atomically, so readers never see a partial write.
+func WriteJournal(j Journal) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.JournalFile), ".tunnel-*.json")
+	if err != nil {
+		return fmt.Errorf("can't write tunnel state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.JournalFile)
+}
+
+// ReadJournal reads the state file of a tunnel
+func ReadJournal(journalPath string) (Journal, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return Journal{}, err
+	}
+
+	var j Journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return Journal{}, fmt.Errorf("can't parse tunnel state %s: %w", journalPath, err)
+	}
+	j.JournalFile = journalPath
+
+	return j, nil
+}
+
+// Stale reports whether the process that wrote the journal is gone (killed, crashed or the machine rebooted)
+func (j Journal) Stale() bool {
+	if j.PID <= 0 {
+		return true
+	}
+
+	exists, err := process.PidExists(int32(j.PID))
+	return err == nil && !exists
+}
+
+// Terminate ends the process that wrote the journal, for tunnels that don't answer on their socket. A process started
+// after the tunnel only reuses its PID and is left alone.
+func (j Journal) Terminate() error {
+	if j.PID <= 0 || j.PID == os.Getpid() {
+		return fmt.Errorf("no tunnel process to terminate")
+	}
+
+	proc, err := process.NewProcess(int32(j.PID))
+	if err != nil {
+		return err
+	}
+
+	created, err := proc.CreateTime()
+	if err != nil {
+		return err
+	}
+	// Create times are only precise to about a second (Linux derives them from the boot time)
+	if time.UnixMilli(created).After(j.StartedAt.Add(time.Second)) {
+		return fmt.Errorf("process %d was started after the tunnel", j.PID)
+	}
+
+	return proc.Terminate()
+}
+
+// Status asks the tunnel for the state of its endpoints. Returns false if it doesn't answer.
+func (j Journal) Status() (bool, []Endpoint) {
+	return j.TunnelSpec.status()
+}
+
+// Remove deletes the journal and the socket of a stale tunnel
+func (j Journal) Remove() {
+	for _, p := range []string{j.JournalFile, j.SocketFile} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Debug("Can't remove tunnel file", "path", p, "error", err)
+		}
+	}
+}
+
+// loadJournal returns the journal of a running tunnel. Stale journals are cleaned up and reported as missing.
+func loadJournal(journalPath string) (Journal, bool) {
+	j, err := ReadJournal(journalPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Debug("Can't read tunnel state", "path", journalPath, "error", err)
+		}
+		return Journal{}, false
+	}
+
+	if j.Stale() {
+		logger.Debug("Tunnel process is gone. Removing stale tunnel state", "path", journalPath, "pid", j.PID)
+		j.Remove()
+		return Journal{}, false
+	}
+
+	return j, true
+}
+
+// FindJournals returns the journals of the tunnels running in the tunnel directory
+func FindJournals(tunnelDir string) ([]Journal, error) {
+	files, err := os.ReadDir(tunnelDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tunnel directory: %w", err)
+	}
+
+	var journals []Journal
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), journalFileSuffix) {
+			continue
+		}
+
+		if j, ok := loadJournal(filepath.Join(tunnelDir, file.Name())); ok {
+			journals = append(journals, j)
+		}
+	}
+
+	return journals, nil
+}
+
+// FindAllJournals returns the journals of the tunnels running for all environments and profiles
+func FindAllJournals(appDir string) ([]Journal, error) {
+	dirs, err := os.ReadDir(appDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app directory: %w", err)
+	}
+
+	var journals []Journal
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		found, err := FindJournals(filepath.Join(appDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, found...)
+	}
+
+	return journals, nil
+}
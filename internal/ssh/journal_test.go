@@ -0,0 +1,153 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+)
+
+// exitedPID returns the pid of a process that is gone
+func exitedPID(t *testing.T) int {
+	t.Helper()
+
+	c := exec.Command(os.Args[0], "-test.run=^$")
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return c.Process.Pid
+}
+
+func TestJournal(t *testing.T) {
+	app := &config.Atun{Config: &config.Config{TunnelDir: t.TempDir(), RouterHostID: "mi-0123456789abcdef0"}}
+	app.Config.Hosts = []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSM, Remote: 5432}}
+
+	spec := NewTunnelSpec(app)
+	spec.Hosts = []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSM, Remote: 5432, Local: 15432}}
+	spec.MaxSession = 8 * time.Hour
+
+	startedAt := time.Now()
+	if err := WriteJournal(NewJournal(spec, startedAt)); err != nil {
+		t.Fatal(err)
+	}
+
+	if j, err := ReadJournal(spec.JournalFile); err != nil || j.PID != os.Getpid() || !j.SessionExpires.Equal(startedAt.Add(8*time.Hour)) {
+		t.Fatalf("ReadJournal() = %+v, %v", j, err)
+	}
+
+	routerHostID, err := GetRouterHostIDFromExistingSession(app.Config.TunnelDir)
+	if err != nil || routerHostID != "mi-0123456789abcdef0" {
+		t.Fatalf("GetRouterHostIDFromExistingSession() = %q, %v", routerHostID, err)
+	}
+
+	// Nothing answers on the socket, but the endpoints are the ones the tunnel was started with
+	running, endpoints, err := GetSSHTunnelStatus(app)
+	if err != nil || running {
+		t.Fatalf("GetSSHTunnelStatus() = %v, %v", running, err)
+	}
+	if len(endpoints) != 1 || endpoints[0].LocalPort != 15432 {
+		t.Fatalf("GetSSHTunnelStatus() endpoints = %+v", endpoints)
+	}
+
+	// The process running the tunnel is gone
+	if err := WriteJournal(Journal{TunnelSpec: spec, PID: exitedPID(t), StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(spec.SocketFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetRouterHostIDFromExistingSession(app.Config.TunnelDir); err == nil {
+		t.Fatal("GetRouterHostIDFromExistingSession() found a stale tunnel")
+	}
+	for _, p := range []string{spec.JournalFile, spec.SocketFile} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("stale %s wasn't removed: %v", filepath.Base(p), err)
+		}
+	}
+}
+
+func TestFindAllJournals(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	appDir := t.TempDir()
+	app := &config.Atun{Config: &config.Config{AppDir: appDir, Env: "dev", AWSProfile: "default", RouterHostID: "i-0123abcd"}}
+	app.Config.TunnelDir = config.GetTunnelDir(appDir, app.Config.Env, app.Config.AWSProfile)
+	app.Config.Hosts = []config.Endpoint{{Name: "127.0.0.1", Proto: config.ProtoSSM, Remote: remotePort, Local: localPort}}
+	if err := os.MkdirAll(app.Config.TunnelDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory of another env without a running tunnel
+	if err := os.MkdirAll(config.GetTunnelDir(appDir, "staging", "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := NewTunnelSpec(app)
+	clientConfig := testClientConfig(t)
+	supervisor := NewSupervisor(func() *Forwarder {
+		return NewForwarder(router.dialer(), clientConfig, spec.Hosts)
+	}, DefaultReconnectPolicy, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := supervisor.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	control, err := ServeControl(spec.SocketFile, supervisor, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	go func() { _ = supervisor.Run(ctx) }()
+
+	if err := WriteJournal(Journal{TunnelSpec: spec, PID: os.Getpid(), StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	journals, err := FindAllJournals(appDir)
+	if err != nil || len(journals) != 1 || journals[0].Env != "dev" || journals[0].RouterHostID != "i-0123abcd" {
+		t.Fatalf("FindAllJournals() = %+v, %v", journals, err)
+	}
+
+	running, endpoints := journals[0].Status()
+	if !running || len(endpoints) != 1 || !endpoints[0].Status || endpoints[0].LocalPort != localPort {
+		t.Fatalf("Status() = %v, %+v", running, endpoints)
+	}
+}
+
+func TestJournalTerminate(t *testing.T) {
+	c := exec.Command("sleep", "30")
+	if err := c.Start(); err != nil {
+		t.Skip("sleep not available:", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	defer func() { _ = c.Process.Kill() }()
+
+	// The process was started after the tunnel, so it only reuses the PID
+	if err := (Journal{PID: c.Process.Pid, StartedAt: time.Now().Add(-time.Minute)}).Terminate(); err == nil {
+		t.Fatal("Terminate() ended a process started after the tunnel")
+	}
+
+	if err := (Journal{PID: c.Process.Pid, StartedAt: time.Now()}).Terminate(); err != nil {
+		t.Fatalf("Terminate() error = %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Terminate() didn't end the tunnel process")
+	}
+}
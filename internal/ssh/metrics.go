@@ -0,0 +1,120 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// endpointMetrics counts the connections and traffic of an endpoint. Counters are updated by the connections
+// without taking the forwarder lock.
+type endpointMetrics struct {
+	active       atomic.Int64
+	total        atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // Unix nanoseconds
+}
+
+func newEndpointMetrics(n int) []*endpointMetrics {
+	metrics := make([]*endpointMetrics, n)
+	for i := range metrics {
+		metrics[i] = &endpointMetrics{}
+	}
+	return metrics
+}
+
+// apply copies the counters to the endpoint
+func (m *endpointMetrics) apply(e *Endpoint) {
+	e.ActiveConnections = m.active.Load()
+	e.TotalConnections = m.total.Load()
+	e.BytesIn = m.bytesIn.Load()
+	e.BytesOut = m.bytesOut.Load()
+	if last := m.lastActivity.Load(); last > 0 {
+		e.LastActivity = time.Unix(0, last)
+	} else {
+		e.LastActivity = time.Time{}
+	}
+}
+
+func (m *endpointMetrics) touch() {
+	m.lastActivity.Store(time.Now().UnixNano())
+}
+
+// opened counts a new connection (or UDP flow). closed must be called when it's gone.
+func (m *endpointMetrics) opened() {
+	m.active.Add(1)
+	m.total.Add(1)
+	m.touch()
+}
+
+func (m *endpointMetrics) closed() {
+	m.active.Add(-1)
+}
+
+// received counts bytes sent by a client of the endpoint
+func (m *endpointMetrics) received(n int) {
+	if n > 0 {
+		m.bytesOut.Add(int64(n))
+		m.touch()
+	}
+}
+
+// sent counts bytes sent back to a client of the endpoint
+func (m *endpointMetrics) sent(n int) {
+	if n > 0 {
+		m.bytesIn.Add(int64(n))
+		m.touch()
+	}
+}
+
+// listener wraps l, so every accepted connection is counted
+func (m *endpointMetrics) listener(l net.Listener) net.Listener {
+	return &meteredListener{Listener: l, metrics: m}
+}
+
+type meteredListener struct {
+	net.Listener
+	metrics *endpointMetrics
+}
+
+func (l *meteredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.metrics.opened()
+	return &meteredConn{Conn: conn, metrics: l.metrics}, nil
+}
+
+// meteredConn counts the traffic of an accepted connection
+type meteredConn struct {
+	net.Conn
+	metrics *endpointMetrics
+	once    sync.Once
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.received(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.sent(n)
+	return n, err
+}
+
+// Close is called more than once by the HTTP server and the forwarding code, the connection is counted as closed once
+func (c *meteredConn) Close() error {
+	c.once.Do(c.metrics.closed)
+	return c.Conn.Close()
+}
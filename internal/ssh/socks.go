@@ -0,0 +1,189 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+)
+
+// ProxySOCKS5 marks the dynamic SOCKS5 endpoint (`atun up --socks <port>`)
+const ProxySOCKS5 = "socks5"
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xFF
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// newSOCKSEndpoint describes the SOCKS5 listener in the endpoints list
+func newSOCKSEndpoint(port int) Endpoint {
+	return Endpoint{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "*",
+		Protocol:   config.ProtoSSM,
+		Transport:  config.TransportTCP,
+		Proxy:      ProxySOCKS5,
+		Status:     false,
+	}
+}
+
+// socksHandshake reads the client's greeting and CONNECT request and returns the requested address.
+// Domain names are returned as is, so they're resolved by the router (private Route 53 zones work).
+func socksHandshake(conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAcceptable {
+		return "", errors.New("client doesn't support unauthenticated SOCKS")
+	}
+
+	// VER CMD RSV ATYP
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddressDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = socksReply(conn, socksReplyAddressNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+
+	if request[1] != socksCommandConnect {
+		_ = socksReply(conn, socksReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply sends a reply with an empty bound address
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveSOCKS accepts SOCKS5 clients for the endpoint with the given index and connects them through the router
+func (f *Forwarder) serveSOCKS(l net.Listener, index int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			f.mu.Lock()
+			f.endpoints[index].Status = false
+			f.mu.Unlock()
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Debug("Stopped accepting SOCKS connections", "local", l.Addr(), "error", err)
+			}
+			return
+		}
+
+		go f.proxySOCKS(conn)
+	}
+}
+
+func (f *Forwarder) proxySOCKS(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	address, err := socksHandshake(conn)
+	if err != nil {
+		logger.Debug("SOCKS handshake failed", "client", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	client, err := f.routerClient()
+	if err != nil {
+		logger.Debug("SOCKS connect failed", "address", address, "error", err)
+		_ = socksReply(conn, socksReplyGeneralFailure)
+		return
+	}
+
+	upstream, err := client.Dial("tcp", address)
+	if err != nil {
+		logger.Debug("SOCKS connect failed", "address", address, "error", err)
+		_ = socksReply(conn, socksReplyGeneralFailure)
+		return
+	}
+	defer upstream.Close()
+
+	if err := socksReply(conn, socksReplySucceeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	logger.Debug("SOCKS connection", "client", conn.RemoteAddr(), "address", address)
+
+	pipe(conn, upstream)
+}
@@ -8,28 +8,102 @@ package ssh
 import (
 	"fmt"
 	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/health"
 	"github.com/automationd/atun/internal/logger"
-	"github.com/shirou/gopsutil/v4/process"
+	"github.com/automationd/atun/internal/netstat"
 	ssh2 "golang.org/x/crypto/ssh"
-	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
-	"strings"
+	"time"
 )
 
-// TODO: Refactor GetSSHCommandArgs into separate functions
+// Endpoint is the state of a forwarded endpoint
 type Endpoint struct {
-	LocalHost  string
-	LocalPort  int
-	RemoteHost string
-	RemotePort int
-	Protocol   string
-	Status     bool
+	LocalHost  string `json:"local_host"`
+	LocalPort  int    `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int    `json:"remote_port"`
+	Protocol   string `json:"protocol"`
+	Transport  string `json:"transport"`
+	// Reverse endpoints listen on the router (RemoteHost:RemotePort) and forward to LocalHost:LocalPort
+	Reverse bool `json:"reverse,omitempty"`
+	// Proxy is set for dynamic endpoints (e.g. socks5) that connect to any host requested by the client
+	Proxy string `json:"proxy,omitempty"`
+	// LocalSocket is set for endpoints listening on a Unix domain socket instead of LocalHost:LocalPort
+	LocalSocket string `json:"local_socket,omitempty"`
+	Status      bool   `json:"status"`
+	// Armed endpoints of a lazy tunnel listen, but the connection to the router is only opened by their first client
+	Armed bool `json:"armed,omitempty"`
+	// Check is the health check run through the tunnel (see CheckEndpoints)
+	Check       string        `json:"check,omitempty"`
+	Health      health.State  `json:"health,omitempty"`
+	Latency     time.Duration `json:"latency,omitempty"`
+	HealthError string        `json:"health_error,omitempty"`
+	// Traffic since the tunnel started. BytesOut is sent by the clients of the endpoint, BytesIn is sent back to them.
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	LastActivity      time.Time `json:"last_activity"`
+}
+
+// newHostEndpoint returns the (not yet forwarded) state of a configured host endpoint
+func newHostEndpoint(host config.Endpoint) Endpoint {
+	e := Endpoint{
+		LocalHost:  host.GetBind(),
+		LocalPort:  host.Local,
+		RemoteHost: host.Name,
+		RemotePort: host.Remote,
+		Protocol:   host.Proto,
+		Transport:  host.GetTransport(),
+		Check:      hostCheck(host),
+		Status:     false,
+	}
+
+	if host.IsUnixSocket() {
+		e.LocalHost = ""
+		e.LocalPort = 0
+		e.LocalSocket = host.GetSocketPath()
+	}
+
+	return e
+}
+
+// LocalNetwork returns the network of the local end of the endpoint (tcp, udp or unix)
+func (e Endpoint) LocalNetwork() string {
+	if e.LocalSocket != "" {
+		return "unix"
+	}
+	if e.Transport == config.TransportUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// LocalAddress returns the local end of the endpoint: host:port or a Unix socket path
+func (e Endpoint) LocalAddress() string {
+	if e.LocalSocket != "" {
+		return e.LocalSocket
+	}
+	return net.JoinHostPort(e.LocalHost, strconv.Itoa(e.LocalPort))
+}
+
+// key identifies the endpoint in status responses. TCP and UDP endpoints may share a port number,
+// and reverse endpoints are identified by the port on the router.
+func (e Endpoint) key() string {
+	if e.Proxy != "" {
+		return "proxy/" + e.Proxy
+	}
+	if e.Reverse {
+		return "reverse/" + strconv.Itoa(e.RemotePort)
+	}
+	if e.LocalSocket != "" {
+		return "unix/" + e.LocalSocket
+	}
+	return e.Transport + "/" + e.LocalAddress()
 }
 
 // GetPublicKey gets the public key from the private key
@@ -68,15 +142,61 @@ func GetPublicKey(path string) (string, error) {
 }
 
 func GenerateSSHConfigFile(app *config.Atun) (string, error) {
-	sshConfigContent := `# SSH over AWS Session Manager (generated by atun.io)
+	// atun itself is the ProxyCommand: it speaks the SSM data channel natively (no AWS CLI or session-manager-plugin needed)
+	atunPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("can't get atun executable path: %w", err)
+	}
+
+	keepaliveInterval := int(app.Config.KeepaliveInterval.Seconds())
+	if keepaliveInterval <= 0 {
+		keepaliveInterval = 180
+	}
+
+	// ssh runs the proxy without the environment of `atun up`, so it gets the env, profile and region of the tunnel
+	var proxyArgs string
+	for _, arg := range [][2]string{{"env", app.Config.Env}, {"aws-profile", app.Config.AWSProfile}, {"aws-region", app.Config.AWSRegion}} {
+		if arg[1] != "" {
+			proxyArgs += fmt.Sprintf(`--%s "%s" `, arg[0], arg[1])
+		}
+	}
+
+	sshConfigContent := fmt.Sprintf(`# SSH over AWS Session Manager (generated by atun.io)
 host i-* mi-*
-ServerAliveInterval 180
-ProxyCommand sh -c "aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters 'portNumber=%p'"
-`
+ServerAliveInterval %d
+ServerAliveCountMax %d
+ProxyCommand "%s" ssm-proxy %s%%h %%p
+`, keepaliveInterval, max(app.Config.KeepaliveCountMax, 1), atunPath, proxyArgs)
+
+	// SSH routers are plain SSH servers, reachable without a proxy
+	if app.Config.IsSSHRouter() {
+		routerHost, routerPort, err := net.SplitHostPort(app.Config.RouterAddress)
+		if err != nil {
+			return "", fmt.Errorf("bad SSH router address %s: %w", app.Config.RouterAddress, err)
+		}
+
+		sshConfigContent = fmt.Sprintf(`# SSH to the SSH router (generated by atun.io)
+host %s
+HostName %s
+Port %s
+User %s
+IdentityFile "%s"
+ServerAliveInterval %d
+ServerAliveCountMax %d
+`, app.Config.RouterHostID, routerHost, routerPort, app.Config.RouterHostUser, app.Config.SSHKeyPath, keepaliveInterval, max(app.Config.KeepaliveCountMax, 1))
+	}
 
 	for _, host := range app.Config.Hosts {
 		logger.Debug("Endpoint", "name", host.Name, "proto", host.Proto, "remote", host.Remote, "local", host.Local)
-		sshConfigContent += fmt.Sprintf("LocalForward %d %s:%d\n", host.Local, host.Name, host.Remote)
+		// ssm-direct endpoints don't go through SSH and UDP can't be expressed with LocalForward
+		if !host.RequiresSSH() || host.IsUDP() {
+			continue
+		}
+		sshConfigContent += fmt.Sprintf("LocalForward %s %s:%d\n", sshLocalForwardBind(host), host.Name, host.Remote)
+	}
+
+	for _, r := range app.Config.Reverse {
+		sshConfigContent += fmt.Sprintf("RemoteForward %s:%d %s:%d\n", r.GetBind(), r.Remote, r.GetLocalHost(), r.Local)
 	}
 
 	sshConfigFilePath := GetSSHConfigFilePath(app)
@@ -98,258 +218,142 @@ ProxyCommand sh -c "aws ssm start-session --target %h --document-name AWS-StartS
 	return sshConfigFile.Name(), nil
 }
 
-func GetSSMPluginStatus(app *config.Atun) (bool, error) {
-	// Check if `session-manager-plugin' is started and process contains Router instance ID
-	cmd := exec.Command("ps", "aux")
-	output, err := cmd.Output()
-	if err != nil {
-		return false, fmt.Errorf("failed to check SSM plugin status: %w", err)
+// sshLocalForwardBind returns the listen part of a LocalForward line: a port (loopback), [address]:port or a socket path
+func sshLocalForwardBind(host config.Endpoint) string {
+	if host.IsUnixSocket() {
+		return host.GetSocketPath()
 	}
-
-	if !strings.Contains(string(output), app.Config.RouterHostID) {
-		return false, nil
+	if host.Bind == "" {
+		return strconv.Itoa(host.Local)
 	}
-
-	return true, nil
+	return fmt.Sprintf("[%s]:%d", host.GetBind(), host.Local)
 }
 
+// GetSSHTunnelStatus reports whether the tunnel is running and the state of its endpoints.
+// The tunnel is found by its journal; a journal left behind by a process that is gone is cleaned up.
 func GetSSHTunnelStatus(app *config.Atun) (bool, []Endpoint, error) {
-	// TODO: Add port check too to make sure to see outrun tunnels
-	var endpoints []Endpoint
-
-	// Pre-populate Endpoints
-	for _, v := range app.Config.Hosts {
-		logger.Debug("Endpoint", "name", v.Name, "proto", v.Proto, "remote", v.Remote, "local", v.Local)
-
-		endpoints = append(endpoints, Endpoint{
-			LocalHost:  "127.0.0.1",
-			LocalPort:  v.Local,
-			RemoteHost: v.Name,
-			RemotePort: v.Remote,
-			Protocol:   v.Proto,
-			Status:     false,
-		})
-	}
-	// Get all active tunnels (all environments)
-	activeSSHTunnels, err := GetActiveSSHTunnels()
-	if err != nil {
-		logger.Debug("No running tunnels found")
-		return false, endpoints, nil
-	}
+	spec := NewTunnelSpec(app)
 
-	if len(activeSSHTunnels) < 1 {
-		logger.Debug("No running ssh tunnel processes found")
-		return false, endpoints, nil
+	j, running := loadJournal(spec.JournalFile)
+	if running {
+		// The running tunnel knows best where it listens (e.g. proxies enabled by `atun up` flags)
+		logger.Debug("Tunnel state found", "path", j.JournalFile, "pid", j.PID, "startedAt", j.StartedAt)
+		spec = j.TunnelSpec
 	}
 
-	var activeOwnedTunnels []config.Config
-	// Check if any of the tunnels have the same RouterHostID
-	for _, v := range activeSSHTunnels {
-		if v.RouterHostID == app.Config.RouterHostID {
-			logger.Debug("Found running tunnel with the current RouterHostID", "routerHostID", app.Config.RouterHostID)
-			activeOwnedTunnels = append(activeOwnedTunnels, v)
-		}
+	if !running {
+		logger.Debug("Tunnel state not found. Tunnel is not running", "path", spec.JournalFile)
+		return false, spec.endpoints(), nil
 	}
 
-	if len(activeOwnedTunnels) < 1 {
-		logger.Debug("No running tunnels found with the current RouterHostID", "routerHostID", app.Config.RouterHostID)
-		return false, nil, nil
-	}
-
-	logger.Debug("Found running tunnels", "tunnels", activeOwnedTunnels)
-
-	routerSockFilePath := GetRouterSockFilePath(app)
-
-	// If a router socket file exists, check the tunnel status by sending an ssh command and then checking the port
-	if _, err := os.Stat(routerSockFilePath); !os.IsNotExist(err) {
-		logger.Debug("An existing tunnel socket found", "path", routerSockFilePath)
-
-		// Pass "check" command to see if the socket has a valid SSH connection
-		args := []string{"ssh", "-S", routerSockFilePath, "-O", "check", ""}
-
-		// Run the SSH command in a blocking way
-		cmd := exec.Command("ssh", args...)
-		cmd.Dir = app.Config.AppDir
-
-		if app.Config.LogLevel == "debug" {
-			cmd.Args = append(cmd.Args, "-vvv")
-		}
-		logger.Debug("Running SSH command", "command", cmd.String())
-		sshMasterProcessOutput, err := cmd.CombinedOutput()
-		if err != nil {
-			logger.Debug("Error checking status of the tunnel", "error", err)
-		}
-
-		if strings.Contains(string(sshMasterProcessOutput), "running") {
-			// Fill in connections with the tunnel connections from Hosts
-			for k, v := range endpoints {
-				var endpointActive bool
-
-				//logger.Debug("Endpoint", "name", v.Name, "proto", v.Proto, "remote", v.Remote, "local", v.Local)
-
-				// TODO: Get args too to get the full connection to match the env / routerID
-				// check if the v.Local port is occupied
-				portUsed, processName, err := CheckPort(v.LocalPort)
-				if err != nil {
-					log.Fatalf("Error checking port status: %v", err)
-				}
+	tunnelActive, endpoints := spec.status()
+	return tunnelActive, endpoints, nil
+}
 
-				if portUsed && processName == "ssh" {
-					endpointActive = true
-					logger.Debug("Port is occupied by ssh", "port", v.LocalPort)
-				} else {
-					endpointActive = false
-					logger.Debug("Port is not used by ssh", "port", v.LocalPort)
-				}
+// status asks the forwarder of the running tunnel for the state of its endpoints. Returns false if it doesn't answer.
+func (s TunnelSpec) status() (bool, []Endpoint) {
+	endpoints := s.endpoints()
 
-				logger.Debug("Port status", "port", v.LocalPort, "status", portUsed)
+	// The forwarder process answers with the state of its listeners
+	response, err := controlRoundTrip(s.SocketFile, controlCommandStatus)
+	if err != nil {
+		logger.Debug("Tunnel process is running but the forwarder doesn't respond", "path", s.SocketFile, "error", err)
+		return false, endpoints
+	}
 
-				endpoints[k].Status = endpointActive
-			}
+	// TCP and UDP endpoints may share a port number
+	forwarded := map[string]Endpoint{}
+	for _, e := range response.Endpoints {
+		forwarded[e.key()] = e
+	}
 
-			return true, endpoints, nil
-		} else {
-			logger.Debug("Master Tunnel is not running", "output", sshMasterProcessOutput)
+	for k, v := range endpoints {
+		if e, ok := forwarded[v.key()]; ok {
+			endpoints[k].Status = e.Status
+			endpoints[k].Armed = e.Armed
+			endpoints[k].ActiveConnections = e.ActiveConnections
+			endpoints[k].TotalConnections = e.TotalConnections
+			endpoints[k].BytesIn = e.BytesIn
+			endpoints[k].BytesOut = e.BytesOut
+			endpoints[k].LastActivity = e.LastActivity
 		}
-
-		return false, nil, nil
-
+		logger.Debug("Port status", "local", v.LocalAddress(), "status", endpoints[k].Status)
 	}
 
-	logger.Debug("Tunnel socket not found. Tunnel is not running", "path", routerSockFilePath)
-	return false, endpoints, nil
+	return response.Running, endpoints
 }
 
-func StartSSHTunnel(app *config.Atun) error {
-	routerSockFilePath := GetRouterSockFilePath(app)
-
-	args := []string{}
+// endpoints lists the endpoints of the spec, all down
+func (s TunnelSpec) endpoints() []Endpoint {
+	var endpoints []Endpoint
 
-	// Check if the router socket file exists
+	for _, v := range s.Hosts {
+		logger.Debug("Endpoint", "name", v.Name, "proto", v.Proto, "remote", v.Remote, "local", v.Local)
 
-	tunnelActive, _, err := GetSSHTunnelStatus(app)
-	if err != nil {
-		return fmt.Errorf("failed to get tunnel status: %w", err)
+		endpoints = append(endpoints, newHostEndpoint(v))
 	}
 
-	if !tunnelActive {
-		logger.Debug("Tunnel socket not found. Creating a new one", "path", routerSockFilePath)
-		args = []string{"-M", "-t", "-S", routerSockFilePath, "-fN"}
-
-		// Disable strict host key checking
-		if !app.Config.SSHStrictHostKeyChecking {
-			args = append(args, "-o", "StrictHostKeyChecking=no")
-		}
+	if s.SocksPort > 0 {
+		socks := newSOCKSEndpoint(s.SocksPort)
+		socks.Protocol = s.routerProto()
+		endpoints = append(endpoints, socks)
+	}
 
-		// TODO: Add ability to support other instance types, not just AWS Linux
-		args = append(args, fmt.Sprintf("%s@%s", app.Config.RouterHostUser, app.Config.RouterHostID))
-		args = append(args, "-F", app.Config.SSHConfigFile)
+	if s.HTTPProxyPort > 0 {
+		httpProxy := newHTTPProxyEndpoint(s.HTTPProxyPort)
+		httpProxy.Protocol = s.routerProto()
+		endpoints = append(endpoints, httpProxy)
+	}
 
-		if _, err := os.Stat(app.Config.SSHKeyPath); !os.IsNotExist(err) {
-			args = append(args, "-i", app.Config.SSHKeyPath)
-		}
+	for _, r := range s.Reverse {
+		endpoints = append(endpoints, Endpoint{
+			LocalHost:  r.GetLocalHost(),
+			LocalPort:  r.Local,
+			RemoteHost: r.GetBind(),
+			RemotePort: r.Remote,
+			Protocol:   s.routerProto(),
+			Transport:  config.TransportTCP,
+			Reverse:    true,
+			Status:     false,
+		})
 	}
 
-	if app.Config.LogLevel == "debug" {
-		args = append(args, "-vvv")
-	}
-
-	logger.Debug("SSH", "args", args)
-	c := exec.Command("ssh", args...)
-	logger.Debug("SSH command", "command", c.String())
-
-	c.Dir = app.Config.AppDir
-	os.Setenv("AWS_REGION", app.Config.AWSRegion)
-	os.Setenv("AWS_PROFILE", app.Config.AWSProfile)
-
-	// Detach the process (platform-dependent)
-	// Platform-specific implementation is in sysproc_*.go files
-	setupSysProcAttr(c)
-
-	//// Stream stdout and stderr
-	//if app.Config.LogLevel == "debug" {
-	//	// Stream output to os.Stdout and os.Stderr in real-time
-	//	stdoutPipe, err := c.StdoutPipe()
-	//	if err != nil {
-	//		return fmt.Errorf("failed to get stdout pipe: %w", err)
-	//	}
-	//	stderrPipe, err := c.StderrPipe()
-	//	if err != nil {
-	//		return fmt.Errorf("failed to get stderr pipe: %w", err)
-	//	}
-	//
-	//	go io.Copy(os.Stdout, stdoutPipe)
-	//	go io.Copy(os.Stderr, stderrPipe)
-	//} else {
-	// Only display logs without streaming
-	//c.Stdout = os.Stdout
-	//c.Stderr = os.Stderr
-	//}
-	//if app.Config.LogLevel == "debug" {
-	//	stdout, err := c.StdoutPipe()
-	//	if err != nil {
-	//		return fmt.Errorf("failed to get stdout pipe: %w", err)
-	//	}
-	//
-	//	stderr, err := c.StderrPipe()
-	//	if err != nil {
-	//		return fmt.Errorf("failed to get stderr pipe: %w", err)
-	//	}
-	//
-	//	go io.Copy(os.Stdout, stdout)
-	//	go io.Copy(os.Stderr, stderr)
-	//}
-	// Run the command
-	if err := c.Run(); err != nil {
-		logger.Debug("SSH command error", "error", err)
-		return fmt.Errorf("failed to run SSH process: %w", err)
-
-		// Print stdot and stderr from the command
-
-	}
-
-	logger.Debug("SSH process started in the background", "pid", c.Process.Pid)
-
-	// Disown the process if the parent process is terminating
-	// This ensures the child process doesn't get terminated when the parent exits
-	go func() {
-		_ = c.Process.Release() // Detach the process fully
-	}()
-
-	return nil
+	return endpoints
 }
 
 // StopSSHTunnel stops the SSH tunnel and returns false if the tunnel is not running
 func StopSSHTunnel(app *config.Atun) (bool, error) {
-	routerSockFilePath := GetRouterSockFilePath(app)
 	tunnelConfigFilePath := GetSSHConfigFilePath(app)
 
-	// If a router socket file exists, check the tunnel status
-	if _, err := os.Stat(routerSockFilePath); !os.IsNotExist(err) {
-		logger.Debug("A tunnel socket from has been found", "path", routerSockFilePath)
-
-		args := []string{"ssh", "-S", routerSockFilePath, "-O", "exit", ""}
+	// If the tunnel is running, ask the forwarder to exit
+	if j, running := loadJournal(GetJournalFilePath(app)); running {
+		logger.Debug("Tunnel state found", "path", j.JournalFile, "pid", j.PID)
 
-		// Run the SSH command in a blocking way
-		cmd := exec.Command("ssh", args...)
-		logger.Debug("Running SSH command", "command", cmd.String())
-		cmd.Dir = app.Config.AppDir
-
-		if app.Config.LogLevel == "debug" {
-			cmd.Args = append(cmd.Args, "-vvv")
+		if _, err := controlRoundTrip(j.SocketFile, controlCommandExit); err != nil {
+			logger.Debug("Forwarder doesn't respond. Terminating tunnel process", "path", j.SocketFile, "pid", j.PID, "error", err)
+			if err := j.Terminate(); err != nil {
+				logger.Debug("Can't terminate tunnel process", "pid", j.PID, "error", err)
+			}
+			j.Remove()
 		}
 
-		if err := cmd.Run(); err != nil {
-			return false, fmt.Errorf("failed to exit tunnel: %w", err)
+		// The forwarder removes its journal and socket on exit
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(j.JournalFile); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
 	}
 
-	// Check if the router socket file exists and remove it if it does
-	if _, err := os.Stat(tunnelConfigFilePath); err == nil {
-		if err := os.Remove(tunnelConfigFilePath); err != nil {
-			return false, fmt.Errorf("failed to remove router config file: %w", err)
+	// Remove the files describing the tunnel
+	for _, p := range []string{tunnelConfigFilePath} {
+		if _, err := os.Stat(p); err == nil {
+			if err := os.Remove(p); err != nil {
+				return false, fmt.Errorf("failed to remove %s: %w", p, err)
+			}
+			logger.Debug("Removed tunnel file", "path", p)
 		}
-		logger.Debug("Removed router config file", "path", tunnelConfigFilePath)
 	}
 
 	tunnelActive, _, err := GetSSHTunnelStatus(app)
@@ -376,236 +380,65 @@ func GetRouterSockFilePath(app *config.Atun) string {
 	return path.Join(app.Config.TunnelDir, fmt.Sprintf("%s-tunnel.sock", app.Config.RouterHostID))
 }
 
+// GetTunnelID identifies the tunnel of the env, profile and router across the machine (e.g. in `atun daemon`)
+func GetTunnelID(app *config.Atun) string {
+	return fmt.Sprintf("%s-%s", filepath.Base(app.Config.TunnelDir), app.Config.RouterHostID)
+}
+
 func GetSSHConfigFilePath(app *config.Atun) string {
 	return path.Join(app.Config.TunnelDir, fmt.Sprintf("%s-ssh.config", app.Config.RouterHostID))
 }
 
-// GetActiveSSHTunnels gets all active SSH tunnels on this machine (all environments)
-func GetActiveSSHTunnels() ([]config.Config, error) {
-	var runningTunnels []config.Config
-	///  ssh -M -t -S /Users/dmitry/.atun/adhoc-nutcorp-dev/i-059cde3acc2a0c8eb-tunnel.sock -fN -o StrictHostKeyChecking=no ec2-user@i-059cde3acc2a0c8eb -F /var/folders/g1/g6vwr5j95c76bc5tnq0ky2t40000gn/T/atun-ssh.config647105965 -i /Users/dmitry/.ssh/id_rsa
-
-	// Define the regex routerInstancePattern
-
-	// This regex is based on the cmd and args in ssh package
-	sshProcessPattern := regexp.MustCompile(`.*-S\s+(?P<sshSocketFile>\S+).*\s+(?P<userName>[a-zA-Z_][a-zA-Z0-9._-]{0,31})@(?P<instanceId>i-[0-9a-f]{17}).*-F\s+(?P<sshConfigFile>\S+).*-i\s+(?P<sshKeyPath>\S+).*`)
-
-	// Run the ps command to list all processes
-	targetBinary := "ssh" // The binary name to match exactly
-
-	// Get a list of all processes
-	processes, err := process.Processes()
-	if err != nil {
-		log.Fatalf("Error retrieving processes: %v", err)
-	}
-
-	logger.Debug("Process matching binary", "targetBinary", targetBinary)
-	for _, proc := range processes {
-		// Get process name
-		name, err := proc.Name()
-		if err != nil {
-			continue // Skip processes with inaccessible names
+// CheckPort checks if the local end of the endpoint (a port on its bind address or a Unix socket) is occupied
+// and returns true/false and also the process holding it
+func CheckPort(endpoint Endpoint) (bool, *netstat.PortOwner, error) {
+	network, address := endpoint.LocalNetwork(), endpoint.LocalAddress()
+	logger.Debug("Checking local endpoint", "network", network, "address", address)
+
+	if network == "udp" {
+		// Datagram sockets can't be dialed to see if anybody listens, binding tells
+		conn, err := net.ListenPacket(network, address)
+		if err == nil {
+			_ = conn.Close()
+			return false, nil, nil
 		}
-
-		// Check for an exact match of the binary name
-		if strings.EqualFold(strings.TrimSpace(name), targetBinary) {
-			// Get process ID
-			pid := proc.Pid
-
-			// (Optional) Get full executable path
-			exePath, err := proc.Exe()
-			if err != nil {
-				exePath = "N/A"
-			}
-
-			a, err := proc.CmdlineSlice()
-			if err != nil {
-				logger.Debug("Error getting process arguments, setting empty []string{}", "error", err)
-				a = []string{}
-			}
-
-			args := strings.Join(a, " ")
-
-			logger.Debug("Found process", "pid", pid, "name", name, "exePath", exePath)
-			if sshProcessPattern.MatchString(args) {
-				matches := sshProcessPattern.FindStringSubmatch(args)
-				if matches == nil {
-					continue
-				}
-
-				matchedSSHSocketFile := ""
-				matchedUserName := ""
-				matchedInstanceID := ""
-				matchedSSHConfigFile := ""
-
-				for i, name := range sshProcessPattern.SubexpNames() {
-					switch name {
-					case "sshSocketFile":
-						matchedSSHSocketFile = matches[i]
-					case "userName":
-						matchedUserName = matches[i]
-					case "instanceId":
-						matchedInstanceID = matches[i]
-					case "sshConfigFile":
-						matchedSSHConfigFile = matches[i]
-					}
-				}
-
-				runningTunnels = append(runningTunnels, config.Config{
-					SSHConfigFile:  matchedSSHConfigFile,
-					SSHSocketFile:  matchedSSHSocketFile,
-					RouterHostID:   matchedInstanceID,
-					RouterHostUser: matchedUserName,
-				})
+	} else {
+		conn, err := net.DialTimeout(network, address, time.Second)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+				// Port is not open
+				return false, nil, nil
 			}
+			return false, nil, fmt.Errorf("error dialing %s: %w", network, err)
 		}
+		_ = conn.Close()
 	}
-	return runningTunnels, nil
-}
-
-// CheckPort checks if the port is occupied and returns true/false and also process name
-func CheckPort(port int) (bool, string, error) {
-	logger.Debug("Checking port", "port", port)
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%v", port))
-	if err != nil {
-		return false, "", fmt.Errorf("can't resolve address: %w", err)
-	}
-
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
-			// Port is not open
-			return false, "", nil
-		}
-		return false, "", fmt.Errorf("error dialing TCP: %w", err)
-	}
-	defer conn.Close()
 
 	// Check which process has created the socket
-	pid, err := getProcessIDByPort(port)
-	if err != nil {
-		return true, "", fmt.Errorf("error getting process ID: %w", err)
-	}
-
-	processName, err := getProcessNameByPID(pid)
-	if err != nil {
-		return true, "", fmt.Errorf("error getting process name: %w", err)
-	}
-
-	return true, processName, nil
-}
-
-func getProcessIDByPort(port int) (int, error) {
-	cmd := exec.Command("lsof", "-sTCP:LISTEN", "-i", fmt.Sprintf(":%d", port), "-t")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, err
-	}
-
-	pidStr := strings.TrimSpace(string(output))
-	if pidStr == "" {
-		return 0, fmt.Errorf("no process found for port %d", port)
-	}
-
-	pid, err := strconv.Atoi(pidStr)
-	if err != nil {
-		return 0, err
-	}
-
-	return pid, nil
-}
-
-func getProcessNameByPID(pid int) (string, error) {
-	proc, err := process.NewProcess(int32(pid))
+	owner, err := netstat.FindOwner(network, address)
 	if err != nil {
-		return "", err
-	}
-
-	name, err := proc.Name()
-	if err != nil {
-		return "", err
+		return true, nil, fmt.Errorf("error getting process ID: %w", err)
 	}
 
-	return name, nil
+	return true, owner, nil
 }
 
-// getRouterHostIDFromSocket gets the router host ID from the router socket file
+// GetRouterHostIDFromExistingSession gets the router host ID of the tunnel running in the tunnel directory
 func GetRouterHostIDFromExistingSession(tunnelDir string) (string, error) {
-	files, err := os.ReadDir(tunnelDir)
+	journals, err := FindJournals(tunnelDir)
 	if err != nil {
-		return "", fmt.Errorf("failed to read tunnel directory: %w", err)
-	}
-
-	var tunnelFiles []string
-
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), "-tunnel.sock") {
-			tunnelFiles = append(tunnelFiles, file.Name())
-		}
+		return "", err
 	}
 
-	logger.Debug("Tunnel socket files", "files", tunnelFiles)
+	logger.Debug("Running tunnels", "count", len(journals))
 
-	if len(tunnelFiles) > 1 {
-		return "", fmt.Errorf("multiple router host IDs found in the tunnel directory %s. Likely due to abnormal termination before. Please clean up manually", tunnelDir)
+	if len(journals) > 1 {
+		return "", fmt.Errorf("multiple tunnels are running from the tunnel directory %s. Please specify the router with --router", tunnelDir)
 	}
 
-	if len(tunnelFiles) == 1 {
-		routerHostID := strings.TrimSuffix(tunnelFiles[0], "-tunnel.sock")
-		return routerHostID, nil
+	if len(journals) == 1 {
+		return journals[0].RouterHostID, nil
 	}
 
-	// TODO: attempt to get it from ssm processes
-
 	return "", fmt.Errorf("no router host ID found in the tunnel directory")
 }
-
-// TerminateSSHProcessesWithRouterHostID terminates all SSH processes that have BastionHostID in their command line
-func TerminateSSHProcessesWithRouterHostID(bastionHostID string) error {
-	processes, err := process.Processes()
-	if err != nil {
-		return fmt.Errorf("error retrieving processes: %w", err)
-	}
-
-	for _, proc := range processes {
-		cmdline, err := proc.Cmdline()
-		if err != nil {
-			continue // Skip processes with inaccessible command lines
-		}
-
-		if strings.Contains(cmdline, bastionHostID) {
-			if err := proc.Terminate(); err != nil {
-				logger.Error("Failed to terminate process", "pid", proc.Pid, "error", err)
-			} else {
-				logger.Debug("Terminated process", "pid", proc.Pid)
-			}
-		}
-	}
-
-	return nil
-}
-
-// TerminateSSMProcessesWithRouterHostID terminates all SSM processes that have RouterHostID in their command line
-func TerminateSSMProcessesWithRouterHostID(routerHostID string) error {
-	processes, err := process.Processes()
-	if err != nil {
-		return fmt.Errorf("error retrieving processes: %w", err)
-	}
-
-	for _, proc := range processes {
-		cmdline, err := proc.Cmdline()
-		if err != nil {
-			continue // Skip processes with inaccessible command lines
-		}
-
-		if strings.Contains(cmdline, routerHostID) && strings.Contains(cmdline, "session-manager-plugin") {
-			if err := proc.Terminate(); err != nil {
-				logger.Error("Failed to terminate process", "pid", proc.Pid, "error", err)
-			} else {
-				logger.Info("Terminated process", "pid", proc.Pid)
-			}
-		}
-	}
-
-	return nil
-}
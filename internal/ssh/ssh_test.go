@@ -0,0 +1,43 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/automationd/atun/internal/config"
+)
+
+func TestGenerateSSHConfigFile(t *testing.T) {
+	app := &config.Atun{Config: &config.Config{
+		TunnelDir:    t.TempDir(),
+		RouterHostID: "i-0123456789abcdef0",
+		Env:          "prod",
+		AWSProfile:   "ops",
+		AWSRegion:    "eu-west-1",
+		Hosts:        []config.Endpoint{{Name: "db.internal", Proto: config.ProtoSSM, Remote: 5432, Local: 15432}},
+	}}
+
+	path, err := GenerateSSHConfigFile(app)
+	if err != nil {
+		t.Fatalf("GenerateSSHConfigFile: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ssh runs the proxy on its own, it needs the env, profile and region of the tunnel
+	if !strings.Contains(string(data), `ssm-proxy --env "prod" --aws-profile "ops" --aws-region "eu-west-1" %h %p`) {
+		t.Errorf("ProxyCommand doesn't pass the tunnel's env, profile and region:\n%s", data)
+	}
+	if !strings.Contains(string(data), "LocalForward 15432 db.internal:5432") {
+		t.Errorf("endpoint isn't forwarded:\n%s", data)
+	}
+}
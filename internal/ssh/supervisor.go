@@ -0,0 +1,260 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+)
+
+// TunnelState is the state of a supervised tunnel as reported over the control socket
+type TunnelState string
+
+const (
+	TunnelStateConnecting   TunnelState = "connecting"
+	TunnelStateConnected    TunnelState = "connected"
+	TunnelStateArmed        TunnelState = "armed" // A lazy tunnel waiting for its first client to connect to the router
+	TunnelStateReconnecting TunnelState = "reconnecting"
+	TunnelStateStopped      TunnelState = "stopped"
+)
+
+// ReconnectPolicy controls how a Supervisor brings a dropped tunnel back
+type ReconnectPolicy struct {
+	// InitialBackoff is the delay before the first reconnect attempt. It doubles after every failed attempt.
+	InitialBackoff time.Duration `json:"initial_backoff,omitempty"`
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration `json:"max_backoff,omitempty"`
+	// MaxAttempts is the number of failed attempts in a row after which the supervisor gives up. 0 retries forever.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// DefaultReconnectPolicy retries forever, backing off from 1 second up to 1 minute
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+// next returns the delay after the given one
+func (p ReconnectPolicy) next(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// Supervisor keeps a tunnel up: it watches the forwarder and, when the connection to the router drops
+// (SSM session timeout, expired credentials, sleep), starts a new one with exponential backoff.
+type Supervisor struct {
+	newForwarder func() *Forwarder
+	policy       ReconnectPolicy
+	onState      func(state TunnelState, err error)
+
+	mu         sync.Mutex
+	forwarder  *Forwarder
+	state      TunnelState
+	reconnects int
+}
+
+// NewSupervisor creates a supervisor for forwarders built by newForwarder.
+// onState (optional) is called on every state transition with the error that caused it, if any.
+func NewSupervisor(newForwarder func() *Forwarder, policy ReconnectPolicy, onState func(state TunnelState, err error)) *Supervisor {
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultReconnectPolicy.InitialBackoff
+	}
+
+	return &Supervisor{
+		newForwarder: newForwarder,
+		policy:       policy,
+		onState:      onState,
+		state:        TunnelStateConnecting,
+	}
+}
+
+// Start brings the tunnel up for the first time. Unlike reconnects, a failure here is returned right away
+// (e.g. the SSH key isn't authorized on the router yet), so the caller can fix it and retry.
+func (s *Supervisor) Start(ctx context.Context) error {
+	if err := s.connect(ctx); err != nil {
+		s.setState(TunnelStateStopped, err)
+		return err
+	}
+	return nil
+}
+
+// Run supervises the tunnel started by Start until ctx is cancelled or the reconnect attempts are exhausted
+func (s *Supervisor) Run(ctx context.Context) error {
+	for {
+		f := s.current()
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			s.setState(TunnelStateStopped, nil)
+			return nil
+		case <-f.Done():
+		}
+
+		err := f.Err()
+		if err == nil {
+			// Closed on purpose
+			s.setState(TunnelStateStopped, nil)
+			return nil
+		}
+
+		s.setState(TunnelStateReconnecting, err)
+
+		backoff := s.policy.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			if s.policy.MaxAttempts > 0 && attempt > s.policy.MaxAttempts {
+				s.setState(TunnelStateStopped, err)
+				return fmt.Errorf("giving up after %d reconnect attempts: %w", s.policy.MaxAttempts, err)
+			}
+
+			logger.Debug("Reconnecting", "attempt", attempt, "in", backoff)
+
+			select {
+			case <-ctx.Done():
+				s.setState(TunnelStateStopped, nil)
+				return nil
+			case <-time.After(backoff):
+			}
+
+			if err = s.connect(ctx); err == nil {
+				break
+			}
+
+			logger.Warn("Reconnect failed", "attempt", attempt, "error", err)
+			backoff = s.policy.next(backoff)
+		}
+
+		s.mu.Lock()
+		s.reconnects++
+		s.mu.Unlock()
+	}
+}
+
+// connect starts a new forwarder and makes it the current one
+func (s *Supervisor) connect(ctx context.Context) error {
+	f := s.newForwarder()
+	f.keepMetrics(s.current())
+	if err := f.Start(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.forwarder = f
+	s.mu.Unlock()
+
+	s.setState(TunnelStateConnected, nil)
+	return nil
+}
+
+func (s *Supervisor) current() *Forwarder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwarder
+}
+
+func (s *Supervisor) setState(state TunnelState, err error) {
+	s.mu.Lock()
+	changed := s.state != state
+	s.state = state
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if err != nil {
+		logger.Info("Tunnel state changed", "state", state, "reason", err)
+	} else {
+		logger.Info("Tunnel state changed", "state", state)
+	}
+
+	if s.onState != nil {
+		s.onState(state, err)
+	}
+}
+
+// State returns the current state of the tunnel and how many times it has been reconnected
+func (s *Supervisor) State() (TunnelState, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == TunnelStateConnected && s.forwarder != nil && s.forwarder.armed() {
+		return TunnelStateArmed, s.reconnects
+	}
+	return s.state, s.reconnects
+}
+
+// Endpoints returns the endpoints of the current forwarder. They're all down while reconnecting.
+func (s *Supervisor) Endpoints() []Endpoint {
+	f := s.current()
+	if f == nil {
+		return nil
+	}
+	return f.Endpoints()
+}
+
+// WatchIdle calls onIdle when none of the endpoints has had an open or new connection for timeout, and returns.
+// It returns without calling onIdle when ctx is cancelled. A zero timeout never expires.
+func (s *Supervisor) WatchIdle(ctx context.Context, timeout time.Duration, onIdle func(idle time.Duration)) {
+	if timeout <= 0 {
+		return
+	}
+
+	startedAt := time.Now()
+	ticker := time.NewTicker(min(timeout/10, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if idle := time.Since(lastActivity(s.Endpoints(), startedAt)); idle >= timeout {
+			onIdle(idle)
+			return
+		}
+	}
+}
+
+// WatchMaxSession calls onExpired when the tunnel has been up for maxSession, unless ctx is cancelled first.
+// A zero maxSession never expires.
+func WatchMaxSession(ctx context.Context, maxSession time.Duration, onExpired func()) {
+	if maxSession <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(maxSession)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		onExpired()
+	}
+}
+
+// lastActivity returns when the endpoints were used last, now if a connection is open
+func lastActivity(endpoints []Endpoint, since time.Time) time.Time {
+	last := since
+	for _, e := range endpoints {
+		if e.ActiveConnections > 0 {
+			return time.Now()
+		}
+		if e.LastActivity.After(last) {
+			last = e.LastActivity
+		}
+	}
+	return last
+}
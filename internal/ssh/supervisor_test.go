@@ -0,0 +1,179 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automationd/atun/internal/config"
+)
+
+func TestSupervisorReconnects(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	// Keep the router connections around to drop them like a timed out SSM session would
+	var mu sync.Mutex
+	var conns []net.Conn
+	routerDial := router.dialer()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		conn, err := routerDial(ctx)
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	}
+
+	hosts := []config.Endpoint{{Name: "127.0.0.1", Proto: config.ProtoSSM, Remote: remotePort, Local: localPort}}
+	clientConfig := testClientConfig(t)
+
+	var states []TunnelState
+	supervisor := NewSupervisor(func() *Forwarder {
+		return NewForwarder(dial, clientConfig, hosts, WithKeepalive(time.Second, 3))
+	}, ReconnectPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}, func(state TunnelState, err error) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := supervisor.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- supervisor.Run(ctx)
+	}()
+
+	mu.Lock()
+	_ = conns[0].Close()
+	mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, reconnects := supervisor.State()
+		if state == TunnelStateConnected && reconnects == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel didn't reconnect: state %s, reconnects %d", state, reconnects)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial local port after reconnect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []TunnelState{TunnelStateConnected, TunnelStateReconnecting, TunnelStateConnected, TunnelStateStopped}
+	if len(states) != len(want) {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states %v, want %v", states, want)
+		}
+	}
+}
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	policy := ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	backoff := policy.InitialBackoff
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		backoff = policy.next(backoff)
+		got = append(got, backoff)
+	}
+
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("backoff %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSupervisorWatchIdle(t *testing.T) {
+	router := newTestRouter(t)
+	remotePort := startEchoServer(t)
+	localPort := freePort(t)
+
+	hosts := []config.Endpoint{{Name: "127.0.0.1", Proto: config.ProtoSSM, Remote: remotePort, Local: localPort}}
+	clientConfig := testClientConfig(t)
+
+	supervisor := NewSupervisor(func() *Forwarder {
+		return NewForwarder(router.dialer(), clientConfig, hosts)
+	}, DefaultReconnectPolicy, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := supervisor.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	go func() {
+		_ = supervisor.Run(ctx)
+	}()
+
+	idle := make(chan time.Duration, 1)
+	go supervisor.WatchIdle(ctx, 200*time.Millisecond, func(d time.Duration) {
+		idle <- d
+	})
+
+	// An open connection keeps the tunnel up, however long it's quiet
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forwarded port: %v", err)
+	}
+
+	select {
+	case d := <-idle:
+		t.Fatalf("tunnel with an open connection reported idle after %v", d)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	_ = conn.Close()
+
+	select {
+	case d := <-idle:
+		if d < 200*time.Millisecond {
+			t.Errorf("idle after %v, want at least 200ms", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel without connections wasn't reported idle")
+	}
+}
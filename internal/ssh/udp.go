@@ -0,0 +1,414 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+	ssh2 "golang.org/x/crypto/ssh"
+)
+
+const (
+	// udpFlowIdleTimeout is how long a client flow is kept without datagrams in either direction
+	udpFlowIdleTimeout = 2 * time.Minute
+	// maxDatagramSize is the largest datagram the 2-byte length framing can carry
+	maxDatagramSize = 65535
+)
+
+// udpRelayCheckCommand fails on routers that can't run the relay script
+const udpRelayCheckCommand = "command -v python3"
+
+// errNoRelayInterpreter is returned for UDP endpoints of routers without python3
+var errNoRelayInterpreter = errors.New("UDP forwarding needs python3 on the router to relay datagrams, but it's not installed")
+
+// udpRelayScript runs on the router. It sends datagrams framed on stdin (2-byte big-endian length + payload)
+// to the remote host and frames the replies to stdout. It must not contain single quotes (see udpRelayCommand).
+const udpRelayScript = `import os, socket, struct, sys, threading
+ai = socket.getaddrinfo(sys.argv[1], int(sys.argv[2]), 0, socket.SOCK_DGRAM)[0]
+s = socket.socket(ai[0], socket.SOCK_DGRAM)
+s.connect(ai[4])
+i, o = sys.stdin.buffer, sys.stdout.buffer
+def up():
+    while True:
+        h = i.read(2)
+        if len(h) < 2:
+            os._exit(0)
+        n = struct.unpack(">H", h)[0]
+        d = i.read(n)
+        if len(d) < n:
+            os._exit(0)
+        try:
+            s.send(d)
+        except OSError:
+            pass
+threading.Thread(target=up, daemon=True).start()
+while True:
+    try:
+        d = s.recv(65535)
+    except OSError:
+        continue
+    o.write(struct.pack(">H", len(d)) + d)
+    o.flush()
+`
+
+// udpRelayHost matches the hostnames and IP addresses the relay is started for. The host is passed to the shell of
+// the router, so nothing else is let through.
+var udpRelayHost = regexp.MustCompile(`^[A-Za-z0-9.:-]+$`)
+
+// udpRelayCommand returns the command that starts the relay for host:port on the router
+func udpRelayCommand(host string, port int) (string, error) {
+	if !udpRelayHost.MatchString(host) || strings.HasPrefix(host, "-") {
+		return "", fmt.Errorf("invalid UDP host %q", host)
+	}
+	return fmt.Sprintf("python3 -u -c '%s' %s %d", udpRelayScript, host, port), nil
+}
+
+// checkUDPRelay checks that the router can run the relay script
+func checkUDPRelay(client *ssh2.Client) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := session.Run(udpRelayCheckCommand); err != nil {
+		var exitErr *ssh2.ExitError
+		if errors.As(err, &exitErr) {
+			return errNoRelayInterpreter
+		}
+		return fmt.Errorf("can't check for python3 on the router: %w", err)
+	}
+
+	return nil
+}
+
+// writeDatagram frames a datagram for the relay
+func writeDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(datagram))
+	}
+
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a single framed datagram from the relay
+func readDatagram(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, datagram); err != nil {
+		return nil, err
+	}
+
+	return datagram, nil
+}
+
+// udpFlow is the relay session serving a single local client address
+type udpFlow struct {
+	session *ssh2.Session
+	stdin   io.WriteCloser
+	metrics *endpointMetrics
+	once    sync.Once
+
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+func (fl *udpFlow) touch() {
+	fl.mu.Lock()
+	fl.lastActive = time.Now()
+	fl.mu.Unlock()
+}
+
+func (fl *udpFlow) idleSince() time.Duration {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return time.Since(fl.lastActive)
+}
+
+// close is called by the reply loop, expiry and shutdown, the flow is counted as closed once
+func (fl *udpFlow) close() {
+	fl.once.Do(fl.metrics.closed)
+	_ = fl.stdin.Close()
+	_ = fl.session.Close()
+}
+
+// udpForwarder relays datagrams received on a local UDP socket to the endpoint, one relay session per client
+type udpForwarder struct {
+	f        *Forwarder
+	endpoint Endpoint
+	metrics  *endpointMetrics
+	conn     net.PacketConn
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+	// starting holds the clients whose relay session is being started
+	starting map[string]bool
+	// closed is set on shutdown, relay sessions started afterwards are closed right away
+	closed bool
+
+	// relayMu is held across the python3 check, so concurrent first clients check the router once
+	relayMu sync.Mutex
+	// relayChecked is set once the router is known to be able to run the relay
+	relayChecked bool
+}
+
+// serveUDP accepts datagrams for the endpoint with the given index
+func (f *Forwarder) serveUDP(conn net.PacketConn, index int) {
+	f.mu.Lock()
+	endpoint := f.endpoints[index]
+	f.mu.Unlock()
+
+	u := &udpForwarder{
+		f:        f,
+		endpoint: endpoint,
+		metrics:  f.metrics[index],
+		conn:     conn,
+		flows:    make(map[string]*udpFlow),
+		starting: make(map[string]bool),
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go u.expireFlows(done)
+	defer u.closeFlows()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			f.mu.Lock()
+			f.endpoints[index].Status = false
+			f.mu.Unlock()
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Debug("Stopped receiving datagrams", "local", conn.LocalAddr(), "error", err)
+			}
+			return
+		}
+
+		key := addr.String()
+
+		u.mu.Lock()
+		flow, ok := u.flows[key]
+		starting := u.starting[key]
+		if !ok && !starting {
+			u.starting[key] = true
+		}
+		u.mu.Unlock()
+
+		switch {
+		case ok:
+			u.send(key, flow, buf[:n])
+		case starting:
+			// The relay of the client isn't ready yet, the datagram is lost the same way as on a congested link
+			logger.Debug("Dropping datagram, UDP relay is starting", "client", key)
+		default:
+			// Starting a relay takes several round trips to the router, datagrams of other clients keep flowing meanwhile
+			go u.startFlow(addr, append([]byte(nil), buf[:n]...))
+		}
+	}
+}
+
+// send passes a datagram of the client to its relay
+func (u *udpForwarder) send(key string, flow *udpFlow, datagram []byte) {
+	flow.touch()
+	u.metrics.received(len(datagram))
+	if err := writeDatagram(flow.stdin, datagram); err != nil {
+		logger.Debug("Can't send datagram to relay", "client", key, "error", err)
+		u.dropFlow(key, flow)
+	}
+}
+
+// startFlow starts the relay session of the client and sends it the first datagram of the client
+func (u *udpForwarder) startFlow(addr net.Addr, datagram []byte) {
+	key := addr.String()
+	remote := net.JoinHostPort(u.endpoint.RemoteHost, strconv.Itoa(u.endpoint.RemotePort))
+
+	flow, stdout, err := u.newFlow()
+
+	u.mu.Lock()
+	delete(u.starting, key)
+	closed := u.closed
+	if err == nil && !closed {
+		u.flows[key] = flow
+	}
+	u.mu.Unlock()
+
+	if err != nil {
+		logger.Debug("Can't start UDP relay", "remote", remote, "error", err)
+		return
+	}
+	if closed {
+		flow.close()
+		return
+	}
+
+	logger.Debug("UDP flow started", "client", key, "remote", remote)
+
+	go u.replies(addr, flow, stdout)
+	u.send(key, flow, datagram)
+}
+
+// newFlow starts a relay session on the router
+func (u *udpForwarder) newFlow() (*udpFlow, io.Reader, error) {
+	client, err := u.f.routerClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := u.checkRelay(client); err != nil {
+		return nil, nil, err
+	}
+
+	command, err := udpRelayCommand(u.endpoint.RemoteHost, u.endpoint.RemotePort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, nil, err
+	}
+
+	if err := session.Start(command); err != nil {
+		_ = session.Close()
+		return nil, nil, err
+	}
+
+	u.metrics.opened()
+
+	return &udpFlow{session: session, stdin: stdin, metrics: u.metrics, lastActive: time.Now()}, stdout, nil
+}
+
+// checkRelay checks the router for python3 before the first relay session. Without it the endpoint can't work,
+// so it's stopped instead of dropping every datagram.
+func (u *udpForwarder) checkRelay(client *ssh2.Client) error {
+	u.relayMu.Lock()
+	defer u.relayMu.Unlock()
+
+	if u.relayChecked {
+		return nil
+	}
+
+	err := checkUDPRelay(client)
+	if errors.Is(err, errNoRelayInterpreter) {
+		logger.Error("Stopping UDP endpoint", "local", u.conn.LocalAddr(), "remote", net.JoinHostPort(u.endpoint.RemoteHost, strconv.Itoa(u.endpoint.RemotePort)), "error", err)
+		_ = u.conn.Close()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	u.relayChecked = true
+
+	return nil
+}
+
+// replies sends datagrams coming back from the relay to the client
+func (u *udpForwarder) replies(addr net.Addr, flow *udpFlow, stdout io.Reader) {
+	defer u.dropFlow(addr.String(), flow)
+
+	for {
+		datagram, err := readDatagram(stdout)
+		if err != nil {
+			return
+		}
+
+		flow.touch()
+		n, err := u.conn.WriteTo(datagram, addr)
+		u.metrics.sent(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dropFlow closes the flow and forgets it, unless it has been replaced already
+func (u *udpForwarder) dropFlow(key string, flow *udpFlow) {
+	u.mu.Lock()
+	if u.flows[key] == flow {
+		delete(u.flows, key)
+	}
+	u.mu.Unlock()
+
+	flow.close()
+}
+
+// expireFlows closes flows that have been idle for longer than udpFlowIdleTimeout
+func (u *udpForwarder) expireFlows(done <-chan struct{}) {
+	ticker := time.NewTicker(udpFlowIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		u.mu.Lock()
+		var idle []string
+		for key, flow := range u.flows {
+			if flow.idleSince() > udpFlowIdleTimeout {
+				idle = append(idle, key)
+			}
+		}
+		u.mu.Unlock()
+
+		for _, key := range idle {
+			u.mu.Lock()
+			flow := u.flows[key]
+			u.mu.Unlock()
+			if flow != nil {
+				logger.Debug("UDP flow expired", "client", key)
+				u.dropFlow(key, flow)
+			}
+		}
+	}
+}
+
+func (u *udpForwarder) closeFlows() {
+	u.mu.Lock()
+	flows := u.flows
+	u.flows = make(map[string]*udpFlow)
+	u.closed = true
+	u.mu.Unlock()
+
+	for _, flow := range flows {
+		flow.close()
+	}
+}
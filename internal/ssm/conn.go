@@ -0,0 +1,661 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/automationd/atun/internal/logger"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clientVersion is reported to the agent during the handshake. Agents switch port sessions to
+	// multiplexed mode for clients newer than 1.1.70, so we stay below that and use one stream per session.
+	clientVersion = "1.1.61.0"
+
+	// streamDataPayloadSize is the max payload size of a single input_stream_data message
+	streamDataPayloadSize = 1024
+
+	// maxUnackedMessages bounds the outgoing window. Writes block when it's full.
+	maxUnackedMessages = 1000
+
+	resendCheckInterval = 100 * time.Millisecond
+	resendTimeout       = time.Second
+	maxResendAttempts   = 300
+
+	handshakeTimeout = 30 * time.Second
+	pingInterval     = 5 * time.Minute
+
+	// acknowledgeFlags is what the session-manager-plugin sets on acknowledge messages
+	acknowledgeFlags = 3
+)
+
+// ErrConnectToPort is returned when the agent can't connect to the requested port on the target
+var ErrConnectToPort = errors.New("agent failed to connect to the remote port")
+
+// openDataChannelInput is the first (text) message sent over the websocket to authenticate the data channel
+type openDataChannelInput struct {
+	MessageSchemaVersion string `json:"MessageSchemaVersion"`
+	RequestID            string `json:"RequestId"`
+	TokenValue           string `json:"TokenValue"`
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string `json:"ClientVersion"`
+}
+
+type acknowledgeContent struct {
+	AcknowledgedMessageType           string `json:"AcknowledgedMessageType"`
+	AcknowledgedMessageID             string `json:"AcknowledgedMessageId"`
+	AcknowledgedMessageSequenceNumber int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage               bool   `json:"IsSequentialMessage"`
+}
+
+type handshakeRequest struct {
+	AgentVersion           string                  `json:"AgentVersion"`
+	RequestedClientActions []requestedClientAction `json:"RequestedClientActions"`
+}
+
+type requestedClientAction struct {
+	ActionType       string          `json:"ActionType"`
+	ActionParameters json.RawMessage `json:"ActionParameters"`
+}
+
+type handshakeResponse struct {
+	ClientVersion          string                  `json:"ClientVersion"`
+	ProcessedClientActions []processedClientAction `json:"ProcessedClientActions"`
+	Errors                 []string                `json:"Errors"`
+}
+
+type processedClientAction struct {
+	ActionType   string `json:"ActionType"`
+	ActionStatus int    `json:"ActionStatus"`
+	Error        string `json:"Error,omitempty"`
+}
+
+const (
+	actionStatusSuccess     = 1
+	actionStatusUnsupported = 3
+)
+
+type outgoingMessage struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// Addr is the net.Addr of an SSM data channel
+type Addr struct {
+	SessionID string
+	Target    string
+}
+
+func (a Addr) Network() string { return "ssm" }
+func (a Addr) String() string  { return fmt.Sprintf("%s/%s", a.Target, a.SessionID) }
+
+// Conn is a Session Manager data channel exposed as a net.Conn.
+// It handles the handshake, sequencing, acknowledgements, retransmission and flow control.
+type Conn struct {
+	ws     *websocket.Conn
+	wsMu   sync.Mutex // serializes websocket writes
+	local  Addr
+	remote Addr
+
+	// onClose is called once when the connection is closed (e.g. to terminate the session via API)
+	onClose func() error
+
+	writeMu sync.Mutex // keeps chunks of a single Write in sequence
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	readBuf          bytes.Buffer
+	readErr          error
+	expectedSequence int64
+	pendingIncoming  map[int64]*clientMessage
+	outSequence      int64
+	unacked          map[int64]*outgoingMessage
+	paused           bool
+	closed           bool
+	handshakeDone    bool
+	handshakeErr     error
+	agentVersion     string
+	readDeadline     time.Time
+	writeDeadline    time.Time
+
+	done chan struct{}
+}
+
+// Open connects to a data channel stream URL, authenticates with the token and completes the handshake
+func Open(ctx context.Context, streamURL, tokenValue string, remote Addr) (*Conn, error) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to data channel: %w", err)
+	}
+
+	c := &Conn{
+		ws:              ws,
+		local:           Addr{SessionID: remote.SessionID, Target: "local"},
+		remote:          remote,
+		pendingIncoming: map[int64]*clientMessage{},
+		unacked:         map[int64]*outgoingMessage{},
+		done:            make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	openInput, err := json.Marshal(openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestID:            uuid.NewString(),
+		TokenValue:           tokenValue,
+		ClientID:             uuid.NewString(),
+		ClientVersion:        clientVersion,
+	})
+	if err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+
+	if err := c.writeWS(websocket.TextMessage, openInput); err != nil {
+		_ = ws.Close()
+		return nil, fmt.Errorf("can't open data channel: %w", err)
+	}
+
+	go c.readLoop()
+	go c.resendLoop()
+	go c.pingLoop()
+
+	if err := c.waitHandshake(ctx); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	logger.Debug("SSM data channel is ready", "session", remote.SessionID, "target", remote.Target, "agentVersion", c.agentVersion)
+
+	return c, nil
+}
+
+// waitHandshake blocks until the agent completes the handshake, the context is done or the timeout is hit
+func (c *Conn) waitHandshake(ctx context.Context) error {
+	timer := time.AfterFunc(handshakeTimeout, func() {
+		c.mu.Lock()
+		if !c.handshakeDone && c.handshakeErr == nil {
+			c.handshakeErr = errors.New("timed out waiting for the SSM handshake")
+		}
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		if !c.handshakeDone && c.handshakeErr == nil {
+			c.handshakeErr = ctx.Err()
+		}
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.handshakeDone && c.handshakeErr == nil && c.readErr == nil {
+		c.cond.Wait()
+	}
+
+	if c.handshakeDone {
+		return nil
+	}
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	return fmt.Errorf("data channel closed during handshake: %w", c.readErr)
+}
+
+// Read reads stream output sent by the agent
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if err := c.waitLocked(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.readBuf.Read(p)
+}
+
+// Write sends p to the agent as a sequence of input_stream_data messages
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), streamDataPayloadSize)
+		if err := c.sendStreamData(PayloadTypeOutput, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close terminates the session and closes the websocket
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	sendTerminate := c.handshakeDone && c.readErr == nil
+	c.closed = true
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	close(c.done)
+
+	// Let the agent know we're done. It's best-effort: the session is terminated via API below anyway.
+	if sendTerminate {
+		flag := make([]byte, 4)
+		binary.BigEndian.PutUint32(flag, uint32(FlagTerminateSession))
+		c.mu.Lock()
+		sequence := c.outSequence
+		c.outSequence++
+		c.mu.Unlock()
+		if data, err := newClientMessage(MessageTypeInputStreamData, sequence, 0, PayloadTypeFlag, flag).marshal(); err == nil {
+			_ = c.writeWS(websocket.BinaryMessage, data)
+		}
+	}
+
+	var err error
+	if c.onClose != nil {
+		err = c.onClose()
+	}
+
+	_ = c.writeWS(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if closeErr := c.ws.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets both read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return nil
+}
+
+// AgentVersion returns the SSM agent version reported during the handshake
+func (c *Conn) AgentVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.agentVersion
+}
+
+// waitLocked waits on the condition variable honoring a deadline. c.mu must be held.
+func (c *Conn) waitLocked(deadline time.Time) error {
+	if deadline.IsZero() {
+		c.cond.Wait()
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.AfterFunc(d, c.cond.Broadcast)
+	c.cond.Wait()
+	timer.Stop()
+
+	if !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// sendStreamData sends a sequenced input_stream_data message, respecting flow control
+func (c *Conn) sendStreamData(payloadType PayloadType, payload []byte) error {
+	c.mu.Lock()
+	for c.paused || len(c.unacked) >= maxUnackedMessages {
+		if c.closed {
+			c.mu.Unlock()
+			return net.ErrClosed
+		}
+		if c.readErr != nil {
+			err := c.readErr
+			c.mu.Unlock()
+			return err
+		}
+		if err := c.waitLocked(c.writeDeadline); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+
+	sequence := c.outSequence
+	c.outSequence++
+
+	data, err := newClientMessage(MessageTypeInputStreamData, sequence, 0, payloadType, payload).marshal()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	c.unacked[sequence] = &outgoingMessage{data: data, sentAt: time.Now(), attempts: 1}
+	c.mu.Unlock()
+
+	return c.writeWS(websocket.BinaryMessage, data)
+}
+
+func (c *Conn) writeWS(messageType int, data []byte) error {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	return c.ws.WriteMessage(messageType, data)
+}
+
+// fail stops the connection with an error visible to readers and writers
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *Conn) readLoop() {
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				c.fail(io.EOF)
+			} else {
+				c.fail(fmt.Errorf("data channel read failed: %w", err))
+			}
+			return
+		}
+
+		if messageType != websocket.BinaryMessage {
+			logger.Debug("Ignoring non-binary data channel message", "type", messageType)
+			continue
+		}
+
+		m, err := unmarshalClientMessage(data)
+		if err != nil {
+			logger.Debug("Ignoring malformed data channel message", "error", err)
+			continue
+		}
+
+		if err := c.handleMessage(m); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) handleMessage(m *clientMessage) error {
+	switch m.MessageType {
+	case MessageTypeOutputStreamData:
+		if err := c.acknowledge(m); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		if m.SequenceNumber < c.expectedSequence {
+			// Duplicate of a message we already processed (our ack got lost)
+			c.mu.Unlock()
+			return nil
+		}
+		c.pendingIncoming[m.SequenceNumber] = m
+
+		var ready []*clientMessage
+		for {
+			next, ok := c.pendingIncoming[c.expectedSequence]
+			if !ok {
+				break
+			}
+			delete(c.pendingIncoming, c.expectedSequence)
+			c.expectedSequence++
+			ready = append(ready, next)
+		}
+		c.mu.Unlock()
+
+		for _, r := range ready {
+			if err := c.processStreamData(r); err != nil {
+				return err
+			}
+		}
+	case MessageTypeAcknowledge:
+		var ack acknowledgeContent
+		if err := json.Unmarshal(m.Payload, &ack); err != nil {
+			logger.Debug("Ignoring malformed acknowledge", "error", err)
+			return nil
+		}
+		c.mu.Lock()
+		delete(c.unacked, ack.AcknowledgedMessageSequenceNumber)
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	case MessageTypePausePublication:
+		c.mu.Lock()
+		c.paused = true
+		c.mu.Unlock()
+	case MessageTypeStartPublication:
+		c.mu.Lock()
+		c.paused = false
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	case MessageTypeChannelClosed:
+		logger.Debug("Data channel closed by the agent", "session", c.remote.SessionID, "payload", string(m.Payload))
+		return io.EOF
+	default:
+		logger.Debug("Ignoring unknown data channel message", "type", m.MessageType)
+	}
+
+	return nil
+}
+
+func (c *Conn) processStreamData(m *clientMessage) error {
+	switch m.PayloadType {
+	case PayloadTypeOutput:
+		c.mu.Lock()
+		c.readBuf.Write(m.Payload)
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	case PayloadTypeHandshakeRequest:
+		return c.respondToHandshake(m.Payload)
+	case PayloadTypeHandshakeComplete:
+		c.mu.Lock()
+		c.handshakeDone = true
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	case PayloadTypeFlag:
+		if len(m.Payload) >= 4 && PayloadFlag(binary.BigEndian.Uint32(m.Payload)) == FlagConnectToPortError {
+			return ErrConnectToPort
+		}
+	case PayloadTypeError, PayloadTypeStdErr:
+		logger.Debug("SSM agent reported an error", "session", c.remote.SessionID, "output", string(m.Payload))
+	default:
+		logger.Debug("Ignoring stream data payload", "payloadType", m.PayloadType)
+	}
+
+	return nil
+}
+
+func (c *Conn) respondToHandshake(payload []byte) error {
+	var request handshakeRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("can't parse handshake request: %w", err)
+	}
+
+	c.mu.Lock()
+	c.agentVersion = request.AgentVersion
+	c.mu.Unlock()
+
+	response := handshakeResponse{
+		ClientVersion: clientVersion,
+		Errors:        []string{},
+	}
+
+	for _, action := range request.RequestedClientActions {
+		switch action.ActionType {
+		case "SessionType":
+			response.ProcessedClientActions = append(response.ProcessedClientActions, processedClientAction{
+				ActionType:   action.ActionType,
+				ActionStatus: actionStatusSuccess,
+			})
+		default:
+			// KMS encryption isn't implemented, the agent will refuse the session if it requires it
+			response.ProcessedClientActions = append(response.ProcessedClientActions, processedClientAction{
+				ActionType:   action.ActionType,
+				ActionStatus: actionStatusUnsupported,
+				Error:        fmt.Sprintf("%s is not supported by atun", action.ActionType),
+			})
+			response.Errors = append(response.Errors, fmt.Sprintf("%s is not supported by atun", action.ActionType))
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// The handshake response is sent from the read loop, so it must not block on flow control
+	c.mu.Lock()
+	sequence := c.outSequence
+	c.outSequence++
+	msg, err := newClientMessage(MessageTypeInputStreamData, sequence, 0, PayloadTypeHandshakeResponse, data).marshal()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.unacked[sequence] = &outgoingMessage{data: msg, sentAt: time.Now(), attempts: 1}
+	c.mu.Unlock()
+
+	return c.writeWS(websocket.BinaryMessage, msg)
+}
+
+func (c *Conn) acknowledge(m *clientMessage) error {
+	payload, err := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageID:             m.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := newClientMessage(MessageTypeAcknowledge, 0, acknowledgeFlags, 0, payload).marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.writeWS(websocket.BinaryMessage, data)
+}
+
+// resendLoop retransmits messages that weren't acknowledged in time
+func (c *Conn) resendLoop() {
+	ticker := time.NewTicker(resendCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		var resend [][]byte
+		c.mu.Lock()
+		for sequence, m := range c.unacked {
+			if time.Since(m.sentAt) < resendTimeout {
+				continue
+			}
+			if m.attempts >= maxResendAttempts {
+				c.mu.Unlock()
+				c.fail(fmt.Errorf("message %d wasn't acknowledged after %d attempts", sequence, m.attempts))
+				return
+			}
+			m.attempts++
+			m.sentAt = time.Now()
+			resend = append(resend, m.data)
+		}
+		c.mu.Unlock()
+
+		for _, data := range resend {
+			if err := c.writeWS(websocket.BinaryMessage, data); err != nil {
+				c.fail(fmt.Errorf("data channel write failed: %w", err))
+				return
+			}
+		}
+	}
+}
+
+// pingLoop keeps the websocket alive through idle periods
+func (c *Conn) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeWS(websocket.PingMessage, []byte("keepalive")); err != nil {
+				logger.Debug("Data channel ping failed", "error", err)
+			}
+		}
+	}
+}
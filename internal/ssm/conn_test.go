@@ -0,0 +1,232 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeAgent is a minimal stand-in for the SSM agent side of a data channel.
+// It performs the handshake and echoes stream data back, optionally swapping the order of output messages.
+type fakeAgent struct {
+	t            *testing.T
+	token        string
+	swapOutput   bool
+	mu           sync.Mutex
+	ws           *websocket.Conn
+	outSequence  int64
+	gotTerminate chan struct{}
+}
+
+func (a *fakeAgent) send(m *clientMessage) {
+	data, err := m.marshal()
+	if err != nil {
+		a.t.Errorf("marshal: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_ = a.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (a *fakeAgent) nextOutput(payloadType PayloadType, payload []byte) *clientMessage {
+	m := newClientMessage(MessageTypeOutputStreamData, a.outSequence, 0, payloadType, payload)
+	a.outSequence++
+	return m
+}
+
+func (a *fakeAgent) ack(m *clientMessage) {
+	payload, _ := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageID:             m.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	a.send(newClientMessage(MessageTypeAcknowledge, 0, acknowledgeFlags, 0, payload))
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		a.t.Errorf("upgrade: %v", err)
+		return
+	}
+	defer ws.Close()
+	a.ws = ws
+
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		a.t.Errorf("read open message: %v", err)
+		return
+	}
+	var open openDataChannelInput
+	if err := json.Unmarshal(data, &open); err != nil || open.TokenValue != a.token {
+		a.t.Errorf("unexpected open message %q: %v", data, err)
+		return
+	}
+
+	request, _ := json.Marshal(handshakeRequest{
+		AgentVersion: "3.3.0.0",
+		RequestedClientActions: []requestedClientAction{
+			{ActionType: "SessionType", ActionParameters: json.RawMessage(`{"SessionType":"Port"}`)},
+		},
+	})
+	a.send(a.nextOutput(PayloadTypeHandshakeRequest, request))
+
+	var held *clientMessage
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		m, err := unmarshalClientMessage(data)
+		if err != nil {
+			a.t.Errorf("unmarshal: %v", err)
+			return
+		}
+		if m.MessageType != MessageTypeInputStreamData {
+			continue
+		}
+		a.ack(m)
+
+		switch m.PayloadType {
+		case PayloadTypeHandshakeResponse:
+			var response handshakeResponse
+			if err := json.Unmarshal(m.Payload, &response); err != nil || len(response.ProcessedClientActions) != 1 {
+				a.t.Errorf("unexpected handshake response %s: %v", m.Payload, err)
+			}
+			a.send(a.nextOutput(PayloadTypeHandshakeComplete, []byte(`{}`)))
+		case PayloadTypeOutput:
+			out := a.nextOutput(PayloadTypeOutput, m.Payload)
+			if !a.swapOutput {
+				a.send(out)
+				continue
+			}
+			if held == nil {
+				held = out
+				continue
+			}
+			a.send(out)
+			a.send(held)
+			held = nil
+		case PayloadTypeFlag:
+			close(a.gotTerminate)
+		}
+	}
+}
+
+func dialFakeAgent(t *testing.T, agent *fakeAgent) *Conn {
+	t.Helper()
+
+	server := httptest.NewServer(agent)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Open(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), agent.token, Addr{SessionID: "s-1", Target: "i-0123456789abcdef0"})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return conn
+}
+
+func TestConnEcho(t *testing.T) {
+	agent := &fakeAgent{t: t, token: "token", gotTerminate: make(chan struct{})}
+	conn := dialFakeAgent(t, agent)
+
+	if got := conn.AgentVersion(); got != "3.3.0.0" {
+		t.Errorf("AgentVersion() = %q", got)
+	}
+
+	// Bigger than a single stream data message to exercise chunking
+	want := strings.Repeat("0123456789", 500)
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("echo mismatch")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	select {
+	case <-agent.gotTerminate:
+	case <-time.After(5 * time.Second):
+		t.Errorf("agent didn't receive terminate flag")
+	}
+}
+
+func TestConnReordersOutput(t *testing.T) {
+	agent := &fakeAgent{t: t, token: "token", swapOutput: true, gotTerminate: make(chan struct{})}
+	conn := dialFakeAgent(t, agent)
+	defer conn.Close()
+
+	for _, chunk := range []string{"first-", "second"} {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got := make([]byte, len("first-second"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(got) != "first-second" {
+		t.Errorf("got %q, want messages delivered in sequence order", got)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	agent := &fakeAgent{t: t, token: "token", gotTerminate: make(chan struct{})}
+	conn := dialFakeAgent(t, agent)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := newClientMessage(MessageTypeInputStreamData, 42, 0, PayloadTypeOutput, []byte("payload"))
+	data, err := m.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	got, err := unmarshalClientMessage(data)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.MessageType != m.MessageType || got.SequenceNumber != 42 || got.MessageID != m.MessageID || string(got.Payload) != "payload" {
+		t.Errorf("round trip mismatch: %+v", got)
+	}
+
+	data[len(data)-1] ^= 0xff
+	if _, err := unmarshalClientMessage(data); err == nil {
+		t.Errorf("expected digest mismatch error")
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message types used by the Session Manager data channel
+const (
+	MessageTypeInputStreamData  = "input_stream_data"
+	MessageTypeOutputStreamData = "output_stream_data"
+	MessageTypeAcknowledge      = "acknowledge"
+	MessageTypeChannelClosed    = "channel_closed"
+	MessageTypeStartPublication = "start_publication"
+	MessageTypePausePublication = "pause_publication"
+)
+
+// PayloadType describes the content of a stream data message
+type PayloadType uint32
+
+const (
+	PayloadTypeOutput               PayloadType = 1
+	PayloadTypeError                PayloadType = 2
+	PayloadTypeSize                 PayloadType = 3
+	PayloadTypeParameter            PayloadType = 4
+	PayloadTypeHandshakeRequest     PayloadType = 5
+	PayloadTypeHandshakeResponse    PayloadType = 6
+	PayloadTypeHandshakeComplete    PayloadType = 7
+	PayloadTypeEncChallengeRequest  PayloadType = 8
+	PayloadTypeEncChallengeResponse PayloadType = 9
+	PayloadTypeFlag                 PayloadType = 10
+	PayloadTypeStdErr               PayloadType = 11
+	PayloadTypeExitCode             PayloadType = 12
+)
+
+// PayloadFlag is sent with PayloadTypeFlag messages to control port sessions
+type PayloadFlag uint32
+
+const (
+	FlagDisconnectToPort   PayloadFlag = 1
+	FlagTerminateSession   PayloadFlag = 2
+	FlagConnectToPortError PayloadFlag = 3
+)
+
+// Binary layout of a client message. All integers are big-endian.
+const (
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	messageTypeLength    = 32
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIDOffset      = 64
+	messageIDLength      = 16
+	payloadDigestOffset  = 80
+	payloadDigestLength  = 32
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+	payloadOffset        = 120
+
+	// headerLength is the value of the HeaderLength field. It doesn't include the payload length field.
+	headerLength = payloadLengthOffset
+
+	schemaVersion = 1
+)
+
+// clientMessage is a single frame exchanged over the data channel websocket
+type clientMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      uuid.UUID
+	PayloadType    PayloadType
+	Payload        []byte
+}
+
+// newClientMessage creates a message with a fresh ID and creation time
+func newClientMessage(messageType string, sequenceNumber int64, flags uint64, payloadType PayloadType, payload []byte) *clientMessage {
+	return &clientMessage{
+		MessageType:    messageType,
+		SchemaVersion:  schemaVersion,
+		CreatedDate:    uint64(time.Now().UnixMilli()),
+		SequenceNumber: sequenceNumber,
+		Flags:          flags,
+		MessageID:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+}
+
+// marshal serializes the message into the binary wire format
+func (m *clientMessage) marshal() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("message type %q is longer than %d bytes", m.MessageType, messageTypeLength)
+	}
+
+	buf := make([]byte, payloadOffset+len(m.Payload))
+
+	binary.BigEndian.PutUint32(buf[headerLengthOffset:], headerLength)
+
+	// Message type is right-padded with spaces
+	copy(buf[messageTypeOffset:messageTypeOffset+messageTypeLength], bytes.Repeat([]byte(" "), messageTypeLength))
+	copy(buf[messageTypeOffset:], m.MessageType)
+
+	binary.BigEndian.PutUint32(buf[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(buf[createdDateOffset:], m.CreatedDate)
+	binary.BigEndian.PutUint64(buf[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[flagsOffset:], m.Flags)
+	putUUID(buf[messageIDOffset:messageIDOffset+messageIDLength], m.MessageID)
+
+	digest := sha256.Sum256(m.Payload)
+	copy(buf[payloadDigestOffset:], digest[:])
+
+	binary.BigEndian.PutUint32(buf[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(buf[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(buf[payloadOffset:], m.Payload)
+
+	return buf, nil
+}
+
+// unmarshalClientMessage parses the binary wire format and validates the payload digest
+func unmarshalClientMessage(data []byte) (*clientMessage, error) {
+	if len(data) < payloadOffset {
+		return nil, fmt.Errorf("message is too short: %d bytes", len(data))
+	}
+
+	hl := binary.BigEndian.Uint32(data[headerLengthOffset:])
+	if hl != headerLength {
+		return nil, fmt.Errorf("unexpected header length %d", hl)
+	}
+
+	m := &clientMessage{
+		MessageType:    strings.TrimRight(string(bytes.TrimRight(data[messageTypeOffset:messageTypeOffset+messageTypeLength], "\x00")), " "),
+		SchemaVersion:  binary.BigEndian.Uint32(data[schemaVersionOffset:]),
+		CreatedDate:    binary.BigEndian.Uint64(data[createdDateOffset:]),
+		SequenceNumber: int64(binary.BigEndian.Uint64(data[sequenceNumberOffset:])),
+		Flags:          binary.BigEndian.Uint64(data[flagsOffset:]),
+		MessageID:      getUUID(data[messageIDOffset : messageIDOffset+messageIDLength]),
+		PayloadType:    PayloadType(binary.BigEndian.Uint32(data[payloadTypeOffset:])),
+	}
+
+	payloadLength := binary.BigEndian.Uint32(data[payloadLengthOffset:])
+	if int(payloadLength) != len(data)-payloadOffset {
+		return nil, fmt.Errorf("payload length %d doesn't match message size %d", payloadLength, len(data)-payloadOffset)
+	}
+
+	m.Payload = make([]byte, payloadLength)
+	copy(m.Payload, data[payloadOffset:])
+
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], data[payloadDigestOffset:payloadDigestOffset+payloadDigestLength]) {
+		return nil, errors.New("payload digest mismatch")
+	}
+
+	return m, nil
+}
+
+// putUUID writes the UUID the way Session Manager expects it: least significant 8 bytes first
+func putUUID(dst []byte, id uuid.UUID) {
+	copy(dst[0:8], id[8:16])
+	copy(dst[8:16], id[0:8])
+}
+
+// getUUID reverses putUUID
+func getUUID(src []byte) uuid.UUID {
+	var id uuid.UUID
+	copy(id[8:16], src[0:8])
+	copy(id[0:8], src[8:16])
+	return id
+}
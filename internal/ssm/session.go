@@ -0,0 +1,87 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package ssm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/automationd/atun/internal/logger"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	ssmsdk "github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	// DocumentSSHSession forwards the session to a port on the target itself (used for SSH)
+	DocumentSSHSession = "AWS-StartSSHSession"
+	// DocumentPortForwardingToRemoteHost forwards the session to a host reachable from the target (no SSH involved)
+	DocumentPortForwardingToRemoteHost = "AWS-StartPortForwardingSessionToRemoteHost"
+)
+
+// StartSession starts a Session Manager session via the SDK and opens its data channel.
+// Closing the returned Conn terminates the session.
+func StartSession(ctx context.Context, sess *session.Session, input *ssmsdk.StartSessionInput) (*Conn, error) {
+	client := ssmsdk.New(sess)
+
+	output, err := client.StartSessionWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("can't start SSM session to %s: %w", aws.StringValue(input.Target), err)
+	}
+
+	sessionID := aws.StringValue(output.SessionId)
+	logger.Debug("SSM session started", "session", sessionID, "target", aws.StringValue(input.Target), "document", aws.StringValue(input.DocumentName))
+
+	conn, err := Open(ctx, aws.StringValue(output.StreamUrl), aws.StringValue(output.TokenValue), Addr{
+		SessionID: sessionID,
+		Target:    aws.StringValue(input.Target),
+	})
+	if err != nil {
+		terminateSession(client, sessionID)
+		return nil, err
+	}
+
+	conn.onClose = func() error {
+		terminateSession(client, sessionID)
+		return nil
+	}
+
+	return conn, nil
+}
+
+// DialSSH opens a session to the SSH port of the target instance
+func DialSSH(ctx context.Context, sess *session.Session, target string, port int) (*Conn, error) {
+	return StartSession(ctx, sess, &ssmsdk.StartSessionInput{
+		Target:       aws.String(target),
+		DocumentName: aws.String(DocumentSSHSession),
+		Parameters: map[string][]*string{
+			"portNumber": {aws.String(strconv.Itoa(port))},
+		},
+	})
+}
+
+// DialRemoteHost opens a port-forwarding session to host:port through the target instance.
+// The session carries a single connection, so every local connection needs its own session.
+func DialRemoteHost(ctx context.Context, sess *session.Session, target, host string, port, localPort int) (*Conn, error) {
+	return StartSession(ctx, sess, &ssmsdk.StartSessionInput{
+		Target:       aws.String(target),
+		DocumentName: aws.String(DocumentPortForwardingToRemoteHost),
+		Parameters: map[string][]*string{
+			"host":            {aws.String(host)},
+			"portNumber":      {aws.String(strconv.Itoa(port))},
+			"localPortNumber": {aws.String(strconv.Itoa(localPort))},
+		},
+	})
+}
+
+func terminateSession(client *ssmsdk.SSM, sessionID string) {
+	if _, err := client.TerminateSession(&ssmsdk.TerminateSessionInput{SessionId: aws.String(sessionID)}); err != nil {
+		logger.Debug("Can't terminate SSM session", "session", sessionID, "error", err)
+		return
+	}
+	logger.Debug("SSM session terminated", "session", sessionID)
+}
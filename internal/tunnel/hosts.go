@@ -0,0 +1,112 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package tunnel
+
+import (
+	"fmt"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/hostsfile"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ssh"
+)
+
+// PlanHostsFile gives every remote hostname its own loopback alias and moves its endpoints there on their original
+// remote ports. Application configs with the real hostname and port (and TLS hostname verification) then work
+// unchanged. Endpoints with an explicit bind are left alone. Nothing is changed on the machine until WriteHostsFile,
+// so the tunnel can still be checked. Aliases of other tunnels in the hosts file and in taken (tunnels of the same
+// `atun up` that aren't written yet) are skipped.
+func PlanHostsFile(app *config.Atun, taken map[string]bool) ([]hostsfile.Entry, error) {
+	existing, written, err := hostsfile.Read(hostsfile.Path(), ssh.GetTunnelID(app))
+	if err != nil {
+		return nil, fmt.Errorf("can't read hosts file: %w", err)
+	}
+	for address := range taken {
+		written[address] = true
+	}
+
+	var hostnames []string
+	for _, host := range app.Config.Hosts {
+		if host.Bind == "" && hostsfile.IsHostname(host.Name) {
+			hostnames = append(hostnames, host.Name)
+		}
+	}
+
+	entries, err := hostsfile.Assign(hostnames, existing, written)
+	if err != nil {
+		return nil, err
+	}
+
+	applyHostsEntries(app, entries)
+
+	return entries, nil
+}
+
+// WriteHostsFile adds the loopback aliases planned by PlanHostsFile and maps the hostnames to them in the hosts file
+func WriteHostsFile(app *config.Atun, entries []hostsfile.Entry) error {
+	for _, e := range entries {
+		if err := hostsfile.AddLoopbackAlias(e.Address); err != nil {
+			return err
+		}
+	}
+
+	return hostsfile.Apply(hostsfile.Path(), ssh.GetTunnelID(app), entries)
+}
+
+// LoadHostsFile moves the endpoints to the loopback aliases the tunnel got from WriteHostsFile, if any.
+// Commands other than `atun up` use it to find the endpoints where the tunnel listens.
+func LoadHostsFile(app *config.Atun) {
+	entries, _, err := hostsfile.Read(hostsfile.Path(), ssh.GetTunnelID(app))
+	if err != nil {
+		logger.Debug("Can't read hosts file", "error", err)
+		return
+	}
+
+	applyHostsEntries(app, entries)
+}
+
+// newDaemonSpec returns the spec of the tunnel with the hosts file block written for it by WriteHostsFile, so the
+// daemon rolls the block back however the tunnel stops
+func newDaemonSpec(app *config.Atun) ssh.TunnelSpec {
+	spec := ssh.NewTunnelSpec(app)
+
+	entries, _, err := hostsfile.Read(hostsfile.Path(), spec.ID)
+	if err != nil {
+		logger.Debug("Can't read hosts file", "error", err)
+		return spec
+	}
+	if len(entries) > 0 {
+		spec.HostsFile = hostsfile.Path()
+		spec.HostsEntries = entries
+	}
+
+	return spec
+}
+
+// RemoveHostsFile rolls back the hosts file block and the loopback aliases of the tunnel.
+// Returns false if there was nothing to roll back.
+func RemoveHostsFile(app *config.Atun) (bool, error) {
+	entries, err := hostsfile.Rollback(hostsfile.Path(), ssh.GetTunnelID(app))
+	return len(entries) > 0, err
+}
+
+// applyHostsEntries binds the endpoints of mapped hostnames to their alias on the remote port
+func applyHostsEntries(app *config.Atun, entries []hostsfile.Entry) {
+	addresses := make(map[string]string, len(entries))
+	for _, e := range entries {
+		addresses[e.Hostname] = e.Address
+	}
+
+	for i, host := range app.Config.Hosts {
+		address, ok := addresses[host.Name]
+		if !ok || host.Bind != "" {
+			continue
+		}
+
+		app.Config.Hosts[i].Bind = address
+		app.Config.Hosts[i].Local = host.Remote
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ports"
+)
+
+// GetPortKey identifies the endpoint in the port registry
+func GetPortKey(app *config.Atun, host config.Endpoint) ports.Key {
+	return ports.Key{Profile: app.Config.AWSProfile, Env: app.Config.Env, Host: host.Name, Remote: host.Remote}
+}
+
+// LookupLocalPorts gives the endpoints the local ports assigned to them by AssignLocalPorts. The registry isn't changed,
+// commands other than `atun up` use it to find the ports of a tunnel.
+func LookupLocalPorts(app *config.Atun, hosts []config.Endpoint) error {
+	registry, err := ports.Load(ports.GetRegistryPath(app.Config.AppDir))
+	if err != nil {
+		return err
+	}
+
+	for i, host := range hosts {
+		if host.IsUnixSocket() {
+			continue
+		}
+		hosts[i].Local = registry.Lookup(GetPortKey(app, host), host.Local)
+	}
+
+	return nil
+}
+
+// AssignLocalPorts gives the endpoints their local ports from the port registry: pinned ports win over the ones
+// configured on the router, and endpoints without a port (local = 0) keep the port they got the first time.
+// Endpoints listening on a Unix socket don't need a port. The assignments are recorded, so only `atun up` calls it.
+func AssignLocalPorts(app *config.Atun, hosts []config.Endpoint) error {
+	return ports.Update(ports.GetRegistryPath(app.Config.AppDir), func(registry *ports.Registry) error {
+		for i, host := range hosts {
+			if host.IsUnixSocket() {
+				continue
+			}
+
+			// 3306 -> 13306, the same way router create suggests ports
+			preferred, err := CalculateLocalPort(host.Remote)
+			if err != nil {
+				return err
+			}
+
+			local, err := registry.Resolve(GetPortKey(app, host), host.Local, preferred, isPortFree)
+			if err != nil {
+				return fmt.Errorf("can't assign local port to %s:%d: %w", host.Name, host.Remote, err)
+			}
+
+			if local != host.Local {
+				logger.Debug("Local port assigned from the registry", "host", host.Name, "remote", host.Remote, "configured", host.Local, "local", local)
+			}
+			hosts[i].Local = local
+		}
+
+		return nil
+	})
+}
+
+// CheckPortCollisions fails if two endpoints of the tunnel would listen on the same local port. Ports of endpoints
+// of other environments and profiles are refused by AssignLocalPorts.
+func CheckPortCollisions(app *config.Atun) error {
+	seen := map[string]config.Endpoint{}
+	for _, host := range app.Config.Hosts {
+		if host.IsUnixSocket() {
+			continue
+		}
+
+		address := host.GetTransport() + "/" + host.GetLocalAddress()
+		if other, ok := seen[address]; ok {
+			return fmt.Errorf("%s:%d and %s:%d both use local port %d. Set another local port or pin one with atun ports pin", other.Name, other.Remote, host.Name, host.Remote, host.Local)
+		}
+		seen[address] = host
+	}
+
+	return nil
+}
+
+// CheckPortConflicts fails if tunnels of several environments and profiles would listen on the same local port or socket.
+// It runs before any of the tunnels starts.
+func CheckPortConflicts(apps []*config.Atun) error {
+	type listener struct {
+		app  *config.Atun
+		name string
+	}
+
+	seen := map[string]listener{}
+	for _, app := range apps {
+		addresses := map[string]string{}
+		for _, host := range app.Config.Hosts {
+			if host.IsUnixSocket() {
+				addresses["unix/"+host.GetSocketPath()] = fmt.Sprintf("%s:%d", host.Name, host.Remote)
+				continue
+			}
+			addresses[host.GetTransport()+"/"+host.GetLocalAddress()] = fmt.Sprintf("%s:%d", host.Name, host.Remote)
+		}
+		if app.Config.SocksPort > 0 {
+			addresses[fmt.Sprintf("tcp/127.0.0.1:%d", app.Config.SocksPort)] = "SOCKS proxy"
+		}
+		if app.Config.HTTPProxyPort > 0 {
+			addresses[fmt.Sprintf("tcp/127.0.0.1:%d", app.Config.HTTPProxyPort)] = "HTTP proxy"
+		}
+
+		for address, name := range addresses {
+			if other, ok := seen[address]; ok && other.app != app {
+				return fmt.Errorf("%s of %s/%s and %s of %s/%s both listen on %s. Pin another local port with atun ports pin",
+					other.name, other.app.Config.AWSProfile, other.app.Config.Env, name, app.Config.AWSProfile, app.Config.Env, strings.SplitN(address, "/", 2)[1])
+			}
+			seen[address] = listener{app: app, name: name}
+		}
+	}
+
+	return nil
+}
+
+// SuggestLocalPort returns the local port of the endpoint from the port registry, assigning one no other endpoint
+// uses if it has none. It's suggested by router create, so new routers don't get the same port for the same remote port.
+func SuggestLocalPort(app *config.Atun, host config.Endpoint) (int, error) {
+	preferred, err := CalculateLocalPort(host.Remote)
+	if err != nil {
+		return 0, err
+	}
+
+	var local int
+	err = ports.Update(ports.GetRegistryPath(app.Config.AppDir), func(registry *ports.Registry) error {
+		local, err = registry.Resolve(GetPortKey(app, host), 0, preferred, isPortFree)
+		return err
+	})
+
+	return local, err
+}
+
+// isPortFree reports whether nothing listens on the loopback port
+func isPortFree(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
+
+// PortKeyFromArgs builds a registry key of the current profile and env from `<host> <remote port>` arguments
+func PortKeyFromArgs(app *config.Atun, host, remote string) (ports.Key, error) {
+	remotePort, err := strconv.Atoi(strings.TrimSpace(remote))
+	if err != nil || remotePort <= 0 || remotePort > 65535 {
+		return ports.Key{}, fmt.Errorf("invalid remote port %q", remote)
+	}
+
+	return GetPortKey(app, config.Endpoint{Name: host, Remote: remotePort}), nil
+}
@@ -0,0 +1,59 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package tunnel
+
+import (
+	"os"
+	"testing"
+
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/ports"
+)
+
+func TestSuggestLocalPort(t *testing.T) {
+	app := &config.Atun{Config: &config.Config{AppDir: t.TempDir(), Env: "dev", AWSProfile: "default"}}
+
+	first, err := SuggestLocalPort(app, config.Endpoint{Name: "orders.db.internal", Remote: 5432})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SuggestLocalPort(app, config.Endpoint{Name: "billing.db.internal", Remote: 5432})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both Postgres hosts got local port %d", first)
+	}
+
+	// The suggestion is kept for the endpoint
+	again, err := SuggestLocalPort(app, config.Endpoint{Name: "orders.db.internal", Remote: 5432})
+	if err != nil || again != first {
+		t.Fatalf("SuggestLocalPort() = %d, %v, want %d again", again, err, first)
+	}
+}
+
+func TestLookupLocalPorts(t *testing.T) {
+	app := &config.Atun{Config: &config.Config{AppDir: t.TempDir(), Env: "dev", AWSProfile: "default"}}
+
+	// Looking ports up doesn't assign any
+	hosts := []config.Endpoint{{Name: "db.internal", Remote: 5432}, {Name: "cache.internal", Remote: 6379, Local: 16379}}
+	if err := LookupLocalPorts(app, hosts); err != nil || hosts[0].Local != 0 || hosts[1].Local != 16379 {
+		t.Fatalf("LookupLocalPorts() = %+v, %v", hosts, err)
+	}
+	if _, err := os.Stat(ports.GetRegistryPath(app.Config.AppDir)); !os.IsNotExist(err) {
+		t.Fatalf("LookupLocalPorts() wrote the port registry: %v", err)
+	}
+
+	assigned := []config.Endpoint{{Name: "db.internal", Remote: 5432}, {Name: "cache.internal", Remote: 6379, Local: 16379}}
+	if err := AssignLocalPorts(app, assigned); err != nil || assigned[0].Local == 0 {
+		t.Fatalf("AssignLocalPorts() = %+v, %v", assigned, err)
+	}
+
+	hosts = []config.Endpoint{{Name: "db.internal", Remote: 5432}, {Name: "cache.internal", Remote: 6379, Local: 16379}}
+	if err := LookupLocalPorts(app, hosts); err != nil || hosts[0].Local != assigned[0].Local || hosts[1].Local != 16379 {
+		t.Fatalf("LookupLocalPorts() after AssignLocalPorts() = %+v, %v, want %+v", hosts, err, assigned)
+	}
+}
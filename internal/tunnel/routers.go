@@ -0,0 +1,67 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/automationd/atun/internal/aws"
+	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/logger"
+)
+
+// FindExpiredRouters returns the routers of all environments whose atun.io/expires-at tag has passed
+func FindExpiredRouters(now time.Time) ([]config.ExpiredRouter, error) {
+	instances, err := aws.ListInstancesWithTags(map[string]string{
+		"atun.io/version": config.App.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var routers []config.ExpiredRouter
+	for _, instance := range instances {
+		tags := make(map[string]string, len(instance.Tags))
+		for _, tag := range instance.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+
+		expired, expiresAt, err := config.RouterExpired(tags, now)
+		if err != nil {
+			logger.Warn("Skipping router", "id", *instance.InstanceId, "error", err)
+			continue
+		}
+		if !expired {
+			continue
+		}
+
+		router := config.ExpiredRouter{
+			ID:        *instance.InstanceId,
+			Env:       tags["atun.io/env"],
+			ExpiresAt: expiresAt,
+		}
+		if instance.SubnetId != nil {
+			router.SubnetID = *instance.SubnetId
+		}
+		if instance.VpcId != nil {
+			router.VPCID = *instance.VpcId
+		}
+		router.LocalState = hasLocalState(config.GetTunnelDir(config.App.Config.AppDir, router.Env, config.App.Config.AWSProfile), router.ID)
+
+		routers = append(routers, router)
+	}
+
+	return routers, nil
+}
+
+// hasLocalState reports whether the CDKTF state in the tunnel directory manages the instance
+func hasLocalState(tunnelDir, instanceID string) bool {
+	data, err := os.ReadFile(filepath.Join(tunnelDir, "terraform.tfstate"))
+	return err == nil && bytes.Contains(data, []byte(instanceID))
+}
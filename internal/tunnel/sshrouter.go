@@ -0,0 +1,69 @@
+/*
+ * SPDX-License-Identifier: Apache-2.0
+ * SPDX-FileCopyrightText: © 2025 Dmitry Kireev
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/automationd/atun/internal/config"
+)
+
+// LoadSSHRouter sets up the app for the SSH router of its environment ([ssh_routers.<env>] in atun.toml): the router,
+// its user and key, and its endpoints. Returns false when the environment has no SSH router and its router is an
+// EC2 instance to be discovered in AWS.
+func LoadSSHRouter(app *config.Atun) (bool, error) {
+	router, ok := app.Config.GetSSHRouter()
+	if !ok {
+		return false, nil
+	}
+
+	address, err := router.GetAddress()
+	if err != nil {
+		return true, fmt.Errorf("SSH router of env %s: %w", app.Config.Env, err)
+	}
+	if router.User == "" {
+		return true, fmt.Errorf("SSH router of env %s has no user", app.Config.Env)
+	}
+
+	var hosts []config.Endpoint
+	for _, endpoint := range router.Hosts {
+		if endpoint.Proto == "" {
+			endpoint.Proto = config.ProtoSSH
+		}
+
+		// SSM endpoints need an EC2 router
+		if endpoint.Proto != config.ProtoSSH && endpoint.Proto != config.ProtoK8s {
+			return true, fmt.Errorf("endpoint %s of the SSH router of env %s: protocol %s needs an EC2 router, use %s or %s", endpoint.Name, app.Config.Env, endpoint.Proto, config.ProtoSSH, config.ProtoK8s)
+		}
+
+		if err := checkEndpoint(&endpoint); err != nil {
+			return true, fmt.Errorf("endpoint %s of the SSH router of env %s: %w", endpoint.Name, app.Config.Env, err)
+		}
+
+		// Ports configured as 0 are assigned from the port registry by `atun up`
+		if endpoint.Local == 0 && !endpoint.IsUnixSocket() && !app.Config.AutoAllocatePort {
+			return true, fmt.Errorf("endpoint %s of the SSH router of env %s has no local port", endpoint.Name, app.Config.Env)
+		}
+
+		hosts = append(hosts, endpoint)
+	}
+
+	if err := LookupLocalPorts(app, hosts); err != nil {
+		return true, err
+	}
+
+	// The router is named after its host in the tunnel files and the status
+	host, _, _ := net.SplitHostPort(address)
+
+	app.Config.RouterHostID = host
+	app.Config.RouterAddress = address
+	app.Config.RouterHostUser = router.User
+	app.Config.SSHKeyPath = router.GetKeyPath(app.Config.SSHKeyPath)
+	app.Config.Hosts = hosts
+
+	return true, nil
+}
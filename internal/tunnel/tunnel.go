@@ -6,46 +6,33 @@
 package tunnel
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/constraints"
+	"github.com/automationd/atun/internal/daemon"
+	"github.com/automationd/atun/internal/health"
+	"github.com/automationd/atun/internal/k8s"
 	"github.com/automationd/atun/internal/logger"
 	"github.com/automationd/atun/internal/ssh"
+	"github.com/automationd/atun/internal/ux"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"log"
-	"net"
+	"github.com/pterm/pterm"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GetRouterHostIDFromTags retrieves the Router Endpoint ID from AWS tags.
 // It takes a session, tag name, and tag value as parameters and returns the instance ID of the Router Endpoint.
 func GetRouterHostIDFromTags() (string, error) {
-	// First try to find router host id from the running processes
-	activeSSHTunnels, err := ssh.GetActiveSSHTunnels()
-	if err != nil {
-		logger.Debug("Error getting running tunnels", "error", err)
-		return "", err
-	}
-
-	logger.Debug("Running tunnels", "tunnels", activeSSHTunnels)
-
-	if len(activeSSHTunnels) > 0 {
-		// Get the router host ID from the running tunnels
-		var activeOwnedTunnels []config.Config
-		// Check if any of the tunnels have the same RouterHostID
-		for _, v := range activeSSHTunnels {
-			if v.RouterHostID == config.App.Config.RouterHostID {
-				logger.Debug("Found active tunnel with the current RouterHostID", "routerHostID", config.App.Config.RouterHostID)
-				activeOwnedTunnels = append(activeOwnedTunnels, v)
-			}
-		}
-
-		if len(activeOwnedTunnels) < 1 {
-			logger.Debug(fmt.Sprintf("No active tunnels found with the current RouterHostID", "routerHostID", config.App.Config.RouterHostID))
-		}
+	// First try the router of a tunnel that is already running for the env and profile
+	if routerHostID, err := GetRouterHostIDFromDaemon(config.App); err == nil {
+		logger.Debug("Found running tunnel in the daemon", "routerHostID", routerHostID)
+		return routerHostID, nil
 	}
 
 	logger.Debug("Getting router host ID. Looking for atun routers.")
@@ -102,14 +89,6 @@ func GetRouterHostConfig(routerHostID string) (config.Atun, error) {
 		Config: &config.Config{}, // Ensure nested structs are initialized
 	}
 
-	sshUser, err := aws.GetInstanceUsername(routerHostID)
-	if err != nil {
-		logger.Error("Error getting instance username", "instance_id", routerHostID, "error", err)
-		return config.Atun{}, err
-	}
-
-	atun.Config.RouterHostUser = sshUser
-
 	for k, v := range tags {
 		// Iterate over the tags and use only atun.io tags
 		if strings.HasPrefix(k, "atun.io") {
@@ -120,42 +99,95 @@ func GetRouterHostConfig(routerHostID string) (config.Atun, error) {
 				atun.Version = v
 			case k == "atun.io/env":
 				atun.Config.Env = v
-			case strings.HasPrefix(k, "atun.io/host/"):
+			case strings.HasPrefix(k, config.ReverseTagPrefix):
+				name := strings.TrimPrefix(k, config.ReverseTagPrefix)
+
+				reverse, err := config.ParseReverseTag(name, v)
+				if err != nil {
+					logger.Error("Error unmarshalling reverse tags", "v", v, "name", name, "error", err)
+					continue
+				}
 
-				var endpoint config.Endpoint
+				atun.Config.Reverse = append(atun.Config.Reverse, reverse)
+			case strings.HasPrefix(k, config.HostTagPrefix):
+				name := strings.TrimPrefix(k, config.HostTagPrefix)
 
-				err := json.Unmarshal([]byte(v), &endpoint)
+				// The tag holds either a single port mapping or a list of them
+				endpoints, err := config.ParseHostTag(name, v)
 				if err != nil {
-					logger.Error("Error unmarshalling host tags", "v", v, "host", endpoint.Name, "error", err)
+					logger.Error("Error unmarshalling host tags", "v", v, "host", name, "error", err)
 					continue
 				}
 
-				endpoint.Name = strings.TrimPrefix(k, "atun.io/host/")
-
-				// Allocate free local port dynamically if set to 0
-				if endpoint.Local == 0 {
-					if config.App.Config.AutoAllocatePort {
-						port, err := getFreePort()
-						if err != nil {
-							return config.Atun{}, err
-						}
-						endpoint.Local = port
-					} else {
+				for _, endpoint := range endpoints {
+					// ssh endpoints go through an SSH router of atun.toml, EC2 routers are reached over SSM
+					if endpoint.Proto == config.ProtoSSH {
+						logger.Error("Unsupported endpoint protocol of an EC2 router", "host", endpoint.Name, "proto", endpoint.Proto)
+						continue
+					}
+
+					if err := checkEndpoint(&endpoint); err != nil {
+						logger.Error("Unsupported endpoint", "host", endpoint.Name, "error", err)
+						continue
+					}
+
+					// Ports configured as 0 are assigned from the port registry by `atun up`
+					if endpoint.Local == 0 && !endpoint.IsUnixSocket() && !config.App.Config.AutoAllocatePort {
 						err = fmt.Errorf("can't allocate port %d", endpoint.Local)
 						return config.Atun{}, err
 					}
-				}
 
-				// Append the host to the Hosts config
-				atun.Config.Hosts = append(atun.Config.Hosts, endpoint)
+					// Append the host to the Hosts config
+					atun.Config.Hosts = append(atun.Config.Hosts, endpoint)
+				}
 			}
 		}
 	}
 
+	// The SSH user only matters when endpoints go through SSH. ssm-direct endpoints work with an unknown user.
+	if atun.Config.RequiresSSH() {
+		sshUser, err := aws.GetInstanceUsername(routerHostID)
+		if err != nil {
+			logger.Error("Error getting instance username", "instance_id", routerHostID, "error", err)
+			return config.Atun{}, err
+		}
+
+		atun.Config.RouterHostUser = sshUser
+	}
+
+	if err := LookupLocalPorts(config.App, atun.Config.Hosts); err != nil {
+		return config.Atun{}, err
+	}
+
 	return atun, nil
 
 }
 
+// checkEndpoint validates the protocol and transport of an endpoint of the router config.
+// A bad health check shouldn't take the endpoint away, it falls back to the check picked by the port.
+func checkEndpoint(endpoint *config.Endpoint) error {
+	if !config.IsValidProto(endpoint.Proto) {
+		return fmt.Errorf("unsupported protocol %q, expected one of %s", endpoint.Proto, strings.Join(config.Protos, ", "))
+	}
+
+	if endpoint.Proto == config.ProtoK8s {
+		if _, err := k8s.ParseTarget(endpoint.Name); err != nil {
+			return err
+		}
+	}
+
+	if !config.IsValidTransport(endpoint.Transport) || (endpoint.IsUDP() && !endpoint.RequiresSSH()) {
+		return fmt.Errorf("unsupported transport %q for protocol %s", endpoint.Transport, endpoint.Proto)
+	}
+
+	if !health.IsValidCheck(endpoint.Health) {
+		logger.Error("Unsupported endpoint health check", "host", endpoint.Name, "health", endpoint.Health, "supported", health.Checks)
+		endpoint.Health = health.CheckAuto
+	}
+
+	return nil
+}
+
 // SetAWSCredentials sets AWS credentials as environment variables
 func SetAWSCredentials(sess *session.Session) error {
 	v, err := sess.Config.Credentials.Get()
@@ -179,12 +211,111 @@ func SetAWSCredentials(sess *session.Session) error {
 	return nil
 }
 
+// daemonRequestTimeout bounds daemon requests that don't start a tunnel
+const daemonRequestTimeout = 15 * time.Second
+
+// GetRouterHostIDFromDaemon returns the router of the tunnel the daemon runs for the env and profile
+func GetRouterHostIDFromDaemon(app *config.Atun) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonRequestTimeout)
+	defer cancel()
+
+	client, err := daemon.Connect(ctx, app.Config.AppDir)
+	if err != nil {
+		return "", err
+	}
+
+	tunnels, err := client.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range tunnels {
+		if t.Env == app.Config.Env && t.AWSProfile == app.Config.AWSProfile {
+			return t.RouterHostID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no tunnel running for env %s and profile %s", app.Config.Env, app.Config.AWSProfile)
+}
+
+// getDaemonCredentials returns the credentials of the app session to hand over to the daemon
+func getDaemonCredentials(sess *session.Session) (*daemon.Credentials, error) {
+	v, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("can't get AWS credentials: %w", err)
+	}
+
+	credentials := &daemon.Credentials{
+		AccessKeyID:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		SessionToken:    v.SessionToken,
+	}
+
+	// Not every provider knows when its credentials expire
+	if expires, err := sess.Config.Credentials.ExpiresAt(); err == nil {
+		credentials.Expires = expires
+	}
+
+	return credentials, nil
+}
+
+// startDaemonTunnel starts the daemon if needed and asks it to bring the tunnel up
+func startDaemonTunnel(app *config.Atun) error {
+	// SSH routers don't need AWS credentials
+	var credentials *daemon.Credentials
+	if !app.Config.IsSSHRouter() {
+		var err error
+		if credentials, err = getDaemonCredentials(app.Session); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+
+	client, err := daemon.EnsureRunning(ctx, app.Config.AppDir, app.Config.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Start(ctx, daemon.StartRequest{Spec: newDaemonSpec(app), Credentials: credentials})
+	return err
+}
+
+// refreshDaemonTunnel hands fresh credentials over to a running daemon tunnel, so it can keep reconnecting.
+// Fails with daemon.ErrConflict if the tunnel runs with another spec.
+func refreshDaemonTunnel(app *config.Atun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonRequestTimeout)
+	defer cancel()
+
+	client, err := daemon.Connect(ctx, app.Config.AppDir)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Get(ctx, ssh.GetTunnelID(app)); err != nil {
+		return err
+	}
+
+	// SSH routers don't need AWS credentials
+	var credentials *daemon.Credentials
+	if !app.Config.IsSSHRouter() {
+		if credentials, err = getDaemonCredentials(app.Session); err != nil {
+			return err
+		}
+	}
+
+	_, err = client.Start(ctx, daemon.StartRequest{Spec: newDaemonSpec(app), Credentials: credentials})
+	return err
+}
+
 // ActivateTunnel starts the SSH tunnel and SSM plugin
 func ActivateTunnel(app *config.Atun) (bool, []ssh.Endpoint, error) {
 	logger.Debug("Starting tunnel", "router", app.Config.RouterHostID, "SSHKeyPath", app.Config.SSHKeyPath, "SSHConfigFile", app.Config.SSHConfigFile, "env", app.Config.Env)
 
-	if err := SetAWSCredentials(app.Session); err != nil {
-		return false, nil, fmt.Errorf("can't start tunnel: %w", err)
+	if !app.Config.IsSSHRouter() {
+		if err := SetAWSCredentials(app.Session); err != nil {
+			return false, nil, fmt.Errorf("can't start tunnel: %w", err)
+		}
 	}
 
 	// Check if tunnel already exists
@@ -195,21 +326,14 @@ func ActivateTunnel(app *config.Atun) (bool, []ssh.Endpoint, error) {
 
 	// If tunnel is not up
 	if !tunnelIsUp {
-		// Check if SSMPlugin is running
-		ssmPluginIsRunning, err := ssh.GetSSMPluginStatus(app)
-		if err != nil {
-			return tunnelIsUp, nil, fmt.Errorf("can't check SSM plugin: %w", err)
-		}
-
-		if ssmPluginIsRunning {
-			return tunnelIsUp, nil, fmt.Errorf("Tunnel is down but SSM plugin is already running with router host %s", app.Config.RouterHostID)
-		}
-
-		// Start SSH Tunnel
-		err = ssh.StartSSHTunnel(app)
-		if err != nil {
+		// The daemon owns the tunnel, so it outlives this process
+		if err := startDaemonTunnel(app); err != nil {
 			return tunnelIsUp, nil, err
 		}
+	} else if err := refreshDaemonTunnel(app); errors.Is(err, daemon.ErrConflict) {
+		return tunnelIsUp, connections, err
+	} else if err != nil {
+		logger.Debug("Can't refresh tunnel credentials", "error", err)
 	}
 	// Check for status and collect connections again
 	tunnelIsUp, connections, err = ssh.GetSSHTunnelStatus(app)
@@ -218,19 +342,19 @@ func ActivateTunnel(app *config.Atun) (bool, []ssh.Endpoint, error) {
 
 // DeactivateTunnel stops the SSH tunnel and SSM plugin
 func DeactivateTunnel(app *config.Atun) (bool, error) {
-	tunnelActive, err := ssh.StopSSHTunnel(app)
-	if err != nil {
-		return false, err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), daemonRequestTimeout)
+	defer cancel()
 
-	err = ssh.TerminateSSHProcessesWithRouterHostID(app.Config.RouterHostID)
-	if err != nil {
-		logger.Debug("Can't terminate SSH processes", "error", err)
+	if client, err := daemon.Connect(ctx, app.Config.AppDir); err == nil {
+		if err := client.Stop(ctx, ssh.GetTunnelID(app)); err != nil && !errors.Is(err, daemon.ErrNotFound) {
+			logger.Debug("Can't stop tunnel in the daemon", "error", err)
+		}
 	}
 
-	err = ssh.TerminateSSMProcessesWithRouterHostID(app.Config.RouterHostID)
+	// Tunnels running in the foreground are asked to exit over their socket
+	tunnelActive, err := ssh.StopSSHTunnel(app)
 	if err != nil {
-		logger.Debug("Can't terminate SSM processes", "error", err)
+		return false, err
 	}
 
 	// Re-check status
@@ -239,27 +363,6 @@ func DeactivateTunnel(app *config.Atun) (bool, error) {
 	return tunnelActive, nil
 }
 
-// TODO: Fix auto-assign port logic
-func getFreePort() (int, error) {
-	// TODO: start from 50000 and find first free port
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", 0))
-	if err != nil {
-		return 0, err
-	}
-
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return 0, err
-	}
-	defer func(l *net.TCPListener) {
-		err := l.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}(l)
-	return l.Addr().(*net.TCPAddr).Port, nil
-}
-
 // CalculateLocalPort converts a remote port to a 5-digit local port.
 // It prefixes "1" or "10" based on the port number.
 // Calculate default Local port from defaultRemotePort. So 3306 would become 13306 and 5006 would become 15006. Take the port number and concat 1 or 10 to it so it becomes 5-digit
@@ -288,66 +391,82 @@ func CalculateLocalPort(remotePort int) (int, error) {
 	return remotePort, nil
 }
 
-// TODO: Fix checkPort logic
-//func checkPort(port int, dir string) error {
-//	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-//	if err != nil {
-//		return fmt.Errorf("can't check address %s: %w", fmt.Sprintf("127.0.0.1:%d", port), err)
-//	}
-//
-//	l, err := net.ListenTCP("tcp", addr)
-//	if err != nil {
-//		command := fmt.Sprintf("lsof -i tcp:%d | grep LISTEN | awk '{print $1, $2}'", port)
-//		stdout, stderr, code, err := term.New(term.WithStdout(io.Discard), term.WithStderr(io.Discard)).Run(exec.Command("bash", "-c", command))
-//		if err != nil {
-//			return fmt.Errorf("can't run command '%s': %w", command, err)
-//		}
-//		if code == 0 {
-//			stdout = strings.TrimSpace(stdout)
-//			processName := strings.Split(stdout, " ")[0]
-//			processPid, err := strconv.Atoi(strings.Split(stdout, " ")[1])
-//			if err != nil {
-//				return fmt.Errorf("can't get pid: %w", err)
-//			}
-//			pterm.Info.Printfln("Can't start tunnel on port %d. It seems like it's take by a process '%s'.", port, processName)
-//			proc, err := os.FindProcess(processPid)
-//			if err != nil {
-//				return fmt.Errorf("can't find process: %w", err)
-//			}
-//
-//			_, err = os.Stat(filepath.Join(dir, "router.sock"))
-//			if processName == "ssh" && os.IsNotExist(err) {
-//				return fmt.Errorf("it could be another ize tunnel, but we can't find a socket. Something went wrong. We suggest terminating it and starting it up again")
-//			}
-//			isContinue := false
-//			if terminal.IsTerminal(int(os.Stdout.Fd())) {
-//				isContinue, err = pterm.DefaultInteractiveConfirm.WithDefaultText("Would you like to terminate it?").Show()
-//				if err != nil {
-//					return err
-//				}
-//			} else {
-//				isContinue = true
-//			}
-//
-//			if !isContinue {
-//				return fmt.Errorf("destroying was canceled")
-//			}
-//			err = proc.Kill()
-//			if err != nil {
-//				return fmt.Errorf("can't kill process: %w", err)
-//			}
-//
-//			pterm.Info.Printfln("Process '%s' (pid %d) was killed", processName, processPid)
-//
-//			return nil
-//		}
-//		return fmt.Errorf("error during run command: %s (exit code: %d, stderr: %s)", command, code, stderr)
-//	}
-//
-//	err = l.Close()
-//	if err != nil {
-//		return err
-//	}
-//
-//	return nil
-//}
+// CheckPorts makes sure the local ends of the endpoints are free before the tunnel starts.
+// A process holding one of them can be terminated after confirmation.
+func CheckPorts(app *config.Atun) error {
+	tunnelIsUp, endpoints, err := ssh.GetSSHTunnelStatus(app)
+	if err != nil {
+		return fmt.Errorf("can't check tunnel: %w", err)
+	}
+
+	// The ports are held by the tunnel itself
+	if tunnelIsUp {
+		return nil
+	}
+
+	for _, endpoint := range endpoints {
+		// Reverse endpoints listen on the router
+		if endpoint.Reverse {
+			continue
+		}
+		if err := checkPort(endpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkPort(endpoint ssh.Endpoint) error {
+	address := endpoint.LocalAddress()
+
+	occupied, owner, err := ssh.CheckPort(endpoint)
+	if !occupied {
+		return err
+	}
+
+	if owner == nil {
+		return fmt.Errorf("can't start tunnel on %s, it's taken by a process that can't be identified: %w", address, err)
+	}
+
+	// Another tunnel is brought down with `atun down`, killing it would leave its state behind
+	if owner.Atun {
+		return fmt.Errorf("can't start tunnel on %s, it's taken by another atun tunnel %s. Bring it down with atun down", address, owner)
+	}
+
+	pterm.Info.Printfln("Can't start tunnel on %s. It seems like it's taken by a process %s.", address, owner)
+	logger.Debug("Port owner", "pid", owner.PID, "name", owner.Name, "cmdline", owner.Cmdline)
+
+	// Unlike an interactive session, a script doesn't get to say no, so nothing is terminated without asking
+	if !constraints.IsInteractiveTerminal() {
+		return fmt.Errorf("%s is taken by %s", address, owner)
+	}
+
+	terminate, err := ux.GetConfirmation("Would you like to terminate it?", false)
+	if err != nil {
+		return err
+	}
+	if !terminate {
+		return fmt.Errorf("%s is taken by %s and terminating was canceled", address, owner)
+	}
+
+	proc, err := os.FindProcess(owner.PID)
+	if err != nil {
+		return fmt.Errorf("can't find process: %w", err)
+	}
+	if err := proc.Kill(); err != nil {
+		return fmt.Errorf("can't kill process: %w", err)
+	}
+
+	pterm.Info.Printfln("Process %s was killed", owner)
+
+	// The port is released once the process is gone
+	for i := 0; i < 20; i++ {
+		if occupied, _, _ := ssh.CheckPort(endpoint); !occupied {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("%s is still taken after terminating %s", address, owner)
+}
@@ -64,6 +64,7 @@ func RenderAsciiArt() {
 
 	// Animation loop
 	go func() {
+		defer close(stopChan)
 		for {
 			select {
 			case <-ticker.C:
@@ -99,7 +100,6 @@ func RenderAsciiArt() {
 				}
 			}
 		}
-		close(stopChan)
 	}()
 
 	<-stopChan
@@ -6,10 +6,15 @@
 package ux
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/automationd/atun/internal/audit"
 	"github.com/automationd/atun/internal/aws"
 	"github.com/automationd/atun/internal/config"
+	"github.com/automationd/atun/internal/daemon"
+	"github.com/automationd/atun/internal/health"
 	"github.com/automationd/atun/internal/logger"
+	"github.com/automationd/atun/internal/ports"
 	"github.com/automationd/atun/internal/ssh"
 	"github.com/pterm/pterm"
 	"io"
@@ -318,11 +323,27 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 		downStatusLabel = " ⏹ ︎"
 	}
 
+	// Connections and traffic of the endpoints only fit wide terminals
+	showTraffic := terminalWidth >= 100
+
 	var rows [][]string
 	var remoteRowMaxLength int
 	var localRowMaxLength int
 
-	for _, endpoint := range endpoints {
+	// Keep port mappings of the same host together
+	sortedEndpoints := make([]ssh.Endpoint, len(endpoints))
+	copy(sortedEndpoints, endpoints)
+	sort.SliceStable(sortedEndpoints, func(i, j int) bool {
+		if sortedEndpoints[i].RemoteHost != sortedEndpoints[j].RemoteHost {
+			return sortedEndpoints[i].RemoteHost < sortedEndpoints[j].RemoteHost
+		}
+		if sortedEndpoints[i].RemotePort != sortedEndpoints[j].RemotePort {
+			return sortedEndpoints[i].RemotePort < sortedEndpoints[j].RemotePort
+		}
+		return sortedEndpoints[i].Transport < sortedEndpoints[j].Transport
+	})
+
+	for _, endpoint := range sortedEndpoints {
 		// Construct each field separately to measure actual lengths
 		statusCol := pterm.NewStyle(
 			pterm.FgBlack,
@@ -335,11 +356,27 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 				pterm.BgRed,
 				pterm.Bold,
 			).Sprint(downStatusLabel)
+		} else if endpoint.Health != "" || endpoint.Armed {
+			statusCol = renderHealth(endpoint, terminalWidth < 45)
 		}
 
-		localCol := fmt.Sprintf("%s:%d", endpoint.LocalHost, endpoint.LocalPort)
+		localCol := endpoint.LocalAddress()
 		fullRemoteCol := fmt.Sprintf("%s:%v", endpoint.RemoteHost, endpoint.RemotePort)
 
+		// TCP is implied, other transports are labeled
+		if endpoint.Transport == config.TransportUDP {
+			localCol += " UDP"
+		}
+		// Reverse endpoints listen on the router and forward to the local machine
+		if endpoint.Reverse {
+			localCol += " REVERSE"
+		}
+		// Proxy endpoints connect to any host the client asks for
+		if endpoint.Proxy != "" {
+			fullRemoteCol = "*"
+			localCol += " " + strings.ToUpper(endpoint.Proxy)
+		}
+
 		// Measure actual column widths
 		statusWidth := len(stripANSI(statusCol))
 		localWidth := len(localCol)
@@ -354,6 +391,14 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 			padding = 14
 		}
 
+		var trafficCols []string
+		if showTraffic {
+			trafficCols = renderTraffic(endpoint)
+			for _, col := range trafficCols {
+				padding += len(col) + 3
+			}
+		}
+
 		estimatedWidth := statusWidth + remoteWidth + localWidth + padding
 
 		// If the table is too wide, shorten Remote column
@@ -369,7 +414,12 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 		localColFinal := localCol
 		if terminalWidth < 60 {
 			availableLocalWidth := max(5, terminalWidth-statusWidth-len(remoteCol)-padding)
-			if len(endpoint.LocalHost) > availableLocalWidth-10 {
+			if endpoint.LocalSocket != "" {
+				// Socket paths are shortened from the left, the file name matters most
+				if len(localCol) > availableLocalWidth {
+					localColFinal = "..." + localCol[len(localCol)-max(availableLocalWidth-3, 1):]
+				}
+			} else if len(endpoint.LocalHost) > availableLocalWidth-10 {
 				localColFinal = fmt.Sprintf("%s...:%d", endpoint.LocalHost[:max(availableLocalWidth-10, 0)], endpoint.LocalPort)
 			}
 		}
@@ -381,7 +431,7 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 			localRowMaxLength = len(localColFinal)
 		}
 
-		row := []string{statusCol, remoteCol, localColFinal}
+		row := append([]string{statusCol, remoteCol, localColFinal}, trafficCols...)
 		rows = append(rows, row)
 	}
 
@@ -389,6 +439,9 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 	centeredLocalHeaderLabel := centerText(localHeaderLabel, localRowMaxLength)
 
 	header := []string{statusHeaderLabel, centeredRemoteHeaderLabel, centeredLocalHeaderLabel}
+	if showTraffic {
+		header = append(header, "Conns", "In", "Out", "Last Activity")
+	}
 
 	// Set table data (header + rows)
 	data := append([][]string{header}, rows...)
@@ -435,6 +488,79 @@ func RenderEndpointsTable(endpoints []ssh.Endpoint) error {
 	return nil
 }
 
+// renderTraffic renders the connections (active/total), traffic and last activity columns of an endpoint
+func renderTraffic(endpoint ssh.Endpoint) []string {
+	if !endpoint.Status && endpoint.TotalConnections == 0 {
+		return []string{"-", "-", "-", "-"}
+	}
+
+	lastActivity := "never"
+	if !endpoint.LastActivity.IsZero() {
+		lastActivity = time.Since(endpoint.LastActivity).Round(time.Second).String() + " ago"
+	}
+
+	return []string{
+		fmt.Sprintf("%d/%d", endpoint.ActiveConnections, endpoint.TotalConnections),
+		formatBytes(endpoint.BytesIn),
+		formatBytes(endpoint.BytesOut),
+		lastActivity,
+	}
+}
+
+// formatBytes renders a byte count in binary units (e.g. 1.5 MiB)
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// renderHealth renders the status column of an endpoint probed through the tunnel (see ssh.CheckEndpoints).
+// Armed endpoints of a lazy tunnel aren't probed.
+func renderHealth(endpoint ssh.Endpoint, narrow bool) string {
+	var label string
+	var style *pterm.Style
+
+	state := endpoint.Health
+	if endpoint.Armed {
+		state = health.StateArmed
+	}
+
+	switch state {
+	case health.StateHealthy:
+		label, style = " HEALTHY ", pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgGreen)
+	case health.StateReachable:
+		label, style = "REACHABLE", pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgLightGreen)
+	case health.StateFailing:
+		label, style = " FAILING ", pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgYellow)
+	case health.StateDown:
+		label, style = "  DOWN   ", pterm.NewStyle(pterm.FgLightWhite, pterm.Bold, pterm.BgRed)
+	case health.StateArmed:
+		label, style = "  ARMED  ", pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgCyan)
+	default:
+		label, style = "LISTENING", pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgLightBlue)
+	}
+
+	if narrow {
+		label = " " + string(strings.ToUpper(string(state))[0]) + " "
+	}
+
+	statusCol := style.Sprint(label)
+	if endpoint.Latency > 0 && !narrow {
+		statusCol += fmt.Sprintf(" %4dms", endpoint.Latency.Milliseconds())
+	}
+
+	return statusCol
+}
+
 // Helper function to strip ANSI escape codes from a string for correct width calculation
 func stripANSI(input string) string {
 	re := regexp.MustCompile(`\x1B\[[0-9;]*[mK]`)
@@ -548,6 +674,218 @@ func RenderRouterTable(routers []config.RouterInfo) {
 	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
 }
 
+// RenderExpiredRoutersTable displays the routers found by `atun router gc` and what happens to them
+func RenderExpiredRoutersTable(routers []config.ExpiredRouter, stop bool) {
+	if len(routers) == 0 {
+		logger.Info("No expired routers found")
+		return
+	}
+
+	tableData := [][]string{
+		{"ID", "ENV", "EXPIRED", "ACTION"},
+	}
+
+	for _, router := range routers {
+		action := "stop (created on another machine)"
+		if stop {
+			action = "stop"
+		} else if router.LocalState {
+			action = "destroy"
+		}
+
+		tableData = append(tableData, []string{
+			router.ID,
+			router.Env,
+			fmt.Sprintf("%s ago", time.Since(router.ExpiresAt).Round(time.Minute)),
+			action,
+		})
+	}
+
+	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
+// RenderDaemonTunnelsTable displays a formatted table of the tunnels owned by `atun daemon`
+func RenderDaemonTunnelsTable(tunnels []daemon.Tunnel) {
+	if len(tunnels) == 0 {
+		logger.Info("No tunnels running in the daemon")
+		return
+	}
+
+	tableData := [][]string{
+		{"ENV", "PROFILE", "ROUTER", "STATE", "ENDPOINTS", "UPTIME", "RECONNECTS"},
+	}
+
+	for _, t := range tunnels {
+		up := 0
+		for _, e := range t.Endpoints {
+			if e.Status {
+				up++
+			}
+		}
+
+		tableData = append(tableData, []string{
+			t.Env,
+			t.AWSProfile,
+			t.RouterHostID,
+			string(t.State),
+			fmt.Sprintf("%d/%d", up, len(t.Endpoints)),
+			time.Since(t.StartedAt).Round(time.Second).String(),
+			fmt.Sprintf("%d", t.Reconnects),
+		})
+	}
+
+	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
+// TunnelOverview is a row group of `atun status --all`: a running tunnel, or an env and profile without one
+type TunnelOverview struct {
+	Env          string         `json:"env"`
+	AWSProfile   string         `json:"aws_profile"`
+	AWSRegion    string         `json:"aws_region"`
+	RouterHostID string         `json:"router_host_id"`
+	Running      bool           `json:"running"`
+	StartedAt    time.Time      `json:"started_at"`
+	Endpoints    []ssh.Endpoint `json:"endpoints"`
+}
+
+// RenderTunnelsOverview renders the tunnels of all environments and profiles of the machine, one row per endpoint
+func RenderTunnelsOverview(tunnels []TunnelOverview) {
+	if len(tunnels) == 0 {
+		logger.Info("No tunnels are running on this machine")
+		return
+	}
+
+	tableData := [][]string{
+		{"ENV", "PROFILE", "REGION", "ROUTER", "UPTIME", "REMOTE", "LOCAL", "STATUS"},
+	}
+
+	down := pterm.NewStyle(pterm.FgLightWhite, pterm.BgRed, pterm.Bold).Sprint(" DOWN ")
+	up := pterm.NewStyle(pterm.FgBlack, pterm.Bold, pterm.BgGreen).Sprint("  UP  ")
+
+	for _, t := range tunnels {
+		uptime := ""
+		if t.Running && !t.StartedAt.IsZero() {
+			uptime = time.Since(t.StartedAt).Round(time.Second).String()
+		}
+
+		tunnelCols := []string{t.Env, t.AWSProfile, t.AWSRegion, t.RouterHostID, uptime}
+
+		if !t.Running || len(t.Endpoints) == 0 {
+			tableData = append(tableData, append(tunnelCols, "", "", down))
+			continue
+		}
+
+		for i, endpoint := range t.Endpoints {
+			// The tunnel columns are only filled on its first row
+			cols := tunnelCols
+			if i > 0 {
+				cols = []string{"", "", "", "", ""}
+			}
+
+			remote := fmt.Sprintf("%s:%d", endpoint.RemoteHost, endpoint.RemotePort)
+			local := endpoint.LocalAddress()
+			if endpoint.Proxy != "" {
+				remote = "*"
+				local += " " + strings.ToUpper(endpoint.Proxy)
+			}
+			if endpoint.Reverse {
+				local += " REVERSE"
+			}
+
+			status := down
+			if endpoint.Status && (endpoint.Health != "" || endpoint.Armed) {
+				status = renderHealth(endpoint, false)
+			} else if endpoint.Status {
+				status = up
+			}
+
+			tableData = append(tableData, append(append([]string{}, cols...), remote, local, status))
+		}
+	}
+
+	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
+// RenderJSON prints v as indented JSON, for scripts and monitoring
+func RenderJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
+
+// RenderHistoryTable renders the tunnel sessions of `atun history`, newest first
+func RenderHistoryTable(sessions []audit.Session) {
+	if len(sessions) == 0 {
+		logger.Info("No tunnel sessions recorded")
+		return
+	}
+
+	tableData := [][]string{
+		{"STARTED", "DURATION", "USER", "IDENTITY", "PROFILE", "ENV", "ROUTER", "ENDPOINTS", "EXIT"},
+	}
+
+	for _, s := range sessions {
+		// Running, or the process running it was killed
+		duration := "-"
+		exit := "no stop recorded"
+		if !s.StoppedAt.IsZero() {
+			duration = s.StoppedAt.Sub(s.StartedAt).Round(time.Second).String()
+			exit = s.ExitReason
+			if s.Error != "" {
+				exit += ": " + s.Error
+			}
+		}
+
+		tableData = append(tableData, []string{
+			s.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			duration,
+			s.User,
+			s.CallerARN,
+			s.AWSProfile,
+			s.Env,
+			s.RouterHostID,
+			strings.Join(s.Endpoints, "\n"),
+			exit,
+		})
+	}
+
+	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
+// RenderPortsTable renders the local port assignments of the port registry
+func RenderPortsTable(assignments []ports.Assignment) {
+	if len(assignments) == 0 {
+		logger.Info("No local ports assigned yet")
+		return
+	}
+
+	tableData := [][]string{
+		{"PROFILE", "ENV", "HOST", "REMOTE", "LOCAL", "PINNED"},
+	}
+
+	for _, a := range assignments {
+		pinned := ""
+		if a.Pinned {
+			pinned = "yes"
+		}
+
+		tableData = append(tableData, []string{
+			a.Profile,
+			a.Env,
+			a.Host,
+			fmt.Sprintf("%d", a.Remote),
+			fmt.Sprintf("%d", a.Local),
+			pinned,
+		})
+	}
+
+	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+}
+
 func RenderDetailedStatus() {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -568,6 +906,7 @@ func RenderDetailedStatus() {
 		{"Router Endpoint User", config.App.Config.RouterHostUser},
 		{"Socket Path", ssh.GetRouterSockFilePath(config.App)},
 		{"SSH Config File", ssh.GetSSHConfigFilePath(config.App)},
+		{"Daemon Log", daemon.GetLogFilePath(config.App.Config.AppDir)},
 		{"Log Level", config.App.Config.LogLevel},
 
 		//{"Toggle", toggleValue},
@@ -42,6 +42,7 @@ export default defineConfig({
         text: 'Features',
         items: [
           { text: 'EC2 Router', link: '/guide/ec2-router' },
+          { text: 'SSH Router', link: '/guide/ssh-router' },
           { text: 'Tag Schema', link: '/guide/tag-schema' }
         ]
       },